@@ -0,0 +1,122 @@
+package blocklist
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often the file is checked for changes
+const reloadInterval = 30 * time.Second
+
+// Blocklist is a set of blocked address ranges loaded from a file, safe to
+// use from any goroutine. A nil Blocklist blocks nothing.
+type Blocklist struct {
+	mutex   sync.RWMutex
+	path    string
+	ranges  []ipRange
+	modTime time.Time
+	size    int64
+}
+
+// Load reads a blocklist file in P2P, eMule DAT or CIDR format
+func Load(path string) (*Blocklist, error) {
+	blocklist := &Blocklist{path: path}
+	err := blocklist.reload()
+	if err != nil {
+		return nil, err
+	}
+	return blocklist, nil
+}
+
+func (blocklist *Blocklist) reload() error {
+	file, err := os.Open(blocklist.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	ranges, invalid, err := parse(file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %v blocked ranges from %v, skipped %v invalid lines\n", len(ranges), blocklist.path, invalid)
+
+	blocklist.mutex.Lock()
+	defer blocklist.mutex.Unlock()
+
+	blocklist.ranges = ranges
+	blocklist.modTime = info.ModTime()
+	blocklist.size = info.Size()
+	return nil
+}
+
+// changed reports whether the file was modified since it was loaded
+func (blocklist *Blocklist) changed() bool {
+	info, err := os.Stat(blocklist.path)
+	if err != nil {
+		return false
+	}
+
+	blocklist.mutex.RLock()
+	defer blocklist.mutex.RUnlock()
+
+	return !info.ModTime().Equal(blocklist.modTime) || info.Size() != blocklist.size
+}
+
+// Watch reloads the file whenever it changes until the context is done. A
+// file that fails to load keeps the ranges loaded before.
+func (blocklist *Blocklist) Watch(ctx context.Context) {
+	blocklist.watch(ctx, reloadInterval)
+}
+
+func (blocklist *Blocklist) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if !blocklist.changed() {
+			continue
+		}
+		err := blocklist.reload()
+		if err != nil {
+			fmt.Printf("Can't reload blocklist %v, %v\n", blocklist.path, err)
+		}
+	}
+}
+
+// Contains reports whether an address is blocked
+func (blocklist *Blocklist) Contains(ip net.IP) bool {
+	if blocklist == nil {
+		return false
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+
+	blocklist.mutex.RLock()
+	defer blocklist.mutex.RUnlock()
+
+	// The last range starting at or before the address
+	i := sort.Search(len(blocklist.ranges), func(i int) bool {
+		return bytes.Compare(blocklist.ranges[i].start, ip) > 0
+	})
+	return i > 0 && bytes.Compare(ip, blocklist.ranges[i-1].end) <= 0
+}
@@ -0,0 +1,215 @@
+package blocklist
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rangeStrings formats ranges as start-end
+func rangeStrings(ranges []ipRange) []string {
+	formatted := []string{}
+	for _, entry := range ranges {
+		formatted = append(formatted, entry.start.String()+"-"+entry.end.String())
+	}
+	return formatted
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   string
+		ranges  string
+		invalid int
+	}{
+		{"P2P", "Some org:1.2.3.0-1.2.3.255", "1.2.3.0-1.2.3.255", 0},
+		{"P2P with colons in the description", "a: b:c:1.2.3.4 - 1.2.3.5", "1.2.3.4-1.2.3.5", 0},
+		{"P2P single address", "someone:1.2.3.4", "1.2.3.4-1.2.3.4", 0},
+		{"DAT", "001.002.003.000 - 001.002.003.255 , 000 , desc", "1.2.3.0-1.2.3.255", 0},
+		{"DAT zero padded octets", "010.000.000.008 - 010.000.000.099 , 100 , not octal", "10.0.0.8-10.0.0.99", 0},
+		{"DAT below the blocked level", "1.2.3.0 - 1.2.3.255 , 127 , blocked", "1.2.3.0-1.2.3.255", 0},
+		{"DAT at the blocked level", "1.2.3.0 - 1.2.3.255 , 128 , allowed", "", 0},
+		{"DAT above the blocked level", "1.2.3.0 - 1.2.3.255 , 255 , allowed", "", 0},
+		{"DAT without a description", "1.2.3.0 - 1.2.3.255 , 0", "1.2.3.0-1.2.3.255", 0},
+		{"CIDR", "10.0.0.0/8", "10.0.0.0-10.255.255.255", 0},
+		{"CIDR of one address", "10.1.2.3/32", "10.1.2.3-10.1.2.3", 0},
+		{"unaligned CIDR", "10.1.2.3/24", "10.1.2.0-10.1.2.255", 0},
+		{"single address", "1.2.3.4", "1.2.3.4-1.2.3.4", 0},
+		{"IPv6 CIDR", "2001:db8::/32", "2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", 0},
+		{"IPv6 range", "2001:db8::1-2001:db8::ff", "2001:db8::1-2001:db8::ff", 0},
+		{"IPv6 single address", "2001:db8::1", "2001:db8::1-2001:db8::1", 0},
+		{"IPv6 P2P", "v6 host:2001:db8::1-2001:db8::2", "2001:db8::1-2001:db8::2", 0},
+		{"comments and blank lines", "# comment\n\n   \n// comment\n1.2.3.4", "1.2.3.4-1.2.3.4", 0},
+		{"garbage", "garbage", "", 1},
+		{"octet out of range", "1.2.3.256", "", 1},
+		{"reversed range", "1.2.3.5-1.2.3.4", "", 1},
+		{"too many dashes", "1.2.3.4-1.2.3.5-1.2.3.6", "", 1},
+		{"invalid DAT level", "1.2.3.0 - 1.2.3.255 , high , desc", "", 1},
+		{"invalid lines skipped", "garbage\n1.2.3.4\nname:nothing", "1.2.3.4-1.2.3.4", 2},
+	}
+	for _, test := range tests {
+		ranges, invalid, err := parse(strings.NewReader(test.lines))
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if got := strings.Join(rangeStrings(ranges), " "); got != test.ranges || invalid != test.invalid {
+			t.Errorf("%v: got %q with %v invalid, want %q with %v", test.name, got, invalid, test.ranges, test.invalid)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		ranges string
+	}{
+		{"overlapping", []string{"1.0.0.0-1.0.0.10", "1.0.0.5-1.0.0.20"}, "1.0.0.0-1.0.0.20"},
+		{"contained", []string{"1.0.0.0-1.0.0.20", "1.0.0.7-1.0.0.8"}, "1.0.0.0-1.0.0.20"},
+		{"sharing an end", []string{"1.0.0.0-1.0.0.10", "1.0.0.10-1.0.0.20"}, "1.0.0.0-1.0.0.20"},
+		{"adjacent", []string{"1.0.0.0-1.0.0.10", "1.0.0.11-1.0.0.20"}, "1.0.0.0-1.0.0.10 1.0.0.11-1.0.0.20"},
+		{"unsorted", []string{"3.0.0.0/8", "1.0.0.0-1.0.0.10", "2.0.0.0", "1.0.0.5-1.0.0.6"}, "1.0.0.0-1.0.0.10 2.0.0.0-2.0.0.0 3.0.0.0-3.255.255.255"},
+		{"chain", []string{"1.0.0.20-1.0.0.30", "1.0.0.0-1.0.0.10", "1.0.0.10-1.0.0.20"}, "1.0.0.0-1.0.0.30"},
+		{"duplicates", []string{"1.2.3.4", "1.2.3.4", "001.002.003.004 - 001.002.003.004 , 0 , dat"}, "1.2.3.4-1.2.3.4"},
+		{"both families", []string{"2001:db8::/64", "10.0.0.0/8"}, "10.0.0.0-10.255.255.255 2001:db8::-2001:db8::ffff:ffff:ffff:ffff"},
+	}
+	for _, test := range tests {
+		ranges, _, err := parse(strings.NewReader(strings.Join(test.lines, "\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(rangeStrings(ranges), " "); got != test.ranges {
+			t.Errorf("%v: got %q, want %q", test.name, got, test.ranges)
+		}
+	}
+}
+
+// writeBlocklist writes a blocklist file, the modification time moves
+// forward on every write so changes are seen whatever the file system's
+// time resolution
+func writeBlocklist(t *testing.T, path string, lines ...string) {
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := info.ModTime().Add(time.Minute)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	writeBlocklist(t, path, "1.2.3.10-1.2.3.20", "10.0.0.0/8", "2001:db8::/32", "255.255.255.255")
+	blocklist, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.2.3.9", false},
+		{"1.2.3.10", true},
+		{"1.2.3.15", true},
+		{"1.2.3.20", true},
+		{"1.2.3.21", false},
+		{"9.255.255.255", false},
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"255.255.255.255", true},
+		{"0.0.0.0", false},
+		{"::ffff:1.2.3.10", true},
+		{"2001:db7:ffff:ffff:ffff:ffff:ffff:ffff", false},
+		{"2001:db8::", true},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:db9::", false},
+		{"::", false},
+	}
+	for _, test := range tests {
+		if got := blocklist.Contains(net.ParseIP(test.ip)); got != test.blocked {
+			t.Errorf("%v: blocked %v, want %v", test.ip, got, test.blocked)
+		}
+	}
+
+	// The 4 byte form of an address is the same address
+	if !blocklist.Contains(net.IPv4(1, 2, 3, 10).To4()) {
+		t.Error("4 byte address not blocked")
+	}
+	if blocklist.Contains(nil) || blocklist.Contains(net.IP{1, 2, 3}) {
+		t.Error("invalid address blocked")
+	}
+	if (*Blocklist)(nil).Contains(net.ParseIP("1.2.3.15")) {
+		t.Error("nil blocklist blocks")
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestWatchReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	writeBlocklist(t, path, "1.2.3.4")
+	blocklist, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		blocklist.watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	// waitFor polls until the blocked state of an address is as wanted
+	waitFor := func(ip string, blocked bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for blocklist.Contains(net.ParseIP(ip)) != blocked {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v still blocked %v", ip, !blocked)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	writeBlocklist(t, path, "5.6.7.0/24")
+	waitFor("5.6.7.8", true)
+	waitFor("1.2.3.4", false)
+
+	// A file that is gone keeps the ranges loaded before
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !blocklist.Contains(net.ParseIP("5.6.7.8")) {
+		t.Error("ranges dropped when the file went away")
+	}
+
+	// A file coming back is loaded again
+	writeBlocklist(t, path, "9.9.9.9")
+	waitFor("9.9.9.9", true)
+	waitFor("5.6.7.8", false)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("watch didn't stop with its context")
+	}
+}
@@ -0,0 +1,170 @@
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// eMule DAT entries with an access level below this are blocked
+const datBlockedLevel = 128
+
+// ipRange is an inclusive range of addresses, IPv4 addresses are kept in
+// their IPv4-mapped IPv6 form so both families compare the same way
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// parse reads a blocklist with one entry per line, in any of the formats:
+//
+//	description:1.2.3.0-1.2.3.255                     (P2P)
+//	description:2001:db8::-2001:db8::ff
+//	001.002.003.000 - 001.002.003.255 , 000 , desc    (eMule DAT)
+//	1.2.3.0/24                                        (CIDR)
+//	1.2.3.4
+//
+// Blank lines and lines starting with # or // are skipped. It returns the
+// merged ranges and the number of lines that couldn't be parsed.
+func parse(reader io.Reader) ([]ipRange, int, error) {
+	ranges := []ipRange{}
+	invalid := 0
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		entry, blocked, err := parseLine(line)
+		if err != nil {
+			invalid++
+			continue
+		}
+		if blocked {
+			ranges = append(ranges, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, invalid, err
+	}
+
+	return merge(ranges), invalid, nil
+}
+
+// parseLine parses an entry, false means the entry allows its range. P2P
+// descriptions may contain anything, so they are tried last.
+func parseLine(line string) (ipRange, bool, error) {
+	// eMule DAT: range, access level, description
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if entry, rangeErr := parseRange(fields[0]); err == nil && rangeErr == nil {
+			return entry, level < datBlockedLevel, nil
+		}
+	}
+
+	if _, network, err := net.ParseCIDR(line); err == nil {
+		return networkRange(network), true, nil
+	}
+
+	if entry, err := parseRange(line); err == nil {
+		return entry, true, nil
+	}
+
+	// P2P: an IPv4 range follows the last colon of the description, an IPv6
+	// range the first colon leaving a valid range
+	i := strings.LastIndex(line, ":")
+	if i < 0 {
+		return ipRange{}, false, errors.New("invalid entry " + line)
+	}
+	entry, err := parseRange(line[i+1:])
+	for j := 0; err != nil && j < i; j++ {
+		if line[j] == ':' {
+			entry, err = parseRange(line[j+1:])
+		}
+	}
+	return entry, true, err
+}
+
+// networkRange returns the first and the last address of a network
+func networkRange(network *net.IPNet) ipRange {
+	start := network.IP.To16()
+	end := make(net.IP, len(start))
+	// IPv4 masks are 4 bytes long and cover the last 4 bytes
+	offset := len(start) - len(network.Mask)
+	for i := range start {
+		end[i] = start[i]
+		if i >= offset {
+			end[i] |= ^network.Mask[i-offset]
+		}
+	}
+	return ipRange{start: start, end: end}
+}
+
+// parseRange parses "start - end" or a single address
+func parseRange(value string) (ipRange, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) > 2 {
+		return ipRange{}, errors.New("invalid range " + value)
+	}
+
+	start := parseIP(parts[0])
+	end := start
+	if len(parts) == 2 {
+		end = parseIP(parts[1])
+	}
+	if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+		return ipRange{}, errors.New("invalid range " + value)
+	}
+	return ipRange{start: start, end: end}, nil
+}
+
+// parseIP parses an address in its 16 byte form, IPv4 octets may have
+// leading zeros as in eMule DAT files
+func parseIP(value string) net.IP {
+	value = strings.TrimSpace(value)
+
+	octets := strings.Split(value, ".")
+	if len(octets) == 4 {
+		for i, octet := range octets {
+			trimmed := strings.TrimLeft(octet, "0")
+			if trimmed == "" && octet != "" {
+				trimmed = "0"
+			}
+			octets[i] = trimmed
+		}
+		value = strings.Join(octets, ".")
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+// merge sorts the ranges and joins the ones that overlap
+func merge(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+
+	merged := []ipRange{}
+	for _, next := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && bytes.Compare(next.start, merged[last].end) <= 0 {
+			if bytes.Compare(next.end, merged[last].end) > 0 {
+				merged[last].end = next.end
+			}
+			continue
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
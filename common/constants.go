@@ -1,5 +1,10 @@
 package common
 
+import "time"
+
 const Port int = 6881
+const ClientName = "torrentClient"
 const BlockSize int = 16384
 const Backlog = 5
+const ConnectTimeout = 15 * time.Second
+const AnnounceInterval = 30 * time.Minute
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+	"torrentClient/models"
+)
+
+const (
+	MinPieceLength = 16 * 1024
+	MaxPieceLength = 16 * 1024 * 1024
+	// Piece count the automatic piece length aims to stay under
+	targetPieceCount = 1500
+)
+
+type CreateOptions struct {
+	// File or directory to create the torrent from
+	Path string
+	// Zero selects the piece length from the total length
+	PieceLength int64
+	// The first tracker is the main one, all of them go in the announce list
+	Trackers  []string
+	Comment   string
+	CreatedBy string
+	Private   bool
+	WebSeeds  []string
+	// Number of goroutines hashing pieces, zero uses one per CPU
+	Workers int
+}
+
+// AutoPieceLength picks the smallest power of two piece length that keeps the
+// torrent under the target piece count
+func AutoPieceLength(totalLength int64) int64 {
+	pieceLength := int64(MinPieceLength)
+	for pieceLength < MaxPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// CreateTorrent hashes the file or directory of the options and returns its
+// manifest along with the content of the .torrent file
+func CreateTorrent(options CreateOptions) (*models.Manifest, []byte, error) {
+	root, err := filepath.Abs(options.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := filepath.Base(root)
+	manifest := &models.Manifest{
+		Name:         name,
+		Comment:      options.Comment,
+		CreatedBy:    options.CreatedBy,
+		CreationDate: time.Now().Unix(),
+		MultiFile:    rootInfo.IsDir(),
+		Private:      options.Private,
+		UrlList:      options.WebSeeds,
+	}
+
+	if len(options.Trackers) > 0 {
+		manifest.Announce = options.Trackers[0]
+	}
+	if len(options.Trackers) > 1 {
+		manifest.AnnounceList = options.Trackers
+	}
+
+	// Paths of the files on disk, in the order of manifest.FileInfos
+	filePaths := []string{}
+
+	if rootInfo.IsDir() {
+		err = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			relativePath, err := filepath.Rel(root, filePath)
+			if err != nil {
+				return err
+			}
+			filePaths = append(filePaths, filePath)
+			manifest.FileInfos = append(manifest.FileInfos, models.FileInfo{
+				Path:   name + "/" + filepath.ToSlash(relativePath),
+				Name:   info.Name(),
+				Length: info.Size(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		filePaths = append(filePaths, root)
+		manifest.FileInfos = append(manifest.FileInfos, models.FileInfo{
+			Path:   name + "/" + name,
+			Name:   name,
+			Length: rootInfo.Size(),
+		})
+	}
+
+	for i := range manifest.FileInfos {
+		manifest.FileInfos[i].Offset = manifest.Length
+		manifest.FileInfos[i].Priority = models.PriorityNormal
+		manifest.Length += manifest.FileInfos[i].Length
+	}
+
+	if manifest.Length == 0 {
+		return nil, nil, errors.New("nothing to hash in " + options.Path)
+	}
+
+	manifest.PieceLength = options.PieceLength
+	if manifest.PieceLength == 0 {
+		manifest.PieceLength = AutoPieceLength(manifest.Length)
+	}
+	if manifest.PieceLength < MinPieceLength || manifest.PieceLength&(manifest.PieceLength-1) != 0 {
+		return nil, nil, errors.New("piece length must be a power of two of at least 16 KiB")
+	}
+
+	manifest.PieceHashes, err = hashPieces(manifest, filePaths, options.Workers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, manifest.InfoHash, err = manifest.EncodeInfo()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content, err := models.EncodeManifestFile(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, content, nil
+}
+
+func hashPieces(manifest *models.Manifest, filePaths []string, workers int) ([][20]byte, error) {
+	files := make([]*os.File, len(filePaths))
+	for i, filePath := range filePaths {
+		file, err := os.Open(filePath)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files[i] = file
+	}
+	defer closeFiles(files)
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	pieceCount := int((manifest.Length + manifest.PieceLength - 1) / manifest.PieceLength)
+	hashes := make([][20]byte, pieceCount)
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var hashErr error
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, manifest.PieceLength)
+			for index := range indexes {
+				piece := buffer[:GetPieceLength(index, int(manifest.PieceLength), int(manifest.Length))]
+				err := readPiece(manifest, files, index, piece)
+				if err != nil {
+					errOnce.Do(func() { hashErr = err })
+					continue
+				}
+				hashes[index] = sha1.Sum(piece)
+			}
+		}()
+	}
+
+	for index := 0; index < pieceCount; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	if hashErr != nil {
+		return nil, hashErr
+	}
+	return hashes, nil
+}
+
+// readPiece reads a piece spanning one or more of the files
+func readPiece(manifest *models.Manifest, files []*os.File, index int, piece []byte) error {
+	pieceStart := int64(index) * manifest.PieceLength
+	pieceEnd := pieceStart + int64(len(piece))
+
+	for i, file := range manifest.FileInfos {
+		start := file.Offset
+		end := file.Offset + file.Length
+		if end <= pieceStart || start >= pieceEnd {
+			continue
+		}
+		if start < pieceStart {
+			start = pieceStart
+		}
+		if end > pieceEnd {
+			end = pieceEnd
+		}
+		_, err := files[i].ReadAt(piece[start-pieceStart:end-pieceStart], start-file.Offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		if file != nil {
+			file.Close()
+		}
+	}
+}
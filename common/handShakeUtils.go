@@ -44,23 +44,35 @@ func ReadHandShake(reader io.Reader) (*models.HandShake, error) {
 	}
 
 	return &models.HandShake{
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerId:   peerId,
 	}, nil
 }
 
-func EstablishHandShake(peerId [20]byte, peer models.Peer, manifest models.Manifest) (int, error) {
+func EstablishHandShake(peerId [20]byte, peer *models.Peer, manifest models.Manifest) (int, error) {
 	peer.Conn.SetDeadline(time.Now().Add(5 * time.Second))
 	// Reset deadline
 	defer peer.Conn.SetDeadline(time.Time{})
 
 	retries := 0
 	var err error = nil
-	handShake := models.New(manifest.InfoHash, peerId)
+	// Hybrid torrents are in two swarms, answer peers with the info hash of
+	// the swarm they are in
+	infoHash := manifest.InfoHash
+	if peer.Address.InfoHash != [20]byte{} {
+		infoHash = peer.Address.InfoHash
+	}
+
+	handShake := models.New(infoHash, peerId)
+	if manifest.IsV2() {
+		handShake.SetV2()
+	}
+	handShake.SetExtensions()
 
 	for retries < 10 {
 		if retries > 0 {
-			fmt.Printf("Retrying handshake with peer %v:%v for %v time\n", peer.Address.IP, peer.Address.Port, retries)
+			fmt.Printf("Retrying handshake with peer %v for %v time\n", peer.Address, retries)
 		}
 
 		_, err := peer.Conn.Write(handShake.ToBytes())
@@ -9,42 +9,28 @@ import (
 )
 
 func Read(r io.Reader) (*models.Message, error) {
-	lengthBuf := make([]byte, 4)
-	_, err := io.ReadFull(r, lengthBuf)
-	if err != nil {
-		return nil, err
-	}
-	length := binary.BigEndian.Uint32(lengthBuf)
-
-	// keep-alive message
-	if length == 0 {
-		return nil, nil
-	}
-
-	messageBuf := make([]byte, length)
-	_, err = io.ReadFull(r, messageBuf)
-	if err != nil {
-		return nil, err
-	}
-
-	message := models.Message{
-		Type:    models.MessageType(messageBuf[0]),
-		Payload: messageBuf[1:],
-	}
-
-	return &message, nil
+	return models.ReadMessage(r)
 }
 
 func SendHaveMessage(peer *models.Peer, pieceIndex int) (err error) {
-	_, err = SendMessageWithRetry(peer, models.Message{
+	err = SendMessage(peer, models.Message{
 		Type:    models.MsgTypeHave,
 		Payload: binary.BigEndian.AppendUint32([]byte{}, uint32(pieceIndex)),
 	})
 	return
 }
 
+// TrySendHaveMessage sends a have message without waiting for a peer whose
+// queue is full
+func TrySendHaveMessage(peer *models.Peer, pieceIndex int) error {
+	return peer.TrySend(models.Message{
+		Type:    models.MsgTypeHave,
+		Payload: binary.BigEndian.AppendUint32([]byte{}, uint32(pieceIndex)),
+	})
+}
+
 func SendUnchokeMessage(peer *models.Peer) (err error) {
-	_, err = SendMessageWithRetry(peer, models.Message{
+	err = SendMessage(peer, models.Message{
 		Type:    models.MsgTypeUnChoke,
 		Payload: []byte{},
 	})
@@ -52,59 +38,47 @@ func SendUnchokeMessage(peer *models.Peer) (err error) {
 }
 
 func SendChokeMessage(peer *models.Peer) (err error) {
-	_, err = SendMessageWithRetry(peer, models.Message{
+	err = SendMessage(peer, models.Message{
 		Type:    models.MsgTypeChoke,
 		Payload: []byte{},
 	})
 	return
 }
 
-func SendMessageWithRetry(peer *models.Peer, message models.Message) (int, error) {
-	retries := 0
-	var err error = nil
-
-	for retries < 10 {
-		_, err := peer.Conn.Write(message.ToBytes())
-		if (err == nil || err == io.EOF) && retries == 0 {
-			return retries, err
-		}
-
-		retries++
-	}
-
-	return retries, err
-}
-
-func ReadMessage(reader io.Reader) (*models.Message, error) {
-	var lengthBytes [4]byte
-	_, err := io.ReadFull(reader, lengthBytes[:])
-
+// SendExtendedHandshake tells the peer about the extensions we support and
+// whether we are done downloading
+func SendExtendedHandshake(peer *models.Peer, uploadOnly bool) error {
+	message, err := models.ExtendedHandshake{
+		Client:     ClientName,
+		Port:       Port,
+		UploadOnly: uploadOnly,
+	}.ToMessage()
 	if err != nil {
-		if err == io.EOF {
-			fmt.Printf("EOF while reading message length\n")
-			return nil, err
-		}
-		return nil, err
+		return err
 	}
+	return peer.Send(message)
+}
 
-	length := binary.BigEndian.Uint32(lengthBytes[:])
-
-	if length == 0 {
-		return nil, nil
+// UpdateUploadOnly sends the extended handshake again when the peer wasn't
+// told yet whether we are done downloading (BEP 21)
+func UpdateUploadOnly(peer *models.Peer, uploadOnly bool) error {
+	if !peer.SupportsExtensions || !peer.SetAmUploadOnly(uploadOnly) {
+		return nil
 	}
+	return SendExtendedHandshake(peer, uploadOnly)
+}
 
-	var payload []byte
-
-	if length > 0 {
-		payload = make([]byte, length)
-		_, err := io.ReadFull(reader, payload)
+// SendMessage queues a message for the writer of the peer
+func SendMessage(peer *models.Peer, message models.Message) error {
+	return peer.Send(message)
+}
 
-		if err != nil {
-			return nil, err
-		}
+func ReadMessage(reader io.Reader) (*models.Message, error) {
+	message, err := models.ReadMessage(reader)
+	if err == io.EOF {
+		fmt.Printf("EOF while reading message length\n")
 	}
-
-	return &models.Message{Type: models.MessageType(payload[0]), Payload: payload[1:]}, nil
+	return message, err
 }
 
 func ReadRequestMessage(payload []byte) (int, int, int, error) {
@@ -1,129 +1,361 @@
 package common
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
+	"torrentClient/blocklist"
 	"torrentClient/models"
+	"torrentClient/mse"
+	"torrentClient/proxy"
+	"torrentClient/utp"
 
 	"github.com/IncSW/go-bencode"
 )
 
-func GetPeersList(manifest models.Manifest, peerId [20]byte, port int) (peers []models.PeerAddress, err error) {
+// Network is how peer connections are made, the zero value connects to any
+// peer in plaintext
+type Network struct {
+	Blocklist *blocklist.Blocklist
+	// Encryption decides whether connections use Message Stream Encryption
+	Encryption mse.Mode
+	// UTP dials peers over uTP next to TCP, nil for TCP only
+	UTP *utp.Socket
+	// Dialer makes the connections to peers, trackers and web seeds, nil
+	// connects directly
+	Dialer proxy.Dialer
+
+	transportOnce sync.Once
+	transport     http.RoundTripper
+}
+
+func (network *Network) dialer() proxy.Dialer {
+	if network.Dialer == nil {
+		return proxy.Direct{}
+	}
+	return network.Dialer
+}
+
+// HTTPClient returns a client for trackers and web seeds connecting with the
+// network's dialer
+func (network *Network) HTTPClient(timeout time.Duration) *http.Client {
+	if network.Dialer == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	// Clients share a transport so idle connections are reused
+	network.transportOnce.Do(func() {
+		network.transport = proxy.NewTransport(network.Dialer)
+	})
+	return &http.Client{Timeout: timeout, Transport: network.transport}
+}
+
+// ListenUTP opens the uTP socket of the network, through the proxy's UDP
+// relay when there is one
+func ListenUTP(ctx context.Context, network *Network, address string) (*utp.Socket, error) {
+	conn, err := network.dialer().ListenPacket(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return utp.NewSocket(conn), nil
+}
+
+// Announce is what we tell the trackers about our transfer
+type Announce struct {
+	Uploaded   int64
+	Downloaded int64
+	// Left is the bytes still missing, zero for seeders
+	Left int64
+	// Event is started, completed, stopped or paused, empty for regular
+	// announces
+	Event string
+}
+
+func GetPeersList(ctx context.Context, network *Network, manifest models.Manifest, peerId [20]byte, port int, announce Announce) (peers []models.PeerAddress, err error) {
 	fmt.Printf("Getting peers list from trackers\n")
 	announcer := []string{manifest.Announce}
 	announcer = append(announcer, manifest.AnnounceList...)
-	var trackerResponse interface{} = nil
+	found := false
 
-	for _, announce := range announcer {
-		announceUrl, err := getTrackerRequestUrl(manifest, announce, peerId, port)
-		if err != nil {
-			continue
+	// Hybrid torrents have a v1 and a v2 swarm, announce to both
+	for _, infoHash := range manifest.InfoHashes() {
+		var trackerResponse interface{} = nil
+
+		for _, tracker := range announcer {
+			announceUrl, err := getTrackerRequestUrl(infoHash, tracker, peerId, port, announce)
+			if err != nil {
+				continue
+			}
+			response, err := getTrackerResponse(ctx, network, announceUrl)
+
+			if err != nil {
+				continue
+			}
+			fmt.Printf("Got peers list from tracker %v\n", tracker)
+			trackerResponse = response
+			break
 		}
-		response, err := getTrackerResponse(announceUrl)
 
+		if trackerResponse == nil {
+			continue
+		}
+		swarmPeers, err := getPeersFromTrackerResponse(trackerResponse)
 		if err != nil {
 			continue
 		}
-		fmt.Printf("Got peers list from tracker %v\n", announce)
-		trackerResponse = response
-		break
+		found = true
+
+		for _, peer := range swarmPeers {
+			if infoHash != manifest.InfoHash {
+				peer.InfoHash = infoHash
+			}
+			peers = append(peers, peer)
+		}
 	}
 
-	if trackerResponse == nil {
+	if !found {
 		return nil, errors.New("can't get peers from any tracker")
 	}
-	peers, err = getPeersFromTrackerResponse(trackerResponse)
-	return
+	return peers, nil
+}
+
+// AnnounceStopped tells every tracker we are leaving the swarm, the
+// responses are ignored
+func AnnounceStopped(ctx context.Context, network *Network, manifest models.Manifest, peerId [20]byte, port int, announce Announce) {
+	announcer := []string{manifest.Announce}
+	announcer = append(announcer, manifest.AnnounceList...)
+	announce.Event = "stopped"
+
+	for _, infoHash := range manifest.InfoHashes() {
+		for _, tracker := range announcer {
+			announceUrl, err := getTrackerRequestUrl(infoHash, tracker, peerId, port, announce)
+			if err != nil {
+				continue
+			}
+			_, err = getTrackerResponse(ctx, network, announceUrl)
+			if err != nil {
+				fmt.Printf("Error sending stopped to tracker %v, %v\n", tracker, err)
+			}
+		}
+	}
 }
 
 func getPeersFromTrackerResponse(trackerResponse interface{}) (peers []models.PeerAddress, err error) {
-	receivedPeers := trackerResponse.(map[string]interface{})["peers"].([]byte)
+	response, ok := trackerResponse.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid tracker response")
+	}
+	if reason, ok := response["failure reason"].([]byte); ok {
+		return nil, errors.New("tracker failure: " + string(reason))
+	}
 
-	if len(receivedPeers)%6 != 0 {
-		return nil, errors.New("invalid peers list")
+	switch receivedPeers := response["peers"].(type) {
+	case []byte:
+		peers, err = models.ParseCompactPeers(receivedPeers, net.IPv4len, models.SourceTracker)
+		if err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		// Non compact responses list a dictionary per peer
+		for _, receivedPeer := range receivedPeers {
+			receivedPeer, ok := receivedPeer.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("invalid peers list")
+			}
+			ip, _ := receivedPeer["ip"].([]byte)
+			port, _ := receivedPeer["port"].(int64)
+			parsedIP := net.ParseIP(string(ip))
+			if parsedIP == nil || port <= 0 || port > 65535 {
+				continue
+			}
+			peers = append(peers, models.PeerAddress{
+				IP:     parsedIP,
+				Port:   uint16(port),
+				Source: models.SourceTracker,
+			})
+		}
 	}
 
-	for i := 0; i < len(receivedPeers); i += 6 {
-		peers = append(peers, models.PeerAddress{
-			IP:   receivedPeers[i : i+4],
-			Port: binary.BigEndian.Uint16(receivedPeers[i+4 : i+6]),
-		})
+	// IPv6 peers come in their own compact list (BEP 7)
+	if receivedPeers6, ok := response["peers6"].([]byte); ok {
+		peers6, err := models.ParseCompactPeers(receivedPeers6, net.IPv6len, models.SourceTracker)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peers6...)
 	}
 
-	return
+	return peers, nil
 }
 
-func getTrackerResponse(announceUrl string) (trackerResp interface{}, err error) {
-	client := &http.Client{Timeout: 5 * time.Second}
+func getTrackerResponse(ctx context.Context, network *Network, announceUrl string) (trackerResp interface{}, err error) {
+	client := network.HTTPClient(5 * time.Second)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, announceUrl, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := client.Get(announceUrl)
+	resp, err := client.Do(request)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	data := make([]byte, 2048)
-	resp.Body.Read(data)
+	// Responses with many IPv6 peers don't fit a fixed buffer
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
 
 	trackerResp, err = bencode.Unmarshal(data)
 	return
 }
 
-func getTrackerRequestUrl(manifest models.Manifest, announce string, peerId [20]byte, port int) (string, error) {
-	baseUrl, err := url.Parse(announce)
+func getTrackerRequestUrl(infoHash [20]byte, tracker string, peerId [20]byte, port int, announce Announce) (string, error) {
+	baseUrl, err := url.Parse(tracker)
 	if err != nil {
 		return "", err
 	}
 
 	params := url.Values{
-		"info_hash":  []string{string(manifest.InfoHash[:])},
+		"info_hash":  []string{string(infoHash[:])},
 		"peer_id":    []string{string(peerId[:])},
 		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"uploaded":   []string{strconv.FormatInt(announce.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(announce.Downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(int(manifest.Length))},
+		"left":       []string{strconv.FormatInt(announce.Left, 10)},
+	}
+
+	if announce.Event != "" {
+		params.Set("event", announce.Event)
 	}
 
 	baseUrl.RawQuery = params.Encode()
 	return baseUrl.String(), nil
 }
 
-func ConnectToPeer(peerAddress models.PeerAddress, port int, timeout time.Duration) (conn net.Conn, err error) {
-	return net.DialTimeout("tcp", peerAddress.IP.String()+":"+strconv.Itoa(int(peerAddress.Port)), timeout)
+// ConnectToPeer dials the peer over TCP, and over uTP at the same time when
+// it is enabled, keeping the connection made first
+func ConnectToPeer(ctx context.Context, network *Network, peerAddress models.PeerAddress, port int, timeout time.Duration) (conn net.Conn, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := network.dialer()
+	if network.UTP == nil {
+		return dialer.DialContext(ctx, "tcp", peerAddress.String())
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, 2)
+	go func() {
+		conn, err := dialer.DialContext(ctx, "tcp", peerAddress.String())
+		results <- dialResult{conn, err}
+	}()
+	go func() {
+		conn, err := network.UTP.DialContext(ctx, peerAddress.String())
+		results <- dialResult{conn, err}
+	}()
+
+	for i := 0; i < 2; i++ {
+		result := <-results
+		if result.err != nil {
+			err = result.err
+			continue
+		}
+		// The slower transport is given up
+		if i == 0 {
+			go func() {
+				if other := <-results; other.err == nil {
+					other.conn.Close()
+				}
+			}()
+		}
+		return result.conn, nil
+	}
+	return nil, err
 }
 
-func EstablishConnection(peerAddress models.PeerAddress, manifest models.Manifest) (peer *models.Peer) {
-	var conn net.Conn = nil
-	var timeout = time.Duration(10 * time.Second)
+func EstablishConnection(ctx context.Context, peerAddress models.PeerAddress, manifest models.Manifest, network *Network) (peer *models.Peer) {
+	if !manifest.AllowsPeerSource(peerAddress.Source) {
+		fmt.Printf("Not connecting to %v peer %v of a private torrent\n", peerAddress.Source, peerAddress)
+		return nil
+	}
 
-	fmt.Printf("Connecting to peer %v:%v\n", peerAddress.IP, peerAddress.Port)
+	if network.Blocklist.Contains(peerAddress.IP) {
+		fmt.Printf("Not connecting to blocked peer %v\n", peerAddress)
+		return nil
+	}
 
-	for conn == nil {
-		timeout *= 2
-		conn, _ = ConnectToPeer(peerAddress, Port, timeout)
+	fmt.Printf("Connecting to peer %v\n", peerAddress)
+
+	// A single attempt, the connection manager retries failed peers later
+	conn, err := ConnectToPeer(ctx, network, peerAddress, Port, ConnectTimeout)
+	if err != nil {
+		fmt.Printf("Can't connect to peer %v, %v\n", peerAddress, err)
+		return nil
+	}
 
-		if timeout > time.Duration(60*time.Second) {
-			fmt.Printf("Can't connect to peer %v:%v\n", peerAddress.IP, peerAddress.Port)
+	if network.Encryption != mse.Disabled {
+		conn = encryptConnection(ctx, network, conn, peerAddress, manifest)
+		if conn == nil {
 			return nil
 		}
 	}
 
-	fmt.Printf("Connected to peer %v:%v\n", peerAddress.IP, peerAddress.Port)
+	fmt.Printf("Connected to peer %v\n", peerAddress)
+
+	return models.NewPeer(conn, peerAddress, manifest.PieceCount())
+}
+
+// encryptConnection runs the encryption handshake, peers that don't support
+// it are dialed again in plaintext unless encryption is required
+func encryptConnection(ctx context.Context, network *Network, conn net.Conn, peerAddress models.PeerAddress, manifest models.Manifest) net.Conn {
+	// Hybrid torrents are in two swarms, the keys depend on the info hash of
+	// the swarm the peer is in
+	infoHash := manifest.InfoHash
+	if peerAddress.InfoHash != [20]byte{} {
+		infoHash = peerAddress.InfoHash
+	}
 
-	peer = &models.Peer{
-		Conn:       conn,
-		Address:    peerAddress,
-		Interested: false,
-		IsChoked:   true,
-		IsChoking:  false,
-		BitField:   make([]byte, len(manifest.PieceHashes)),
+	encrypted, err := mse.Initiate(conn, infoHash, network.Encryption)
+	if err == nil {
+		return encrypted
+	}
+	conn.Close()
+
+	if network.Encryption == mse.Required {
+		fmt.Printf("Can't encrypt connection to peer %v, %v\n", peerAddress, err)
+		return nil
+	}
+	fmt.Printf("Can't encrypt connection to peer %v, retrying in plaintext, %v\n", peerAddress, err)
+
+	conn, err = ConnectToPeer(ctx, network, peerAddress, Port, ConnectTimeout)
+	if err != nil {
+		fmt.Printf("Can't connect to peer %v, %v\n", peerAddress, err)
+		return nil
+	}
+	return conn
+}
+
+// FilterPeerSources drops the peers the torrent may not use and the blocked
+// peers
+func FilterPeerSources(manifest *models.Manifest, blocked *blocklist.Blocklist, peers []models.PeerAddress) []models.PeerAddress {
+	allowed := []models.PeerAddress{}
+	for _, peer := range peers {
+		if manifest.AllowsPeerSource(peer.Source) && !blocked.Contains(peer.IP) {
+			allowed = append(allowed, peer)
+		}
 	}
-	return peer
+	return allowed
 }
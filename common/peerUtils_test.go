@@ -0,0 +1,296 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"torrentClient/blocklist"
+	"torrentClient/models"
+	"torrentClient/mse"
+	"torrentClient/proxy"
+	"torrentClient/proxy/proxytest"
+	"torrentClient/utp"
+)
+
+func TestFilterPeerSources(t *testing.T) {
+	sources := []models.PeerSource{models.SourceUnknown, models.SourceTracker, models.SourceIncoming, models.SourceDHT, models.SourcePEX, models.SourceLSD}
+	peers := []models.PeerAddress{}
+	for i, source := range sources {
+		peers = append(peers, models.PeerAddress{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 6881, Source: source})
+	}
+
+	allowed := FilterPeerSources(&models.Manifest{Private: true}, nil, peers)
+	if len(allowed) != 2 {
+		t.Errorf("private torrent allows %v", allowed)
+	}
+	for _, peer := range allowed {
+		if peer.Source != models.SourceTracker && peer.Source != models.SourceIncoming {
+			t.Errorf("private torrent leaks to %v peer %v", peer.Source, peer)
+		}
+	}
+
+	allowed = FilterPeerSources(&models.Manifest{}, nil, peers)
+	if len(allowed) != len(peers) {
+		t.Errorf("public torrent only allows %v", allowed)
+	}
+}
+
+func TestFilterPeerSourcesBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("192.0.2.0/24\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := blocklist.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers := []models.PeerAddress{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 1, Source: models.SourceTracker},
+		{IP: net.IPv4(198, 51, 100, 1), Port: 1, Source: models.SourceTracker},
+	}
+	for _, manifest := range []*models.Manifest{{}, {Private: true}} {
+		allowed := FilterPeerSources(manifest, blocked, peers)
+		if len(allowed) != 1 || !allowed[0].IP.Equal(peers[1].IP) {
+			t.Errorf("private %v, allowed %v", manifest.Private, allowed)
+		}
+	}
+}
+
+func TestTrackerPeersAllowedForPrivateTorrents(t *testing.T) {
+	// Compact, dictionary and IPv6 peer lists all come from the tracker
+	response := map[string]interface{}{
+		"peers6": []byte("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1"),
+	}
+	for _, peers := range []interface{}{
+		[]byte("\xc0\x00\x02\x01\x1a\xe1"),
+		[]interface{}{map[string]interface{}{"ip": []byte("192.0.2.1"), "port": int64(6881)}},
+	} {
+		response["peers"] = peers
+		received, err := getPeersFromTrackerResponse(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed := FilterPeerSources(&models.Manifest{Private: true}, nil, received)
+		if len(received) != 2 || len(allowed) != len(received) {
+			t.Errorf("received %v, allowed %v", received, allowed)
+		}
+	}
+}
+
+// listenPeer accepts connections with the encryption mode of a peer and
+// answers their first message, every accepted connection is counted
+func listenPeer(t *testing.T, infoHash [20]byte, mode mse.Mode) (models.PeerAddress, *int32) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go func() {
+				defer conn.Close()
+				conn, err := mse.Accept(conn, [][20]byte{infoHash}, mode)
+				if err != nil {
+					return
+				}
+				message := make([]byte, 20)
+				if _, err := io.ReadFull(conn, message); err == nil {
+					conn.Write(message)
+				}
+			}()
+		}
+	}()
+
+	local := listener.Addr().(*net.TCPAddr)
+	return models.PeerAddress{IP: local.IP, Port: uint16(local.Port)}, accepted
+}
+
+func TestEncryptConnection(t *testing.T) {
+	manifest := models.Manifest{InfoHash: [20]byte{1, 2, 3}}
+	tests := []struct {
+		name      string
+		ours      mse.Mode
+		theirs    mse.Mode
+		ok        bool
+		encrypted bool
+		dials     int32
+	}{
+		{"both encrypt", mse.Preferred, mse.Preferred, true, true, 1},
+		{"plaintext fallback", mse.Preferred, mse.Disabled, true, false, 2},
+		{"required against plaintext", mse.Required, mse.Disabled, false, false, 1},
+		{"required against encryption", mse.Required, mse.Required, true, true, 1},
+	}
+	for _, test := range tests {
+		address, accepted := listenPeer(t, manifest.InfoHash, test.theirs)
+		network := &Network{Encryption: test.ours}
+		conn, err := net.Dial("tcp4", address.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn = encryptConnection(context.Background(), network, conn, address, manifest)
+		if (conn != nil) != test.ok {
+			t.Errorf("%v: got connection %v", test.name, conn != nil)
+			continue
+		}
+		if conn != nil {
+			encrypted, ok := conn.(*mse.Conn)
+			if (ok && encrypted.Encrypted) != test.encrypted {
+				t.Errorf("%v: encrypted %v", test.name, ok && encrypted.Encrypted)
+			}
+			// Plaintext connections start with the handshake, which the
+			// peer's encryption handshake lets through
+			message := []byte("\x13BitTorrent protocol")
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, err := conn.Write(message)
+			if err == nil {
+				_, err = io.ReadFull(conn, message)
+			}
+			if err != nil || string(message) != "\x13BitTorrent protocol" {
+				t.Errorf("%v: no answer through the connection, %v", test.name, err)
+			}
+			conn.Close()
+		}
+		if dials := atomic.LoadInt32(accepted); dials != test.dials {
+			t.Errorf("%v: %v connections, want %v", test.name, dials, test.dials)
+		}
+	}
+}
+
+func startProxy(t *testing.T, start func(string, string) (*proxytest.Server, error), username string, password string) *proxytest.Server {
+	server, err := start(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+func proxyNetwork(t *testing.T, rawUrl string) *Network {
+	dialer, err := proxy.FromURL(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Network{Dialer: dialer}
+}
+
+func TestHTTPClientThroughProxies(t *testing.T) {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+
+	socks := startProxy(t, proxytest.NewSOCKS5, "alice", "secret")
+	httpProxy := startProxy(t, proxytest.NewHTTPConnect, "bob", "hunter2")
+	tests := []struct {
+		url    string
+		server *proxytest.Server
+	}{
+		{"socks5://alice:secret@" + socks.Address, socks},
+		{"http://bob:hunter2@" + httpProxy.Address, httpProxy},
+	}
+	for _, test := range tests {
+		network := proxyNetwork(t, test.url)
+		for i := 0; i < 2; i++ {
+			response, err := network.HTTPClient(5 * time.Second).Get(tracker.URL + "/announce")
+			if err != nil {
+				t.Fatalf("%v: %v", test.url, err)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+		// The second request reuses the connection of the first
+		if test.server.Connects() != 1 {
+			t.Errorf("%v: %v connections relayed", test.url, test.server.Connects())
+		}
+	}
+}
+
+func TestConnectToPeerThroughProxy(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("\x13BitTorrent protocol"))
+			conn.Close()
+		}
+	}()
+
+	socks := startProxy(t, proxytest.NewSOCKS5, "", "")
+	network := proxyNetwork(t, "socks5://"+socks.Address)
+	local := listener.Addr().(*net.TCPAddr)
+	conn, err := ConnectToPeer(context.Background(), network, models.PeerAddress{IP: local.IP, Port: uint16(local.Port)}, Port, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(conn, header); err != nil || string(header) != "\x13BitTorrent protocol" {
+		t.Errorf("peer answered %q, %v", header, err)
+	}
+	if socks.Connects() != 1 {
+		t.Errorf("%v connections relayed", socks.Connects())
+	}
+}
+
+// UDP associations only carry uTP, trackers are reached over HTTP
+func TestListenUTPThroughSOCKS5(t *testing.T) {
+	socks := startProxy(t, proxytest.NewSOCKS5, "alice", "secret")
+	network := proxyNetwork(t, "socks5://alice:secret@"+socks.Address)
+	socket, err := ListenUTP(context.Background(), network, ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	peer, err := utp.Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	data := bytes.Repeat([]byte("piece data "), 100000)
+	go func() {
+		conn, err := peer.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(data)
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := socket.DialContext(ctx, peer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	received, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(received, data) {
+		t.Fatalf("received %v bytes, %v", len(received), err)
+	}
+	if socks.Packets() == 0 {
+		t.Error("uTP packets didn't go through the relay")
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"errors"
-	"os"
 	"torrentClient/models"
 )
 
@@ -31,9 +30,16 @@ func CheckPieceHash(piece []byte, hash [20]byte) bool {
 	return bytes.Equal(sha1Hash[:], hash[:])
 }
 
-func WritePieceToFile(manifest *models.Manifest, pieceJobResult *models.PieceJobResult, blobFile *os.File) {
-	pieceOffset := int64(pieceJobResult.PieceIndex) * manifest.PieceLength
-	blobFile.WriteAt(pieceJobResult.PieceData, pieceOffset)
+// CheckPiece verifies a piece against the SHA-1 hashes of v1 torrents and the
+// merkle trees of v2 torrents, hybrid torrents are checked against both
+func CheckPiece(manifest *models.Manifest, index int, piece []byte) bool {
+	if index < len(manifest.PieceHashes) && !CheckPieceHash(piece, manifest.PieceHashes[index]) {
+		return false
+	}
+	if manifest.IsV2() {
+		return manifest.CheckPieceV2(index, piece)
+	}
+	return index < len(manifest.PieceHashes)
 }
 
 func WritePieceMessage(index int, begin int, block []byte) *models.Message {
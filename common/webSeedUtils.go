@@ -0,0 +1,118 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"torrentClient/models"
+)
+
+// FileRange is the part of a file a piece covers
+type FileRange struct {
+	FileIndex int
+	// Offsets inside the file
+	Start int64
+	End   int64
+	// Offset inside the piece
+	PieceOffset int64
+}
+
+// PieceFileRanges maps a piece to the byte ranges of the files it spans,
+// padding files are left out since their data is all zeros
+func PieceFileRanges(manifest *models.Manifest, index int) []FileRange {
+	pieceStart := int64(index) * manifest.PieceLength
+	pieceEnd := pieceStart + int64(GetPieceLength(index, int(manifest.PieceLength), int(manifest.Length)))
+
+	ranges := []FileRange{}
+	for i := range manifest.FileInfos {
+		file := &manifest.FileInfos[i]
+		start := file.Offset
+		end := file.Offset + file.Length
+		if file.Padding || end <= pieceStart || start >= pieceEnd {
+			continue
+		}
+		if start < pieceStart {
+			start = pieceStart
+		}
+		if end > pieceEnd {
+			end = pieceEnd
+		}
+		ranges = append(ranges, FileRange{
+			FileIndex:   i,
+			Start:       start - file.Offset,
+			End:         end - file.Offset,
+			PieceOffset: start - pieceStart,
+		})
+	}
+	return ranges
+}
+
+// WebSeedFileUrl returns the url of a file on a web seed (BEP 19). Urls of
+// multi file torrents and urls ending with a slash are directories the
+// torrent's paths are appended to.
+func WebSeedFileUrl(baseUrl string, manifest *models.Manifest, fileIndex int) string {
+	if !manifest.MultiFile && !strings.HasSuffix(baseUrl, "/") {
+		return baseUrl
+	}
+
+	parts := strings.Split(manifest.FileInfos[fileIndex].Path, "/")
+	if !manifest.MultiFile {
+		parts = parts[len(parts)-1:]
+	}
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	if !strings.HasSuffix(baseUrl, "/") {
+		baseUrl += "/"
+	}
+	return baseUrl + strings.Join(parts, "/")
+}
+
+// FetchWebSeedPiece downloads a piece from a web seed with one range request
+// per file the piece spans
+func FetchWebSeedPiece(ctx context.Context, client *http.Client, baseUrl string, manifest *models.Manifest, index int) ([]byte, error) {
+	piece := make([]byte, GetPieceLength(index, int(manifest.PieceLength), int(manifest.Length)))
+
+	for _, fileRange := range PieceFileRanges(manifest, index) {
+		err := fetchRange(ctx, client, WebSeedFileUrl(baseUrl, manifest, fileRange.FileIndex), fileRange, piece)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return piece, nil
+}
+
+func fetchRange(ctx context.Context, client *http.Client, fileUrl string, fileRange FileRange, piece []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fileUrl, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", fileRange.Start, fileRange.End-1))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body := io.Reader(response.Body)
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range, skip to it
+		_, err = io.CopyN(io.Discard, body, fileRange.Start)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("web seed responded with " + response.Status)
+	}
+
+	_, err = io.ReadFull(body, piece[fileRange.PieceOffset:fileRange.PieceOffset+fileRange.End-fileRange.Start])
+	return err
+}
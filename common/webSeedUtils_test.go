@@ -0,0 +1,163 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"torrentClient/models"
+	"torrentClient/torrenttest"
+)
+
+const testPieceLength = 16384
+
+// newWebSeed creates a torrent of a directory with two files whose second
+// piece spans both, and serves the directory with handler
+func newWebSeed(t *testing.T, handler func(dir string) http.Handler) (*models.Manifest, []byte, *httptest.Server) {
+	torrent := torrenttest.MultiFile(t, "files", testPieceLength,
+		torrenttest.File{Path: "a", Length: 20000},
+		torrenttest.File{Path: "b", Length: 30000},
+	)
+	server := httptest.NewServer(handler(filepath.Dir(torrent.Source)))
+	t.Cleanup(server.Close)
+	return &torrent.Manifest, torrent.Data, server
+}
+
+func fileServer(dir string) http.Handler {
+	return http.FileServer(http.Dir(dir))
+}
+
+func pieceData(data []byte, index int) []byte {
+	start := index * testPieceLength
+	return data[start : start+GetPieceLength(index, testPieceLength, len(data))]
+}
+
+func TestPieceFileRanges(t *testing.T) {
+	manifest, _, _ := newWebSeed(t, fileServer)
+
+	ranges := PieceFileRanges(manifest, 1)
+	want := []FileRange{
+		{FileIndex: 0, Start: 16384, End: 20000, PieceOffset: 0},
+		{FileIndex: 1, Start: 0, End: 12768, PieceOffset: 3616},
+	}
+	if len(ranges) != len(want) {
+		t.Fatalf("got ranges %+v", ranges)
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Errorf("range %v is %+v, want %+v", i, ranges[i], want[i])
+		}
+	}
+}
+
+func TestFetchWebSeedPiece(t *testing.T) {
+	var requests []string
+	manifest, data, server := newWebSeed(t, func(dir string) http.Handler {
+		files := fileServer(dir)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.URL.Path+" "+r.Header.Get("Range"))
+			files.ServeHTTP(w, r)
+		})
+	})
+
+	for index := 0; index < manifest.PieceCount(); index++ {
+		piece, err := FetchWebSeedPiece(context.Background(), server.Client(), server.URL, manifest, index)
+		if err != nil {
+			t.Fatalf("piece %v: %v", index, err)
+		}
+		if !bytes.Equal(piece, pieceData(data, index)) || !CheckPiece(manifest, index, piece) {
+			t.Errorf("piece %v differs", index)
+		}
+	}
+
+	// The piece spanning both files takes a range request for each
+	want := []string{"/files/a bytes=0-16383", "/files/a bytes=16384-19999", "/files/b bytes=0-12767", "/files/b bytes=12768-29151", "/files/b bytes=29152-29999"}
+	if strings.Join(requests, ", ") != strings.Join(want, ", ") {
+		t.Errorf("requests %v", requests)
+	}
+}
+
+func TestFetchWebSeedPieceIgnoringRange(t *testing.T) {
+	manifest, data, server := newWebSeed(t, func(dir string) http.Handler {
+		files := fileServer(dir)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del("Range")
+			files.ServeHTTP(w, r)
+		})
+	})
+
+	piece, err := FetchWebSeedPiece(context.Background(), server.Client(), server.URL, manifest, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(piece, pieceData(data, 1)) {
+		t.Error("piece differs when the server sends the whole files")
+	}
+}
+
+func TestFetchWebSeedPieceBadData(t *testing.T) {
+	manifest, data, server := newWebSeed(t, func(dir string) http.Handler {
+		files := fileServer(dir)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/files/b":
+				// Corrupted copy of b
+				content, _ := os.ReadFile(filepath.Join(dir, "files", "b"))
+				content[5000] ^= 0xff
+				http.ServeContent(w, r, "b", time.Time{}, bytes.NewReader(content))
+			case "/files/short":
+				w.Write([]byte("short"))
+			default:
+				files.ServeHTTP(w, r)
+			}
+		})
+	})
+
+	piece, err := FetchWebSeedPiece(context.Background(), server.Client(), server.URL, manifest, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CheckPiece(manifest, 1, piece) {
+		t.Error("corrupted piece passes the hash check")
+	}
+	if !CheckPiece(manifest, 0, pieceData(data, 0)) {
+		t.Error("good piece fails the hash check")
+	}
+
+	_, err = FetchWebSeedPiece(context.Background(), server.Client(), server.URL+"/missing/", manifest, 0)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("missing file, got %v", err)
+	}
+
+	manifest.FileInfos[0].Path = "files/short"
+	_, err = FetchWebSeedPiece(context.Background(), server.Client(), server.URL, manifest, 0)
+	if err == nil {
+		t.Error("short response accepted")
+	}
+}
+
+func TestWebSeedFileUrl(t *testing.T) {
+	multiFile := &models.Manifest{MultiFile: true, FileInfos: []models.FileInfo{{Path: "torrent/dir/a b#c"}}}
+	singleFile := &models.Manifest{FileInfos: []models.FileInfo{{Path: "file.iso/file.iso"}}}
+
+	tests := []struct {
+		base     string
+		manifest *models.Manifest
+		want     string
+	}{
+		{"http://seed/files", multiFile, "http://seed/files/torrent/dir/a%20b%23c"},
+		{"http://seed/files/", multiFile, "http://seed/files/torrent/dir/a%20b%23c"},
+		{"http://seed/file.iso", singleFile, "http://seed/file.iso"},
+		{"http://seed/mirror/", singleFile, "http://seed/mirror/file.iso"},
+	}
+	for _, test := range tests {
+		if got := WebSeedFileUrl(test.base, test.manifest, 0); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.base, got, test.want)
+		}
+	}
+}
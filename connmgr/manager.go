@@ -0,0 +1,108 @@
+package connmgr
+
+import (
+	"sync"
+	"time"
+	"torrentClient/models"
+)
+
+const (
+	DefaultMaxConnections           = 200
+	DefaultMaxConnectionsPerTorrent = 50
+	DefaultMaxHalfOpen              = 20
+
+	// How often the candidate pool is checked for peers to connect to
+	fillInterval = 5 * time.Second
+)
+
+// Manager caps the connections of every torrent together and the connection
+// attempts still in progress, which are counted against the caps too
+type Manager struct {
+	mutex          sync.Mutex
+	maxConnections int
+	maxHalfOpen    int
+	connections    int
+	halfOpen       int
+	torrents       map[[20]byte]*Torrent
+}
+
+func New(maxConnections int, maxHalfOpen int) *Manager {
+	return &Manager{
+		maxConnections: maxConnections,
+		maxHalfOpen:    maxHalfOpen,
+		torrents:       map[[20]byte]*Torrent{},
+	}
+}
+
+// AddTorrent returns the connections of a torrent, creating them the first
+// time the info hash is seen
+func (manager *Manager) AddTorrent(infoHash [20]byte, maxConnections int) *Torrent {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if torrent, ok := manager.torrents[infoHash]; ok {
+		return torrent
+	}
+
+	torrent := &Torrent{
+		manager:        manager,
+		maxConnections: maxConnections,
+		candidates:     map[string]*candidate{},
+		peers:          map[string]*models.Peer{},
+		peerIds:        map[[20]byte]string{},
+		wake:           make(chan struct{}, 1),
+		failedBlocks:   map[int][]blockRecord{},
+		banned:         map[string]string{},
+	}
+	manager.torrents[infoHash] = torrent
+	return torrent
+}
+
+// Connections returns the number of connections of every torrent, including
+// connection attempts
+func (manager *Manager) Connections() int {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return manager.connections
+}
+
+// reserve takes a connection slot, and a half open slot for outgoing
+// connections. Called with the torrent's mutex held.
+func (manager *Manager) reserve(halfOpen bool) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.connections >= manager.maxConnections {
+		return false
+	}
+	if halfOpen && manager.halfOpen >= manager.maxHalfOpen {
+		return false
+	}
+
+	manager.connections++
+	if halfOpen {
+		manager.halfOpen++
+	}
+	return true
+}
+
+func (manager *Manager) release(connection bool, halfOpen bool) {
+	manager.mutex.Lock()
+	if connection {
+		manager.connections--
+	}
+	if halfOpen {
+		manager.halfOpen--
+	}
+	torrents := make([]*Torrent, 0, len(manager.torrents))
+	for _, torrent := range manager.torrents {
+		torrents = append(torrents, torrent)
+	}
+	manager.mutex.Unlock()
+
+	// A slot opened up, any torrent may use it
+	for _, torrent := range torrents {
+		torrent.signal()
+	}
+}
@@ -0,0 +1,156 @@
+package connmgr
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"time"
+	"torrentClient/models"
+)
+
+// Peers that sent a failed piece get it again after this long, or at once
+// if no other peer has it
+const suspectTimeout = 2 * time.Minute
+
+// Block is a block of a downloaded piece and the peer that sent it
+type Block struct {
+	Begin  int
+	Data   []byte
+	Source net.IP
+}
+
+// blockRecord is what is kept of a block of a piece that failed its hash
+// check
+type blockRecord struct {
+	begin  int
+	length int
+	hash   [20]byte
+	source string
+	failed time.Time
+}
+
+// PieceFailed remembers who sent the blocks of a piece that failed its hash
+// check. The senders aren't given the piece again for a while, once it
+// downloads correctly the senders of the blocks that differ are banned.
+// Peers failing the same piece twice are banned right away.
+func (torrent *Torrent) PieceFailed(index int, blocks []Block) {
+	torrent.mutex.Lock()
+	failedBefore := map[string]bool{}
+	for _, record := range torrent.failedBlocks[index] {
+		failedBefore[record.source] = true
+	}
+	now := time.Now()
+	repeated := []string{}
+	for _, block := range blocks {
+		source := block.Source.String()
+		if failedBefore[source] {
+			repeated = append(repeated, source)
+			delete(failedBefore, source)
+		}
+		torrent.failedBlocks[index] = append(torrent.failedBlocks[index], blockRecord{
+			begin:  block.Begin,
+			length: len(block.Data),
+			hash:   sha1.Sum(block.Data),
+			source: source,
+			failed: now,
+		})
+	}
+	torrent.mutex.Unlock()
+
+	for _, source := range repeated {
+		torrent.Ban(net.ParseIP(source), fmt.Sprintf("failed piece %v twice", index))
+	}
+}
+
+// PieceVerified compares a piece that passed its hash check with the blocks
+// of its failed downloads and bans the peers that sent corrupt blocks
+func (torrent *Torrent) PieceVerified(index int, piece []byte) {
+	torrent.mutex.Lock()
+	records, ok := torrent.failedBlocks[index]
+	delete(torrent.failedBlocks, index)
+	torrent.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, record := range records {
+		if record.begin+record.length > len(piece) || sha1.Sum(piece[record.begin:record.begin+record.length]) != record.hash {
+			torrent.Ban(net.ParseIP(record.source), fmt.Sprintf("sent a corrupt block at %v of piece %v", record.begin, index))
+		}
+	}
+}
+
+// SuspectPieces returns the pieces not verified yet the peer sent blocks of
+// a failed download of, as long as another peer has them and the failure
+// is recent. The peer may retry the others, so a piece only it has doesn't
+// stall the download.
+func (torrent *Torrent) SuspectPieces(ip net.IP) []int {
+	torrent.mutex.Lock()
+	defer torrent.mutex.Unlock()
+
+	source := ip.String()
+	pieces := []int{}
+	for index, records := range torrent.failedBlocks {
+		for _, record := range records {
+			if record.source == source {
+				if time.Since(record.failed) < suspectTimeout && torrent.otherPeerHas(index, source) {
+					pieces = append(pieces, index)
+				}
+				break
+			}
+		}
+	}
+	return pieces
+}
+
+// otherPeerHas reports whether a connected peer not at the IP has the piece
+func (torrent *Torrent) otherPeerHas(index int, source string) bool {
+	for _, peer := range torrent.peers {
+		if peer.Address.IP.String() != source && peer.HasPiece(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban closes the connections to an IP and refuses it for the rest of the
+// session
+func (torrent *Torrent) Ban(ip net.IP, reason string) {
+	key := ip.String()
+
+	torrent.mutex.Lock()
+	if _, ok := torrent.banned[key]; ok {
+		torrent.mutex.Unlock()
+		return
+	}
+	torrent.banned[key] = reason
+
+	// Active candidates are dropped once their connection closes
+	for address, candidate := range torrent.candidates {
+		if candidate.address.IP.Equal(ip) && !candidate.active {
+			delete(torrent.candidates, address)
+		}
+	}
+	peers := []*models.Peer{}
+	for _, peer := range torrent.peers {
+		if peer.Address.IP.Equal(ip) {
+			peers = append(peers, peer)
+		}
+	}
+	torrent.mutex.Unlock()
+
+	fmt.Printf("Banning peer %v for the session, %v\n", key, reason)
+	for _, peer := range peers {
+		peer.Close()
+	}
+}
+
+// Banned reports whether an IP is banned
+func (torrent *Torrent) Banned(ip net.IP) bool {
+	torrent.mutex.Lock()
+	defer torrent.mutex.Unlock()
+
+	_, ok := torrent.banned[ip.String()]
+	return ok
+}
@@ -0,0 +1,134 @@
+package connmgr
+
+import (
+	"net"
+	"testing"
+	"time"
+	"torrentClient/models"
+)
+
+// addTestPeer registers a handshaked peer at the IP that has every piece
+func addTestPeer(t *testing.T, torrent *Torrent, ip net.IP, id byte) *models.Peer {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	peer := models.NewPeer(local, models.PeerAddress{IP: ip, Port: 6881}, 8)
+	peer.SetBitField(models.Bitfield{0xff})
+	peer.PeerId[0] = id
+	if !torrent.Accept(peer.Address) || !torrent.Handshaked(peer) {
+		t.Fatal("peer refused")
+	}
+	peer.Start()
+	t.Cleanup(peer.Close)
+	return peer
+}
+
+func testBlocks(piece []byte, source net.IP) []Block {
+	return []Block{
+		{Begin: 0, Data: piece[:4], Source: source},
+		{Begin: 4, Data: piece[4:], Source: source},
+	}
+}
+
+func isClosed(peer *models.Peer) bool {
+	select {
+	case <-peer.Done():
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestPieceVerifiedBansCorruptSender(t *testing.T) {
+	torrent := New(10, 5).AddTorrent([20]byte{1}, 10)
+	badIP, goodIP := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	bad := addTestPeer(t, torrent, badIP, 1)
+	good := addTestPeer(t, torrent, goodIP, 2)
+
+	piece := []byte("abcdefgh")
+	corrupt := []byte("abcdXfgh")
+	torrent.PieceFailed(3, testBlocks(corrupt, badIP))
+	if torrent.Banned(badIP) {
+		t.Fatal("banned after a single failure")
+	}
+	torrent.PieceVerified(3, piece)
+
+	if !torrent.Banned(badIP) || !isClosed(bad) {
+		t.Error("sender of the differing block isn't banned and closed")
+	}
+	if torrent.Banned(goodIP) || isClosed(good) {
+		t.Error("other peer banned")
+	}
+}
+
+func TestPieceVerifiedKeepsMatchingSenders(t *testing.T) {
+	torrent := New(10, 5).AddTorrent([20]byte{1}, 10)
+	ip := net.IPv4(192, 0, 2, 1)
+	peer := addTestPeer(t, torrent, ip, 1)
+
+	// A block of another peer broke the piece, the blocks of this one match
+	piece := []byte("abcdefgh")
+	blocks := testBlocks(piece, ip)
+	blocks[1].Source = net.IPv4(192, 0, 2, 9)
+	blocks[1].Data = []byte("XXXX")
+	torrent.PieceFailed(3, blocks)
+	torrent.PieceVerified(3, piece)
+
+	if torrent.Banned(ip) || isClosed(peer) {
+		t.Error("peer sending correct blocks banned")
+	}
+	if !torrent.Banned(net.IPv4(192, 0, 2, 9)) {
+		t.Error("peer sending the corrupt block isn't banned")
+	}
+}
+
+func TestPieceFailedTwiceBans(t *testing.T) {
+	torrent := New(10, 5).AddTorrent([20]byte{1}, 10)
+	ip := net.IPv4(192, 0, 2, 1)
+	peer := addTestPeer(t, torrent, ip, 1)
+
+	torrent.PieceFailed(3, testBlocks([]byte("abcdXfgh"), ip))
+	torrent.PieceFailed(5, testBlocks([]byte("abcdXfgh"), ip))
+	if torrent.Banned(ip) {
+		t.Fatal("banned for failures of different pieces")
+	}
+	torrent.PieceFailed(3, testBlocks([]byte("abcdYfgh"), ip))
+	if !torrent.Banned(ip) || !isClosed(peer) {
+		t.Error("peer failing a piece twice isn't banned")
+	}
+}
+
+func TestSuspectPieces(t *testing.T) {
+	torrent := New(10, 5).AddTorrent([20]byte{1}, 10)
+	ip := net.IPv4(192, 0, 2, 1)
+	addTestPeer(t, torrent, ip, 1)
+	corrupt := testBlocks([]byte("abcdXfgh"), ip)
+
+	// The only peer having the piece may retry it right away
+	torrent.PieceFailed(3, corrupt)
+	if suspect := torrent.SuspectPieces(ip); len(suspect) != 0 {
+		t.Errorf("piece no one else has is hidden, %v", suspect)
+	}
+
+	other := addTestPeer(t, torrent, net.IPv4(192, 0, 2, 2), 2)
+	if suspect := torrent.SuspectPieces(ip); len(suspect) != 1 || suspect[0] != 3 {
+		t.Errorf("piece another peer has isn't left to it, %v", suspect)
+	}
+	if suspect := torrent.SuspectPieces(other.Address.IP); len(suspect) != 0 {
+		t.Errorf("piece hidden from a peer that didn't send it, %v", suspect)
+	}
+
+	// The other peer didn't deliver it in time
+	torrent.mutex.Lock()
+	for i := range torrent.failedBlocks[3] {
+		torrent.failedBlocks[3][i].failed = time.Now().Add(-suspectTimeout)
+	}
+	torrent.mutex.Unlock()
+	if suspect := torrent.SuspectPieces(ip); len(suspect) != 0 {
+		t.Errorf("piece still hidden after the timeout, %v", suspect)
+	}
+
+	torrent.PieceVerified(3, []byte("abcdefgh"))
+	if len(torrent.failedBlocks) != 0 {
+		t.Error("blocks of the verified piece are kept")
+	}
+}
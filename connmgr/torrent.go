@@ -0,0 +1,229 @@
+package connmgr
+
+import (
+	"context"
+	"sync"
+	"time"
+	"torrentClient/models"
+)
+
+const (
+	// Wait before reconnecting to a candidate, doubled for every failure
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 30 * time.Minute
+	// Candidates failing this many times in a row are dropped from the pool
+	maxFailures = 6
+)
+
+// candidate is a peer address we may connect to
+type candidate struct {
+	address     models.PeerAddress
+	failures    int
+	nextAttempt time.Time
+	// active is true while connecting or connected
+	active bool
+}
+
+// Torrent keeps the pool of candidate peers of a torrent and its
+// connections. Peers are deduplicated by address and by peer id.
+type Torrent struct {
+	mutex          sync.Mutex
+	manager        *Manager
+	maxConnections int
+	connections    int
+	candidates     map[string]*candidate
+	peers          map[string]*models.Peer
+	peerIds        map[[20]byte]string
+	wake           chan struct{}
+	// failedBlocks has the blocks of every failed download of a piece
+	failedBlocks map[int][]blockRecord
+	// banned maps banned IPs to the reason they were banned for
+	banned map[string]string
+}
+
+func backoff(failures int) time.Duration {
+	wait := baseBackoff
+	for i := 0; i < failures && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+func (torrent *Torrent) signal() {
+	select {
+	case torrent.wake <- struct{}{}:
+	default:
+	}
+}
+
+// AddCandidates adds peers to the pool, addresses already in it keep their
+// failure count and banned addresses are left out
+func (torrent *Torrent) AddCandidates(addresses []models.PeerAddress) {
+	torrent.mutex.Lock()
+	for _, address := range addresses {
+		if _, ok := torrent.banned[address.IP.String()]; ok {
+			continue
+		}
+		key := address.String()
+		if _, ok := torrent.candidates[key]; !ok {
+			torrent.candidates[key] = &candidate{address: address}
+		}
+	}
+	torrent.mutex.Unlock()
+
+	torrent.signal()
+}
+
+// Candidates returns the number of peers in the pool
+func (torrent *Torrent) Candidates() int {
+	torrent.mutex.Lock()
+	defer torrent.mutex.Unlock()
+
+	return len(torrent.candidates)
+}
+
+// Run keeps connecting to candidates whenever a connection slot is free,
+// connect is started in its own goroutine for every candidate picked. It
+// returns once the context is done.
+func (torrent *Torrent) Run(ctx context.Context, connect func(models.PeerAddress)) {
+	ticker := time.NewTicker(fillInterval)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		torrent.fill(connect)
+		select {
+		case <-ticker.C:
+		case <-torrent.wake:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (torrent *Torrent) fill(connect func(models.PeerAddress)) {
+	for {
+		torrent.mutex.Lock()
+		best := torrent.bestCandidate(time.Now())
+		if best == nil || torrent.connections >= torrent.maxConnections || !torrent.manager.reserve(true) {
+			torrent.mutex.Unlock()
+			return
+		}
+		best.active = true
+		torrent.connections++
+		address := best.address
+		torrent.mutex.Unlock()
+
+		go connect(address)
+	}
+}
+
+// bestCandidate picks the idle candidate with the fewest failures whose
+// backoff has passed
+func (torrent *Torrent) bestCandidate(now time.Time) *candidate {
+	var best *candidate
+	for _, candidate := range torrent.candidates {
+		if candidate.active || candidate.nextAttempt.After(now) {
+			continue
+		}
+		if best == nil || candidate.failures < best.failures {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// Dialed ends the half open state of a connection attempt, failed attempts
+// give back their connection slot too
+func (torrent *Torrent) Dialed(address models.PeerAddress, connected bool) {
+	torrent.manager.release(false, true)
+	if !connected {
+		torrent.closed(address, nil, true)
+	}
+}
+
+// Accept takes a connection slot for an incoming connection, false means
+// the connection should be refused
+func (torrent *Torrent) Accept(address models.PeerAddress) bool {
+	torrent.mutex.Lock()
+	defer torrent.mutex.Unlock()
+
+	if torrent.connections >= torrent.maxConnections || !torrent.manager.reserve(false) {
+		return false
+	}
+	torrent.connections++
+	return true
+}
+
+// Release gives back the slot of an accepted connection that closed before
+// its handshake
+func (torrent *Torrent) Release(address models.PeerAddress) {
+	torrent.closed(address, nil, false)
+}
+
+// Handshaked registers a peer once its peer id is known, false means we are
+// already connected to it and the connection should be closed
+func (torrent *Torrent) Handshaked(peer *models.Peer) bool {
+	torrent.mutex.Lock()
+	defer torrent.mutex.Unlock()
+
+	key := peer.Address.String()
+	if _, ok := torrent.peerIds[peer.PeerId]; ok {
+		return false
+	}
+	if _, ok := torrent.peers[key]; ok {
+		return false
+	}
+
+	torrent.peers[key] = peer
+	torrent.peerIds[peer.PeerId] = key
+	if candidate, ok := torrent.candidates[key]; ok {
+		candidate.failures = 0
+	}
+	return true
+}
+
+// Closed gives back the connection slot of a peer, its address is retried
+// after a backoff that grows while connections to it keep failing
+func (torrent *Torrent) Closed(peer *models.Peer, failed bool) {
+	torrent.closed(peer.Address, peer, failed)
+}
+
+func (torrent *Torrent) closed(address models.PeerAddress, peer *models.Peer, failed bool) {
+	torrent.mutex.Lock()
+	key := address.String()
+	if peer != nil && torrent.peers[key] == peer {
+		delete(torrent.peers, key)
+		delete(torrent.peerIds, peer.PeerId)
+	}
+	torrent.connections--
+
+	if candidate, ok := torrent.candidates[key]; ok && candidate.active {
+		candidate.active = false
+		if failed {
+			candidate.failures++
+		}
+		_, banned := torrent.banned[address.IP.String()]
+		if candidate.failures >= maxFailures || banned {
+			delete(torrent.candidates, key)
+		} else {
+			candidate.nextAttempt = time.Now().Add(backoff(candidate.failures))
+		}
+	}
+	torrent.mutex.Unlock()
+
+	torrent.manager.release(true, false)
+}
+
+// Peers returns the peers with a completed handshake
+func (torrent *Torrent) Peers() []*models.Peer {
+	torrent.mutex.Lock()
+	defer torrent.mutex.Unlock()
+
+	peers := make([]*models.Peer, 0, len(torrent.peers))
+	for _, peer := range torrent.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
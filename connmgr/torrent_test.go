@@ -0,0 +1,321 @@
+package connmgr
+
+import (
+	"net"
+	"testing"
+	"time"
+	"torrentClient/models"
+)
+
+func TestReleaseAcceptedSlot(t *testing.T) {
+	manager := New(10, 5)
+	torrent := manager.AddTorrent([20]byte{1}, 2)
+	addresses := []models.PeerAddress{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 6881, Source: models.SourceIncoming},
+		{IP: net.IPv4(192, 0, 2, 2), Port: 6881, Source: models.SourceIncoming},
+		{IP: net.IPv4(192, 0, 2, 3), Port: 6881, Source: models.SourceIncoming},
+	}
+
+	if !torrent.Accept(addresses[0]) || !torrent.Accept(addresses[1]) {
+		t.Fatal("slots refused")
+	}
+	if torrent.Accept(addresses[2]) {
+		t.Fatal("accepted over the limit")
+	}
+
+	// The encryption handshake of a peer failed
+	torrent.Release(addresses[0])
+	if manager.Connections() != 1 {
+		t.Errorf("%v connections after a release", manager.Connections())
+	}
+	if !torrent.Accept(addresses[2]) {
+		t.Error("released slot refused")
+	}
+	if torrent.Candidates() != 0 {
+		t.Error("released incoming peer added to the candidates")
+	}
+}
+
+// testAddresses returns count addresses of peers found by the tracker
+func testAddresses(count int) []models.PeerAddress {
+	addresses := []models.PeerAddress{}
+	for i := 0; i < count; i++ {
+		addresses = append(addresses, models.PeerAddress{IP: net.IPv4(198, 51, 100, byte(i+1)), Port: 6881, Source: models.SourceTracker})
+	}
+	return addresses
+}
+
+func activeCandidates(torrent *Torrent) int {
+	torrent.mutex.Lock()
+	defer torrent.mutex.Unlock()
+
+	active := 0
+	for _, candidate := range torrent.candidates {
+		if candidate.active {
+			active++
+		}
+	}
+	return active
+}
+
+// dial runs one fill of the torrent and returns the addresses it connected
+// to
+func dial(t *testing.T, torrent *Torrent) []models.PeerAddress {
+	t.Helper()
+	connected := make(chan models.PeerAddress, 100)
+	before := activeCandidates(torrent)
+	torrent.fill(func(address models.PeerAddress) { connected <- address })
+
+	// fill picked every address before returning, the connect calls run in
+	// their own goroutines
+	addresses := []models.PeerAddress{}
+	for len(addresses) < activeCandidates(torrent)-before {
+		select {
+		case address := <-connected:
+			addresses = append(addresses, address)
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect not called")
+		}
+	}
+	select {
+	case address := <-connected:
+		t.Fatalf("connected to %v without a slot", address)
+	case <-time.After(20 * time.Millisecond):
+	}
+	return addresses
+}
+
+func TestPerTorrentCap(t *testing.T) {
+	manager := New(10, 10)
+	torrent := manager.AddTorrent([20]byte{1}, 3)
+	torrent.AddCandidates(testAddresses(5))
+
+	if dialed := dial(t, torrent); len(dialed) != 3 {
+		t.Fatalf("%v connections for a cap of 3", len(dialed))
+	}
+	if torrent.Accept(models.PeerAddress{IP: net.IPv4(192, 0, 2, 1), Port: 6881, Source: models.SourceIncoming}) {
+		t.Error("incoming connection accepted over the torrent's cap")
+	}
+
+	// Another torrent has its own cap
+	other := manager.AddTorrent([20]byte{2}, 3)
+	if !other.Accept(models.PeerAddress{IP: net.IPv4(192, 0, 2, 1), Port: 6881, Source: models.SourceIncoming}) {
+		t.Error("incoming connection of another torrent refused")
+	}
+	if manager.AddTorrent([20]byte{1}, 100) != torrent {
+		t.Error("info hash added twice")
+	}
+}
+
+func TestGlobalCap(t *testing.T) {
+	manager := New(4, 10)
+	first := manager.AddTorrent([20]byte{1}, 10)
+	second := manager.AddTorrent([20]byte{2}, 10)
+	first.AddCandidates(testAddresses(3))
+	second.AddCandidates(testAddresses(3))
+
+	if dialed := dial(t, first); len(dialed) != 3 {
+		t.Fatalf("first torrent made %v connections", len(dialed))
+	}
+	// One slot is left over all torrents
+	if dialed := dial(t, second); len(dialed) != 1 {
+		t.Fatalf("second torrent made %v connections", len(dialed))
+	}
+	incoming := models.PeerAddress{IP: net.IPv4(192, 0, 2, 1), Port: 6881, Source: models.SourceIncoming}
+	if first.Accept(incoming) || second.Accept(incoming) {
+		t.Error("incoming connection accepted over the global cap")
+	}
+	if manager.Connections() != 4 {
+		t.Errorf("%v connections", manager.Connections())
+	}
+
+	// A connection of the first torrent closing frees a slot for the second
+	dialed := testAddresses(1)[0]
+	first.Dialed(dialed, false)
+	if manager.Connections() != 3 {
+		t.Errorf("%v connections after a failed attempt", manager.Connections())
+	}
+	if dialed := dial(t, second); len(dialed) != 1 {
+		t.Errorf("second torrent made %v connections in the freed slot", len(dialed))
+	}
+}
+
+func TestHalfOpenLimit(t *testing.T) {
+	manager := New(10, 2)
+	torrent := manager.AddTorrent([20]byte{1}, 10)
+	torrent.AddCandidates(testAddresses(5))
+
+	dialed := dial(t, torrent)
+	if len(dialed) != 2 {
+		t.Fatalf("%v attempts for a half open limit of 2", len(dialed))
+	}
+
+	// Incoming connections aren't half open
+	incoming := models.PeerAddress{IP: net.IPv4(192, 0, 2, 1), Port: 6881, Source: models.SourceIncoming}
+	if !torrent.Accept(incoming) {
+		t.Error("incoming connection refused by the half open limit")
+	}
+
+	// A connected attempt keeps its connection slot and frees its half open
+	// one
+	torrent.Dialed(dialed[0], true)
+	if more := dial(t, torrent); len(more) != 1 {
+		t.Fatalf("%v attempts after one connected", len(more))
+	}
+	if manager.Connections() != 4 {
+		t.Errorf("%v connections", manager.Connections())
+	}
+
+	// A failed attempt frees both
+	torrent.Dialed(dialed[1], false)
+	if manager.Connections() != 3 {
+		t.Errorf("%v connections after a failed attempt", manager.Connections())
+	}
+	if more := dial(t, torrent); len(more) != 1 {
+		t.Errorf("%v attempts after one failed", len(more))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		wait     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, 16 * time.Minute},
+		{6, 30 * time.Minute},
+		{20, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		if wait := backoff(test.failures); wait != test.wait {
+			t.Errorf("%v failures: wait %v, want %v", test.failures, wait, test.wait)
+		}
+	}
+}
+
+func TestFailingCandidatesBackOff(t *testing.T) {
+	manager := New(10, 10)
+	torrent := manager.AddTorrent([20]byte{1}, 10)
+	address := testAddresses(1)[0]
+	torrent.AddCandidates([]models.PeerAddress{address})
+
+	for failures := 1; failures < maxFailures; failures++ {
+		if dialed := dial(t, torrent); len(dialed) != 1 {
+			t.Fatalf("attempt %v made %v connections", failures, len(dialed))
+		}
+		start := time.Now()
+		torrent.Dialed(address, false)
+
+		// Retried only once the backoff for the failures so far passed
+		wait := backoff(failures)
+		torrent.mutex.Lock()
+		early := torrent.bestCandidate(start.Add(wait - time.Second))
+		due := torrent.bestCandidate(time.Now().Add(wait))
+		torrent.mutex.Unlock()
+		if early != nil || due == nil {
+			t.Fatalf("after %v failures: picked early %v, picked when due %v", failures, early != nil, due != nil)
+		}
+		torrent.candidates[address.String()].nextAttempt = time.Time{}
+	}
+
+	// The last failure drops the candidate, adding it again starts over
+	dial(t, torrent)
+	torrent.Dialed(address, false)
+	if torrent.Candidates() != 0 {
+		t.Fatalf("candidate kept after %v failures", maxFailures)
+	}
+	torrent.AddCandidates([]models.PeerAddress{address})
+	if torrent.candidates[address.String()].failures != 0 {
+		t.Error("failures kept by a dropped candidate")
+	}
+}
+
+func TestHandshakeResetsFailures(t *testing.T) {
+	manager := New(10, 10)
+	torrent := manager.AddTorrent([20]byte{1}, 10)
+	address := testAddresses(1)[0]
+	torrent.AddCandidates([]models.PeerAddress{address})
+
+	dial(t, torrent)
+	torrent.Dialed(address, false)
+	torrent.candidates[address.String()].nextAttempt = time.Time{}
+
+	dial(t, torrent)
+	torrent.Dialed(address, true)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peer := models.NewPeer(local, address, 8)
+	if !torrent.Handshaked(peer) {
+		t.Fatal("handshake refused")
+	}
+	if failures := torrent.candidates[address.String()].failures; failures != 0 {
+		t.Errorf("%v failures after a handshake", failures)
+	}
+
+	// A connection closing cleanly is retried after the shortest backoff
+	torrent.Closed(peer, false)
+	if wait := time.Until(torrent.candidates[address.String()].nextAttempt); wait > baseBackoff || wait < baseBackoff-time.Second {
+		t.Errorf("retried in %v", wait)
+	}
+}
+
+func TestHandshakedDeduplicates(t *testing.T) {
+	manager := New(10, 10)
+	torrent := manager.AddTorrent([20]byte{1}, 10)
+
+	newPeer := func(ip net.IP, port uint16, id byte) *models.Peer {
+		local, remote := net.Pipe()
+		t.Cleanup(func() { remote.Close() })
+		peer := models.NewPeer(local, models.PeerAddress{IP: ip, Port: port}, 8)
+		peer.PeerId[0] = id
+		if !torrent.Accept(peer.Address) {
+			t.Fatal("slot refused")
+		}
+		return peer
+	}
+
+	first := newPeer(net.IPv4(192, 0, 2, 1), 6881, 1)
+	if !torrent.Handshaked(first) {
+		t.Fatal("first peer refused")
+	}
+
+	tests := []struct {
+		name     string
+		peer     *models.Peer
+		accepted bool
+	}{
+		{"same address", newPeer(net.IPv4(192, 0, 2, 1), 6881, 2), false},
+		{"same peer id", newPeer(net.IPv4(192, 0, 2, 2), 6881, 1), false},
+		{"same IP on another port", newPeer(net.IPv4(192, 0, 2, 1), 6882, 3), true},
+		{"another peer", newPeer(net.IPv4(192, 0, 2, 3), 6881, 4), true},
+	}
+	for _, test := range tests {
+		if accepted := torrent.Handshaked(test.peer); accepted != test.accepted {
+			t.Errorf("%v: accepted %v, want %v", test.name, accepted, test.accepted)
+		}
+		if !test.accepted {
+			torrent.Closed(test.peer, false)
+		}
+	}
+	if peers := torrent.Peers(); len(peers) != 3 {
+		t.Errorf("%v peers", len(peers))
+	}
+
+	// A duplicate closing leaves the original registered, the original
+	// closing frees its address and peer id
+	if len(torrent.Peers()) != 3 || torrent.peers[first.Address.String()] != first {
+		t.Error("closing a duplicate removed the original")
+	}
+	torrent.Closed(first, false)
+	again := newPeer(net.IPv4(192, 0, 2, 4), 6881, 1)
+	if !torrent.Handshaked(again) {
+		t.Error("peer id of a closed peer refused")
+	}
+	if manager.Connections() != 3 {
+		t.Errorf("%v connections", manager.Connections())
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"torrentClient/models"
+	"torrentClient/picker"
+	"torrentClient/storage"
+)
+
+// applyFilePriorities parses priorities given as "index=priority" pairs
+// separated by commas and applies them before the download starts
+func applyFilePriorities(manifest *models.Manifest, priorities string) error {
+	if priorities == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(priorities, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("expected index=priority but got '" + pair + "'")
+		}
+
+		index, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || index < 0 || index >= len(manifest.FileInfos) {
+			return errors.New("invalid file index '" + parts[0] + "'")
+		}
+
+		priority, err := models.ParseFilePriority(parts[1])
+		if err != nil {
+			return err
+		}
+		manifest.FileInfos[index].Priority = priority
+	}
+	return nil
+}
+
+func setFilePriority(piecePicker *picker.Picker, store *storage.Storage, index int, priority models.FilePriority) error {
+	// Storage has to be ready for the file before the picker hands out its pieces
+	err := store.SetFilePriority(index, priority)
+	if err != nil {
+		return err
+	}
+	return piecePicker.SetFilePriority(index, priority)
+}
+
+func printFiles(manifest *models.Manifest, piecePicker *picker.Picker) {
+	for i := range manifest.FileInfos {
+		file := &manifest.FileInfos[i]
+		if file.Padding {
+			continue
+		}
+		fmt.Printf("%v\t%v\t%v\t%v\n", i, piecePicker.FilePriority(i), file.Length, file.Path)
+	}
+}
+
+func runConsole(manifest *models.Manifest, piecePicker *picker.Picker, store *storage.Storage) {
+	scanner := bufio.NewScanner(os.Stdin)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "files":
+			printFiles(manifest, piecePicker)
+		case "priority":
+			if len(fields) != 3 {
+				fmt.Println("Usage: priority <file index> <skip|low|normal|high>")
+				continue
+			}
+			index, err := strconv.Atoi(fields[1])
+			if err != nil {
+				fmt.Println("Invalid file index", fields[1])
+				continue
+			}
+			priority, err := models.ParseFilePriority(fields[2])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			err = setFilePriority(piecePicker, store, index, priority)
+			if err != nil {
+				fmt.Println("Can't change file priority", err)
+				continue
+			}
+			fmt.Printf("File %v priority set to %v\n", index, priority)
+		case "sequential":
+			if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+				fmt.Println("Usage: sequential <on|off>")
+				continue
+			}
+			piecePicker.SetSequential(fields[1] == "on")
+			fmt.Println("Sequential download", fields[1])
+		case "move":
+			if len(fields) != 2 {
+				fmt.Println("Usage: move <directory>")
+				continue
+			}
+			fmt.Printf("Moving files from %v to %v\n", store.Dir(), fields[1])
+			err := store.Move(fields[1])
+			if err != nil {
+				fmt.Println("Can't move files", err)
+				continue
+			}
+			fmt.Println("Files moved to", fields[1])
+		default:
+			fmt.Println("Commands: files, priority <file index> <skip|low|normal|high>, sequential <on|off>, move <directory>")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"torrentClient/common"
+)
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// runCreate implements the create command, which makes a .torrent file out
+// of a file or directory
+func runCreate(args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	output := flags.String("o", "", "path of the .torrent file, defaults to <name>.torrent")
+	trackers := flags.String("announce", "", "comma separated tracker urls, the first one is the main tracker")
+	comment := flags.String("comment", "", "comment of the torrent")
+	createdBy := flags.String("created-by", "torrentClient", "creator of the torrent")
+	private := flags.Bool("private", false, "only get peers from the trackers")
+	webSeeds := flags.String("webseed", "", "comma separated web seed urls")
+	pieceLength := flags.Int64("piece-length", 0, "piece length in bytes, picked from the total length when zero")
+	workers := flags.Int("workers", 0, "goroutines hashing pieces, one per CPU when zero")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: create [options] <file or directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	manifest, content, err := common.CreateTorrent(common.CreateOptions{
+		Path:        flags.Arg(0),
+		PieceLength: *pieceLength,
+		Trackers:    splitList(*trackers),
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		WebSeeds:    splitList(*webSeeds),
+		Workers:     *workers,
+	})
+	if err != nil {
+		fmt.Println("Can't create torrent", err)
+		os.Exit(1)
+	}
+
+	if *output == "" {
+		*output = manifest.Name + ".torrent"
+	}
+
+	err = os.WriteFile(*output, content, 0644)
+	if err != nil {
+		fmt.Println("Can't write torrent file", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Created %v with info hash %x, %v pieces of %v bytes\n", *output, manifest.InfoHash, len(manifest.PieceHashes), manifest.PieceLength)
+}
@@ -1,5 +1,5 @@
 module torrentClient
 
-go 1.17
+go 1.18
 
-require github.com/IncSW/go-bencode v0.2.2 // indirect
\ No newline at end of file
+require github.com/IncSW/go-bencode v0.2.2
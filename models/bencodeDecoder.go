@@ -0,0 +1,188 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Nesting deeper than this is rejected instead of growing the stack
+const maxBencodeDepth = 64
+
+// Span is the position of a bencoded value inside the decoded data
+type Span struct {
+	Start int
+	End   int
+}
+
+// bencodeDecoder decodes into the same types as the bencode library and
+// records the byte span of every value of the top level dictionary, so hashes
+// can be taken over the original bytes instead of a re-encoding
+type bencodeDecoder struct {
+	data     []byte
+	position int
+	spans    map[string]Span
+}
+
+// DecodeBencode decodes a single bencoded value and returns the spans of the
+// values of its top level dictionary
+func DecodeBencode(data []byte) (interface{}, map[string]Span, error) {
+	decoder := &bencodeDecoder{
+		data:  data,
+		spans: map[string]Span{},
+	}
+
+	value, err := decoder.decode(0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if decoder.position != len(data) {
+		return nil, nil, fmt.Errorf("bencode: %v bytes of trailing data", len(data)-decoder.position)
+	}
+	return value, decoder.spans, nil
+}
+
+func (decoder *bencodeDecoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("bencode: "+format+" at offset %v", append(args, decoder.position)...)
+}
+
+func (decoder *bencodeDecoder) decode(depth int) (interface{}, error) {
+	if decoder.position >= len(decoder.data) {
+		return nil, errors.New("bencode: unexpected end of data")
+	}
+	if depth > maxBencodeDepth {
+		return nil, decoder.errorf("nesting deeper than %v", maxBencodeDepth)
+	}
+
+	switch c := decoder.data[decoder.position]; {
+	case c == 'i':
+		return decoder.decodeInt()
+	case c == 'l':
+		return decoder.decodeList(depth)
+	case c == 'd':
+		return decoder.decodeDictionary(depth)
+	case c >= '0' && c <= '9':
+		return decoder.decodeBytes()
+	default:
+		return nil, decoder.errorf("invalid value type '%c'", c)
+	}
+}
+
+func (decoder *bencodeDecoder) decodeInt() (int64, error) {
+	decoder.position++
+	end := decoder.position
+	for end < len(decoder.data) && decoder.data[end] != 'e' {
+		end++
+	}
+	if end == len(decoder.data) {
+		return 0, errors.New("bencode: unterminated integer")
+	}
+
+	digits := string(decoder.data[decoder.position:end])
+	if !isDigits(strings.TrimPrefix(digits, "-")) || digits == "-0" ||
+		(len(digits) > 1 && digits[0] == '0') || (len(digits) > 2 && digits[:2] == "-0") {
+		return 0, decoder.errorf("invalid integer '%v'", digits)
+	}
+
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, decoder.errorf("invalid integer '%v'", digits)
+	}
+	decoder.position = end + 1
+	return value, nil
+}
+
+func (decoder *bencodeDecoder) decodeBytes() ([]byte, error) {
+	colon := decoder.position
+	for colon < len(decoder.data) && decoder.data[colon] != ':' {
+		colon++
+	}
+	if colon == len(decoder.data) {
+		return nil, errors.New("bencode: unterminated string length")
+	}
+
+	digits := string(decoder.data[decoder.position:colon])
+	if !isDigits(digits) || (len(digits) > 1 && digits[0] == '0') {
+		return nil, decoder.errorf("invalid string length '%v'", digits)
+	}
+	length, err := strconv.Atoi(digits)
+	if err != nil || length < 0 {
+		return nil, decoder.errorf("invalid string length '%v'", digits)
+	}
+
+	start := colon + 1
+	if length > len(decoder.data)-start {
+		return nil, decoder.errorf("string of %v bytes past the end of data", length)
+	}
+	decoder.position = start + length
+	return decoder.data[start:decoder.position], nil
+}
+
+// isDigits reports whether s is made of decimal digits only, strconv also
+// takes a sign
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (decoder *bencodeDecoder) decodeList(depth int) ([]interface{}, error) {
+	decoder.position++
+	list := []interface{}{}
+	for {
+		if decoder.position >= len(decoder.data) {
+			return nil, errors.New("bencode: unterminated list")
+		}
+		if decoder.data[decoder.position] == 'e' {
+			decoder.position++
+			return list, nil
+		}
+		value, err := decoder.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+}
+
+func (decoder *bencodeDecoder) decodeDictionary(depth int) (map[string]interface{}, error) {
+	decoder.position++
+	dictionary := map[string]interface{}{}
+	for {
+		if decoder.position >= len(decoder.data) {
+			return nil, errors.New("bencode: unterminated dictionary")
+		}
+		if decoder.data[decoder.position] == 'e' {
+			decoder.position++
+			return dictionary, nil
+		}
+
+		c := decoder.data[decoder.position]
+		if c < '0' || c > '9' {
+			return nil, decoder.errorf("dictionary key is not a string")
+		}
+		key, err := decoder.decodeBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		start := decoder.position
+		value, err := decoder.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if depth == 0 {
+			decoder.spans[string(key)] = Span{Start: start, End: decoder.position}
+		}
+		dictionary[string(key)] = value
+	}
+}
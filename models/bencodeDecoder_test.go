@@ -0,0 +1,169 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBencode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{"i0e", int64(0)},
+		{"i42e", int64(42)},
+		{"i-42e", int64(-42)},
+		{"i9223372036854775807e", int64(9223372036854775807)},
+		{"0:", []byte{}},
+		{"3:abc", []byte("abc")},
+		{"le", []interface{}{}},
+		{"li1e3:abce", []interface{}{int64(1), []byte("abc")}},
+		{"de", map[string]interface{}{}},
+		{"d1:ai1e1:bl1:cee", map[string]interface{}{"a": int64(1), "b": []interface{}{[]byte("c")}}},
+	}
+	for _, test := range tests {
+		got, _, err := DecodeBencode([]byte(test.input))
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %#v, want %#v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestDecodeBencodeInvalid(t *testing.T) {
+	inputs := []string{
+		"",
+		"x",
+		"ie",
+		"i-e",
+		"i-0e",
+		"i03e",
+		"i-03e",
+		"i+5e",
+		"i 5e",
+		"i5 e",
+		"i0x10e",
+		"i1.5e",
+		"i5",
+		"i9223372036854775808e",
+		"+3:abc",
+		"-3:abc",
+		"03:abc",
+		" 3:abc",
+		"3:ab",
+		"3abc",
+		"l",
+		"li1e",
+		"d",
+		"d1:a",
+		"d1:ai1e",
+		"di1ei2ee",
+		"i1ei2e",
+		"3:abcx",
+	}
+	for _, input := range inputs {
+		if value, _, err := DecodeBencode([]byte(input)); err == nil {
+			t.Errorf("%q decoded to %#v", input, value)
+		}
+	}
+}
+
+func TestDecodeBencodeDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		data := []byte{}
+		for i := 0; i < depth; i++ {
+			data = append(data, 'l')
+		}
+		for i := 0; i < depth; i++ {
+			data = append(data, 'e')
+		}
+		return data
+	}
+
+	if _, _, err := DecodeBencode(nested(maxBencodeDepth + 1)); err != nil {
+		t.Errorf("nesting of %v rejected, %v", maxBencodeDepth+1, err)
+	}
+	if _, _, err := DecodeBencode(nested(100000)); err == nil {
+		t.Error("deep nesting accepted")
+	}
+}
+
+func TestDecodeBencodeSpans(t *testing.T) {
+	data := []byte("d1:ai12e1:bl1:ce1:cd1:di1eee")
+	_, spans, err := DecodeBencode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "i12e", "b": "l1:ce", "c": "d1:di1ee"}
+	if len(spans) != len(want) {
+		t.Errorf("got %v spans, only the top level dictionary has spans", len(spans))
+	}
+	for key, value := range want {
+		span := spans[key]
+		if got := string(data[span.Start:span.End]); got != value {
+			t.Errorf("span of %v is %q, want %q", key, got, value)
+		}
+	}
+}
+
+func FuzzParseManifest(f *testing.F) {
+	torrent, err := os.ReadFile("../debian-11.6.0-amd64-netinst.iso.torrent")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(torrent)
+	f.Add([]byte("d8:announce20:http://tracker/annce4:infod6:lengthi5e4:name4:test12:piece lengthi16384e6:pieces20:xxxxxxxxxxxxxxxxxxxxee"))
+	f.Add([]byte("d4:infod5:filesld6:lengthi5e4:pathl1:a1:beee4:name1:d12:piece lengthi16384e6:pieces20:xxxxxxxxxxxxxxxxxxxxee"))
+	f.Add([]byte("d1:ai-1e1:bl0:lee1:cdee"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, spans, err := DecodeBencode(data)
+		if err == nil {
+			if _, ok := value.(map[string]interface{}); !ok && len(spans) > 0 {
+				t.Errorf("spans of a %v", typeName(value))
+			}
+			for key, span := range spans {
+				if span.Start < 0 || span.End > len(data) || span.Start >= span.End {
+					t.Errorf("span of %q is %+v in %v bytes", key, span, len(data))
+				}
+			}
+		}
+
+		manifest, err := DecodeManifestFile(data)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidManifest) {
+				t.Errorf("error %v isn't an ErrInvalidManifest", err)
+			}
+			return
+		}
+
+		if manifest.PieceLength <= 0 || manifest.Length <= 0 {
+			t.Errorf("%v bytes in pieces of %v", manifest.Length, manifest.PieceLength)
+		}
+		var length int64
+		for _, file := range manifest.FileInfos {
+			if file.Offset != length || file.Length < 0 {
+				t.Errorf("file %v at %v of %v bytes after %v bytes", file.Path, file.Offset, file.Length, length)
+			}
+			length += file.Length
+			for _, part := range strings.Split(file.Path, "/") {
+				if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "\\\x00") {
+					t.Errorf("unsafe path %q", file.Path)
+				}
+			}
+		}
+		if length != manifest.Length {
+			t.Errorf("files have %v bytes of %v", length, manifest.Length)
+		}
+		if manifest.MetaVersion != 2 && len(manifest.PieceHashes) != manifest.PieceCount() {
+			t.Errorf("%v piece hashes for %v pieces", len(manifest.PieceHashes), manifest.PieceCount())
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/IncSW/go-bencode"
+)
+
+// Extended messages carry their extension's id as the first payload byte,
+// zero is the extended handshake (BEP 10)
+const ExtendedHandshakeId = 0
+
+// ExtendedHandshake is the dictionary peers supporting the extension
+// protocol send after the handshake, and again whenever it changes
+type ExtendedHandshake struct {
+	// Messages maps the extensions the sender supports to their ids
+	Messages map[string]int
+	Client   string
+	Port     int
+	// UploadOnly peers don't download anything (BEP 21)
+	UploadOnly bool
+}
+
+// SetExtensions advertises extension protocol support (BEP 10)
+func (handShake *HandShake) SetExtensions() {
+	handShake.Reserved[5] |= 0x10
+}
+
+func (handShake *HandShake) SupportsExtensions() bool {
+	return handShake.Reserved[5]&0x10 != 0
+}
+
+func (extendedHandshake ExtendedHandshake) ToMessage() (Message, error) {
+	messages := map[string]interface{}{}
+	for name, id := range extendedHandshake.Messages {
+		messages[name] = int64(id)
+	}
+
+	data := map[string]interface{}{
+		"m": messages,
+	}
+	if extendedHandshake.Client != "" {
+		data["v"] = extendedHandshake.Client
+	}
+	if extendedHandshake.Port != 0 {
+		data["p"] = int64(extendedHandshake.Port)
+	}
+	if extendedHandshake.UploadOnly {
+		data["upload_only"] = int64(1)
+	}
+
+	encoded, err := bencode.Marshal(data)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:    MsgTypeExtended,
+		Payload: append([]byte{ExtendedHandshakeId}, encoded...),
+	}, nil
+}
+
+// ReadExtendedHandshake reads the payload of an extended handshake message,
+// unknown keys are ignored
+func ReadExtendedHandshake(payload []byte) (ExtendedHandshake, error) {
+	if len(payload) < 1 || payload[0] != ExtendedHandshakeId {
+		return ExtendedHandshake{}, errors.New("not an extended handshake")
+	}
+
+	decoded, err := bencode.Unmarshal(payload[1:])
+	if err != nil {
+		return ExtendedHandshake{}, err
+	}
+	data, ok := decoded.(map[string]interface{})
+	if !ok {
+		return ExtendedHandshake{}, errors.New("extended handshake is not a dictionary")
+	}
+
+	extendedHandshake := ExtendedHandshake{Messages: map[string]int{}}
+	if messages, ok := data["m"].(map[string]interface{}); ok {
+		for name, id := range messages {
+			// Id zero disables an extension
+			if id, ok := id.(int64); ok && id > 0 && id < 256 {
+				extendedHandshake.Messages[name] = int(id)
+			}
+		}
+	}
+	if client, ok := data["v"].([]byte); ok {
+		extendedHandshake.Client = string(client)
+	}
+	if port, ok := data["p"].(int64); ok && port > 0 && port < 65536 {
+		extendedHandshake.Port = int(port)
+	}
+	if uploadOnly, ok := data["upload_only"].(int64); ok {
+		extendedHandshake.UploadOnly = uploadOnly != 0
+	}
+
+	return extendedHandshake, nil
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+type FilePriority int
+
+const (
+	PrioritySkip   FilePriority = 0
+	PriorityLow    FilePriority = 1
+	PriorityNormal FilePriority = 4
+	PriorityHigh   FilePriority = 7
+)
+
+func (priority FilePriority) String() string {
+	switch priority {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return strconv.Itoa(int(priority))
+	}
+}
+
+func ParseFilePriority(value string) (FilePriority, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "skip", "0":
+		return PrioritySkip, nil
+	case "low", "1":
+		return PriorityLow, nil
+	case "normal", "4":
+		return PriorityNormal, nil
+	case "high", "7":
+		return PriorityHigh, nil
+	}
+	return PrioritySkip, errors.New("invalid file priority '" + value + "', expected skip, low, normal or high")
+}
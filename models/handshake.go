@@ -4,10 +4,20 @@ import "io"
 
 type HandShake struct {
 	HeaderText string
+	Reserved   [8]byte
 	InfoHash   [20]byte
 	PeerId     [20]byte
 }
 
+// SetV2 advertises BitTorrent v2 support (BEP 52)
+func (handShake *HandShake) SetV2() {
+	handShake.Reserved[7] |= 0x10
+}
+
+func (handShake *HandShake) SupportsV2() bool {
+	return handShake.Reserved[7]&0x10 != 0
+}
+
 func New(infoHash, peerId [20]byte) HandShake {
 	return HandShake{
 		HeaderText: "BitTorrent protocol",
@@ -21,7 +31,7 @@ func (handShake *HandShake) ToBytes() []byte {
 	buf[0] = byte(len(handShake.HeaderText))
 	curr := 1
 	curr += copy(buf[curr:], []byte(handShake.HeaderText))
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], handShake.Reserved[:])
 	curr += copy(buf[curr:], handShake.InfoHash[:])
 	curr += copy(buf[curr:], handShake.PeerId[:])
 	return buf
@@ -62,6 +72,7 @@ func ReadHandShake(reader io.Reader) (HandShake, error) {
 
 	return HandShake{
 		HeaderText: string(headerText[:]),
+		Reserved:   reserved,
 		InfoHash:   infoHash,
 		PeerId:     peerId,
 	}, nil
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// HashRequest asks for a range of hashes of a file's merkle tree (BEP 52), the
+// same payload is sent back in hash reject messages
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+func (req HashRequest) ToBytes() []byte {
+	bytes := make([]byte, 0, 48)
+
+	bytes = append(bytes, req.PiecesRoot[:]...)
+	bytes = binary.BigEndian.AppendUint32(bytes, uint32(req.BaseLayer))
+	bytes = binary.BigEndian.AppendUint32(bytes, uint32(req.Index))
+	bytes = binary.BigEndian.AppendUint32(bytes, uint32(req.Length))
+	bytes = binary.BigEndian.AppendUint32(bytes, uint32(req.ProofLayers))
+	return bytes
+}
+
+func ReadHashRequest(payload []byte) (HashRequest, error) {
+	if len(payload) < 48 {
+		return HashRequest{}, errors.New("invalid payload length hash request message")
+	}
+	req := HashRequest{
+		BaseLayer:   int(binary.BigEndian.Uint32(payload[32:36])),
+		Index:       int(binary.BigEndian.Uint32(payload[36:40])),
+		Length:      int(binary.BigEndian.Uint32(payload[40:44])),
+		ProofLayers: int(binary.BigEndian.Uint32(payload[44:48])),
+	}
+	copy(req.PiecesRoot[:], payload[:32])
+	return req, nil
+}
+
+// ReadHashesMessage splits a hashes message into the request it answers and
+// the hashes, the requested ones followed by the proof hashes
+func ReadHashesMessage(payload []byte) (HashRequest, [][32]byte, error) {
+	req, err := ReadHashRequest(payload)
+	if err != nil {
+		return HashRequest{}, nil, err
+	}
+	if (len(payload)-48)%32 != 0 {
+		return HashRequest{}, nil, errors.New("invalid payload length hashes message")
+	}
+	return req, SplitHashes(payload[48:]), nil
+}
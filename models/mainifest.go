@@ -2,9 +2,11 @@ package models
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"math"
 	"path"
-
-	"github.com/IncSW/go-bencode"
+	"strings"
 )
 
 type Manifest struct {
@@ -19,50 +21,187 @@ type Manifest struct {
 	Name         string
 	Comment      string
 	CreatedBy    string
-	FileInfos    []FileInfo
+	CreationDate int64
+	// MultiFile is true when the info dictionary has a files list
+	MultiFile bool
+	Private   bool
+	// Web seed urls
+	UrlList   []string
+	FileInfos []FileInfo
+	// MetaVersion is 2 for BitTorrent v2 and hybrid torrents
+	MetaVersion int
+	// InfoHashV2 is the SHA-256 of the info dictionary of v2 torrents
+	InfoHashV2 [32]byte
+	// PieceLayers maps the pieces root of every file bigger than a piece to
+	// the concatenated merkle hashes of its pieces
+	PieceLayers map[[32]byte][]byte
 }
 
 type FileInfo struct {
-	Path   string
-	Name   string
-	Length int64
-	Offset int64
+	Path     string
+	Name     string
+	Length   int64
+	Offset   int64
+	Priority FilePriority
+	// PiecesRoot is the merkle root of the file in v2 torrents
+	PiecesRoot [32]byte
+	// Padding files only align the next file to a piece boundary, their
+	// zeros are never stored
+	Padding bool
 }
 
-func DecodeManifestFile(data interface{}) Manifest {
-	manifestoMap := data.(map[string]interface{})
+// FilePieces returns the first and last piece index overlapping the given file
+func (manifest *Manifest) FilePieces(fileIndex int) (int, int) {
+	file := &manifest.FileInfos[fileIndex]
+	first := int(file.Offset / manifest.PieceLength)
+	last := first
+	if file.Length > 0 {
+		last = int((file.Offset + file.Length - 1) / manifest.PieceLength)
+	}
+	return first, last
+}
+
+func DecodeManifestFile(content []byte) (Manifest, error) {
+	data, spans, err := DecodeBencode(content)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	manifestoMap, ok := data.(map[string]interface{})
+	if !ok {
+		return Manifest{}, manifestError("", "expected a dictionary but got %v", typeName(data))
+	}
+
+	announce, err := getString(manifestoMap, "announce", "", false)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	announceList, err := getAnnounceList(manifestoMap)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	urlList, err := getUrlList(manifestoMap)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	comment, err := getString(manifestoMap, "comment", "", false)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	createdBy, err := getString(manifestoMap, "created by", "", false)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	creationDate, _, err := getInt(manifestoMap, "creation date", "", false)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	info, err := getDict(manifestoMap, "info", "", true)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	pieceLength, _, err := getInt(info, "piece length", "info", true)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if pieceLength <= 0 {
+		return Manifest{}, manifestError("info", "piece length must be positive but is %v", pieceLength)
+	}
+
+	name, err := getString(info, "name", "info", true)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if err := checkPathPart(name, "info.name"); err != nil {
+		return Manifest{}, err
+	}
+
+	// Hash the info dictionary exactly as it is encoded in the file, a
+	// re-encoding may differ from it
+	infoSpan := spans["info"]
+	infoHash := sha1.Sum(content[infoSpan.Start:infoSpan.End])
+
+	private, _, err := getInt(info, "private", "info", false)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	metaVersion, _, err := getInt(info, "meta version", "info", false)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if metaVersion < 0 || metaVersion > 2 {
+		return Manifest{}, manifestError("info", "unsupported meta version %v", metaVersion)
+	}
+	_, hasPieces := info["pieces"]
+
+	manifest := Manifest{
+		Announce:     announce,
+		AnnounceList: announceList,
+		InfoHash:     infoHash,
+		PieceLength:  pieceLength,
+		Name:         name,
+		Comment:      comment,
+		CreatedBy:    createdBy,
+		CreationDate: creationDate,
+		Private:      private == 1,
+		UrlList:      urlList,
+		MetaVersion:  int(metaVersion),
+	}
 
-	announce := string(manifestoMap["announce"].([]byte))
+	if hasPieces || metaVersion != 2 {
+		err = decodeV1(&manifest, info)
+		if err != nil {
+			return Manifest{}, err
+		}
+	}
 
-	announceList := []string{}
-	if manifestoMap["announce-list"] != nil {
-		for _, announce := range manifestoMap["announce-list"].([]interface{}) {
-			announceList = append(announceList, string(announce.([]interface{})[0].([]byte)))
+	if metaVersion == 2 {
+		manifest.InfoHashV2 = sha256.Sum256(content[infoSpan.Start:infoSpan.End])
+		err = decodeV2(&manifest, manifestoMap, info)
+		if err != nil {
+			return Manifest{}, err
+		}
+		// v2 only torrents are known by their truncated v2 info hash
+		if !hasPieces {
+			manifest.InfoHash = manifest.TruncatedInfoHashV2()
 		}
 	}
 
-	comment := ""
-	if manifestoMap["comment"] != nil {
-		comment = string(manifestoMap["comment"].([]byte))
+	if manifest.Length == 0 {
+		return Manifest{}, manifestError("info", "torrent has no data")
 	}
 
-	createdBy := ""
-	if manifestoMap["created by"] != nil {
-		createdBy = string(manifestoMap["created by"].([]byte))
+	if hasPieces || metaVersion != 2 {
+		expectedPieces := (manifest.Length-1)/pieceLength + 1
+		if int64(len(manifest.PieceHashes)) != expectedPieces {
+			return Manifest{}, manifestError("info", "%v bytes in pieces of %v bytes need %v piece hashes but there are %v", manifest.Length, pieceLength, expectedPieces, len(manifest.PieceHashes))
+		}
 	}
 
-	info := manifestoMap["info"].(map[string]interface{})
+	return manifest, nil
+}
 
-	pieceLength := info["piece length"].(int64)
-	name := string(info["name"].([]byte))
+// decodeV1 parses the piece hashes and the files of a v1 or hybrid torrent
+func decodeV1(manifest *Manifest, info map[string]interface{}) error {
+	name := manifest.Name
 
-	// NOTICE: Not sure if this is correct
-	infoBytes, _ := bencode.Marshal(info)
-	infoHash := sha1.Sum(infoBytes)
+	pieces, err := getBytes(info, "pieces", "info", true)
+	if err != nil {
+		return err
+	}
+	if len(pieces)%20 != 0 {
+		return manifestError("info", "pieces length %v is not a multiple of 20", len(pieces))
+	}
 
 	pieceHashes := [][20]byte{}
-	pieces := info["pieces"].([]byte)
-
 	for i := 0; i < len(pieces); i += 20 {
 		var currentHash [20]byte
 		copy(currentHash[:], pieces[i:i+20])
@@ -70,49 +209,90 @@ func DecodeManifestFile(data interface{}) Manifest {
 	}
 
 	files := []interface{}{info}
+	multiFile := info["files"] != nil
 
-	if info["files"] != nil {
-		files = info["files"].([]interface{})
+	if multiFile {
+		files, err = getList(info, "files", "info", true)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return manifestError("info", "files list is empty")
+		}
 	}
 
 	fileInfos := []FileInfo{}
 	var offset int64
 
-	for _, file := range files {
-		file := file.(map[string]interface{})
+	for i, file := range files {
+		context := "info"
+		if multiFile {
+			context = fmt.Sprintf("info.files[%v]", i)
+		}
+
+		file, ok := file.(map[string]interface{})
+		if !ok {
+			return manifestError(context, "expected a dictionary but got %v", typeName(files[i]))
+		}
 
 		parts := []string{name}
 
-		if file["path"] != nil {
-			for _, part := range file["path"].([]interface{}) {
-				parts = append(parts, string(part.([]byte)))
+		if multiFile {
+			pathParts, err := getList(file, "path", context, true)
+			if err != nil {
+				return err
+			}
+			if len(pathParts) == 0 {
+				return manifestError(context, "path is empty")
+			}
+			for j, part := range pathParts {
+				part, ok := part.([]byte)
+				if !ok {
+					return manifestError(context, "path[%v] expected a string but got %v", j, typeName(pathParts[j]))
+				}
+				if err := checkPathPart(string(part), fmt.Sprintf("%v.path[%v]", context, j)); err != nil {
+					return err
+				}
+				parts = append(parts, string(part))
 			}
 		} else {
 			parts = append(parts, name)
 		}
 
-		length := file["length"].(int64)
+		length, _, err := getInt(file, "length", context, true)
+		if err != nil {
+			return err
+		}
+		if length < 0 || length > math.MaxInt64-offset {
+			return manifestError(context, "invalid length %v", length)
+		}
+
+		// Padding files (BEP 47) are marked with a 'p' attribute
+		attr, err := getString(file, "attr", context, false)
+		if err != nil {
+			return err
+		}
+		padding := strings.Contains(attr, "p")
+		priority := PriorityNormal
+		if padding {
+			priority = PrioritySkip
+		}
 
 		fileInfos = append(fileInfos, FileInfo{
-			Path:   path.Join(parts...),
-			Name:   parts[len(parts)-1],
-			Length: length,
-			Offset: offset,
+			Path:     path.Join(parts...),
+			Name:     parts[len(parts)-1],
+			Length:   length,
+			Offset:   offset,
+			Priority: priority,
+			Padding:  padding,
 		})
 
 		offset += length
 	}
 
-	return Manifest{
-		Announce:     announce,
-		AnnounceList: announceList,
-		InfoHash:     infoHash,
-		PieceHashes:  pieceHashes,
-		PieceLength:  pieceLength,
-		Length:       offset,
-		Name:         name,
-		Comment:      comment,
-		CreatedBy:    createdBy,
-		FileInfos:    fileInfos,
-	}
+	manifest.PieceHashes = pieceHashes
+	manifest.MultiFile = multiFile
+	manifest.FileInfos = fileInfos
+	manifest.Length = offset
+	return nil
 }
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/IncSW/go-bencode"
+)
+
+func TestInfoHashOfRealTorrent(t *testing.T) {
+	content, err := os.ReadFile("../debian-11.6.0-amd64-netinst.iso.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := DecodeManifestFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := hex.EncodeToString(manifest.InfoHash[:]); got != "6d4795dee70aeb88e03e5336ca7c9fcf0a1e206d" {
+		t.Errorf("info hash %v", got)
+	}
+	if manifest.Name != "debian-11.6.0-amd64-netinst.iso" || manifest.Length != 406847488 || manifest.PieceLength != 262144 {
+		t.Errorf("got %v of %v bytes in pieces of %v", manifest.Name, manifest.Length, manifest.PieceLength)
+	}
+	if len(manifest.PieceHashes) != manifest.PieceCount() {
+		t.Errorf("%v piece hashes for %v pieces", len(manifest.PieceHashes), manifest.PieceCount())
+	}
+}
+
+func TestInfoHashOverOriginalBytes(t *testing.T) {
+	// Keys out of order and a key the encoder doesn't know, a re-encoding
+	// sorts the keys and drops the unknown one
+	info := "d4:name4:test12:piece lengthi16384e6:lengthi5e6:pieces20:" + strings.Repeat("x", 20) + "7:x-extra3:abce"
+	content := []byte("d8:announce20:http://tracker/annce4:info" + info + "e")
+
+	manifest, err := DecodeManifestFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest.InfoHash != sha1.Sum([]byte(info)) {
+		t.Error("info hash isn't the hash of the original info dictionary")
+	}
+	encoded, reencodedHash, err := manifest.EncodeInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) == info || reencodedHash == manifest.InfoHash {
+		t.Errorf("re-encoding %q should differ from the original", encoded)
+	}
+}
+
+// testTorrent returns a valid single file torrent, edit changes its
+// dictionaries before they are encoded
+func testTorrent(t *testing.T, edit func(torrent map[string]interface{}, info map[string]interface{})) []byte {
+	info := map[string]interface{}{
+		"name":         "file.bin",
+		"piece length": int64(16384),
+		"length":       int64(20000),
+		"pieces":       strings.Repeat("x", 40),
+	}
+	torrent := map[string]interface{}{
+		"announce": "http://tracker/announce",
+		"info":     info,
+	}
+	if edit != nil {
+		edit(torrent, info)
+	}
+	content, err := bencode.Marshal(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func multiFile(info map[string]interface{}, files ...interface{}) {
+	delete(info, "length")
+	info["files"] = files
+}
+
+func file(length int64, path ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"length": length, "path": path}
+}
+
+func TestDecodeManifestValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(torrent map[string]interface{}, info map[string]interface{})
+		error string
+	}{
+		{"missing info", func(torrent, info map[string]interface{}) { delete(torrent, "info") }, "missing key 'info'"},
+		{"info not a dictionary", func(torrent, info map[string]interface{}) { torrent["info"] = "x" }, "'info' expected a dictionary but got a string"},
+		{"announce not a string", func(torrent, info map[string]interface{}) { torrent["announce"] = int64(1) }, "'announce' expected a string but got an integer"},
+		{"announce tier not a list", func(torrent, info map[string]interface{}) { torrent["announce-list"] = []interface{}{"x"} }, "announce-list[0] expected a list but got a string"},
+		{"announce url not a string", func(torrent, info map[string]interface{}) {
+			torrent["announce-list"] = []interface{}{[]interface{}{int64(1)}}
+		}, "announce-list[0][0] expected a string but got an integer"},
+		{"url list not a list", func(torrent, info map[string]interface{}) { torrent["url-list"] = int64(1) }, "'url-list' expected a string or a list but got an integer"},
+		{"url not a string", func(torrent, info map[string]interface{}) { torrent["url-list"] = []interface{}{int64(1)} }, "url-list[0] expected a string but got an integer"},
+		{"creation date not an integer", func(torrent, info map[string]interface{}) { torrent["creation date"] = "today" }, "'creation date' expected an integer but got a string"},
+		{"missing piece length", func(torrent, info map[string]interface{}) { delete(info, "piece length") }, "info: missing key 'piece length'"},
+		{"zero piece length", func(torrent, info map[string]interface{}) { info["piece length"] = int64(0) }, "info: piece length must be positive but is 0"},
+		{"negative piece length", func(torrent, info map[string]interface{}) { info["piece length"] = int64(-16384) }, "info: piece length must be positive but is -16384"},
+		{"missing name", func(torrent, info map[string]interface{}) { delete(info, "name") }, "info: missing key 'name'"},
+		{"empty name", func(torrent, info map[string]interface{}) { info["name"] = "" }, "info.name: empty path component"},
+		{"name traversal", func(torrent, info map[string]interface{}) { info["name"] = ".." }, "info.name: path traversal with '..'"},
+		{"name with a separator", func(torrent, info map[string]interface{}) { info["name"] = "a/b" }, "info.name: path component 'a/b' contains a separator"},
+		{"name with a backslash", func(torrent, info map[string]interface{}) { info["name"] = `a\b` }, `info.name: path component 'a\b' contains a separator`},
+		{"unsupported meta version", func(torrent, info map[string]interface{}) { info["meta version"] = int64(3) }, "info: unsupported meta version 3"},
+		{"missing pieces", func(torrent, info map[string]interface{}) { delete(info, "pieces") }, "info: missing key 'pieces'"},
+		{"pieces not a multiple of 20", func(torrent, info map[string]interface{}) { info["pieces"] = strings.Repeat("x", 39) }, "info: pieces length 39 is not a multiple of 20"},
+		{"too few piece hashes", func(torrent, info map[string]interface{}) { info["pieces"] = strings.Repeat("x", 20) }, "info: 20000 bytes in pieces of 16384 bytes need 2 piece hashes but there are 1"},
+		{"too many piece hashes", func(torrent, info map[string]interface{}) { info["pieces"] = strings.Repeat("x", 60) }, "need 2 piece hashes but there are 3"},
+		{"missing length", func(torrent, info map[string]interface{}) { delete(info, "length") }, "info: missing key 'length'"},
+		{"negative length", func(torrent, info map[string]interface{}) { info["length"] = int64(-1) }, "info: invalid length -1"},
+		{"no data", func(torrent, info map[string]interface{}) { info["length"] = int64(0) }, "info: torrent has no data"},
+		{"empty files", func(torrent, info map[string]interface{}) { multiFile(info) }, "info: files list is empty"},
+		{"file not a dictionary", func(torrent, info map[string]interface{}) { multiFile(info, "x") }, "info.files[0]: expected a dictionary but got a string"},
+		{"file without a path", func(torrent, info map[string]interface{}) {
+			multiFile(info, map[string]interface{}{"length": int64(20000)})
+		}, "info.files[0]: missing key 'path'"},
+		{"empty path", func(torrent, info map[string]interface{}) { multiFile(info, file(20000)) }, "info.files[0]: path is empty"},
+		{"path part not a string", func(torrent, info map[string]interface{}) { multiFile(info, file(20000, int64(1))) }, "info.files[0]: path[0] expected a string but got an integer"},
+		{"path traversal", func(torrent, info map[string]interface{}) {
+			multiFile(info, file(10000, "a"), file(10000, "..", "etc", "passwd"))
+		}, "info.files[1].path[0]: path traversal with '..'"},
+		{"current directory in path", func(torrent, info map[string]interface{}) { multiFile(info, file(20000, "a", ".")) }, "info.files[0].path[1]: path traversal with '.'"},
+		{"empty path part", func(torrent, info map[string]interface{}) { multiFile(info, file(20000, "a", "")) }, "info.files[0].path[1]: empty path component"},
+		{"separator in path part", func(torrent, info map[string]interface{}) { multiFile(info, file(20000, "a/../../b")) }, "info.files[0].path[0]: path component 'a/../../b' contains a separator"},
+		{"nul in path part", func(torrent, info map[string]interface{}) { multiFile(info, file(20000, "a\x00b")) }, "contains a separator"},
+		{"file without a length", func(torrent, info map[string]interface{}) {
+			multiFile(info, map[string]interface{}{"path": []interface{}{"a"}})
+		}, "info.files[0]: missing key 'length'"},
+		{"negative file length", func(torrent, info map[string]interface{}) {
+			multiFile(info, file(30000, "a"), file(-10000, "b"))
+		}, "info.files[1]: invalid length -10000"},
+		{"file lengths overflowing", func(torrent, info map[string]interface{}) {
+			multiFile(info, file(math.MaxInt64, "a"), file(1, "b"))
+		}, "info.files[1]: invalid length 1"},
+	}
+
+	for _, test := range tests {
+		_, err := DecodeManifestFile(testTorrent(t, test.edit))
+		if err == nil {
+			t.Errorf("%v: accepted", test.name)
+			continue
+		}
+		if !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("%v: error %v isn't an ErrInvalidManifest", test.name, err)
+		}
+		if !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%v: got %q, want %q", test.name, err, test.error)
+		}
+	}
+}
+
+func TestDecodeManifestNotBencode(t *testing.T) {
+	inputs := map[string]string{
+		"":               "bencode: unexpected end of data",
+		"d4:info":        "bencode: unexpected end of data",
+		"le":             "expected a dictionary but got a list",
+		"i1e":            "expected a dictionary but got an integer",
+		"d4:infodee1:x":  "trailing data",
+		"d4:infoi+1ee":   "invalid integer '+1'",
+		"d4:info99:abce": "past the end of data",
+	}
+	for input, message := range inputs {
+		_, err := DecodeManifestFile([]byte(input))
+		if err == nil || !errors.Is(err, ErrInvalidManifest) || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: got %v, want %q", input, err, message)
+		}
+	}
+}
+
+func TestDecodeManifestValid(t *testing.T) {
+	manifest, err := DecodeManifestFile(testTorrent(t, func(torrent, info map[string]interface{}) {
+		multiFile(info, file(15000, "dir", "a"), file(5000, "b"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []FileInfo{
+		{Path: "file.bin/dir/a", Name: "a", Length: 15000, Offset: 0, Priority: PriorityNormal},
+		{Path: "file.bin/b", Name: "b", Length: 5000, Offset: 15000, Priority: PriorityNormal},
+	}
+	if !reflect.DeepEqual(manifest.FileInfos, want) {
+		t.Errorf("got files %+v", manifest.FileInfos)
+	}
+	if manifest.Length != 20000 || manifest.PieceCount() != 2 || !manifest.MultiFile {
+		t.Errorf("got %v bytes in %v pieces", manifest.Length, manifest.PieceCount())
+	}
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"crypto/sha1"
+	"strings"
+
+	"github.com/IncSW/go-bencode"
+)
+
+// InfoDict builds the info dictionary of the manifest
+func (manifest *Manifest) InfoDict() map[string]interface{} {
+	pieces := make([]byte, 0, len(manifest.PieceHashes)*20)
+	for _, hash := range manifest.PieceHashes {
+		pieces = append(pieces, hash[:]...)
+	}
+
+	info := map[string]interface{}{
+		"name":         manifest.Name,
+		"piece length": manifest.PieceLength,
+		"pieces":       pieces,
+	}
+
+	if manifest.Private {
+		info["private"] = int64(1)
+	}
+
+	if !manifest.MultiFile {
+		info["length"] = manifest.Length
+		return info
+	}
+
+	files := []interface{}{}
+	for i := range manifest.FileInfos {
+		file := &manifest.FileInfos[i]
+		// Paths start with the torrent name
+		parts := strings.Split(file.Path, "/")[1:]
+		filePath := make([]interface{}, len(parts))
+		for j, part := range parts {
+			filePath[j] = part
+		}
+		files = append(files, map[string]interface{}{
+			"length": file.Length,
+			"path":   filePath,
+		})
+	}
+	info["files"] = files
+	return info
+}
+
+// EncodeInfo returns the bencoded info dictionary and its hash
+func (manifest *Manifest) EncodeInfo() ([]byte, [20]byte, error) {
+	infoBytes, err := bencode.Marshal(manifest.InfoDict())
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	return infoBytes, sha1.Sum(infoBytes), nil
+}
+
+// EncodeManifestFile returns the content of the .torrent file of the manifest
+func EncodeManifestFile(manifest *Manifest) ([]byte, error) {
+	data := map[string]interface{}{
+		"info": manifest.InfoDict(),
+	}
+
+	if manifest.Announce != "" {
+		data["announce"] = manifest.Announce
+	}
+
+	if len(manifest.AnnounceList) > 0 {
+		tiers := []interface{}{}
+		for _, announce := range manifest.AnnounceList {
+			tiers = append(tiers, []interface{}{announce})
+		}
+		data["announce-list"] = tiers
+	}
+
+	if manifest.Comment != "" {
+		data["comment"] = manifest.Comment
+	}
+
+	if manifest.CreatedBy != "" {
+		data["created by"] = manifest.CreatedBy
+	}
+
+	if manifest.CreationDate != 0 {
+		data["creation date"] = manifest.CreationDate
+	}
+
+	if len(manifest.UrlList) == 1 {
+		data["url-list"] = manifest.UrlList[0]
+	} else if len(manifest.UrlList) > 1 {
+		urls := []interface{}{}
+		for _, url := range manifest.UrlList {
+			urls = append(urls, url)
+		}
+		data["url-list"] = urls
+	}
+
+	return bencode.Marshal(data)
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+func manifestError(context string, format string, args ...interface{}) error {
+	if context != "" {
+		format = context + ": " + format
+	}
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidManifest}, args...)...)
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case int64:
+		return "an integer"
+	case []byte:
+		return "a string"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a dictionary"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func getValue(dict map[string]interface{}, key string, context string, required bool) (interface{}, error) {
+	value, ok := dict[key]
+	if !ok && required {
+		return nil, manifestError(context, "missing key '%v'", key)
+	}
+	return value, nil
+}
+
+func getString(dict map[string]interface{}, key string, context string, required bool) (string, error) {
+	value, err := getBytes(dict, key, context, required)
+	return string(value), err
+}
+
+func getBytes(dict map[string]interface{}, key string, context string, required bool) ([]byte, error) {
+	value, err := getValue(dict, key, context, required)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return nil, manifestError(context, "'%v' expected a string but got %v", key, typeName(value))
+	}
+	return bytes, nil
+}
+
+func getInt(dict map[string]interface{}, key string, context string, required bool) (int64, bool, error) {
+	value, err := getValue(dict, key, context, required)
+	if err != nil || value == nil {
+		return 0, false, err
+	}
+	number, ok := value.(int64)
+	if !ok {
+		return 0, false, manifestError(context, "'%v' expected an integer but got %v", key, typeName(value))
+	}
+	return number, true, nil
+}
+
+func getList(dict map[string]interface{}, key string, context string, required bool) ([]interface{}, error) {
+	value, err := getValue(dict, key, context, required)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, manifestError(context, "'%v' expected a list but got %v", key, typeName(value))
+	}
+	return list, nil
+}
+
+func getDict(dict map[string]interface{}, key string, context string, required bool) (map[string]interface{}, error) {
+	value, err := getValue(dict, key, context, required)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	child, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, manifestError(context, "'%v' expected a dictionary but got %v", key, typeName(value))
+	}
+	return child, nil
+}
+
+// getAnnounceList flattens the tiers of the announce list
+func getAnnounceList(dict map[string]interface{}) ([]string, error) {
+	tiers, err := getList(dict, "announce-list", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	announceList := []string{}
+	for i, tier := range tiers {
+		urls, ok := tier.([]interface{})
+		if !ok {
+			return nil, manifestError("", "announce-list[%v] expected a list but got %v", i, typeName(tier))
+		}
+		for j, url := range urls {
+			url, ok := url.([]byte)
+			if !ok {
+				return nil, manifestError("", "announce-list[%v][%v] expected a string but got %v", i, j, typeName(urls[j]))
+			}
+			announceList = append(announceList, string(url))
+		}
+	}
+	return announceList, nil
+}
+
+// checkPathPart rejects path components that could escape the download
+// directory once joined
+func checkPathPart(part string, context string) error {
+	if part == "" {
+		return manifestError(context, "empty path component")
+	}
+	if part == "." || part == ".." {
+		return manifestError(context, "path traversal with '%v'", part)
+	}
+	if strings.ContainsAny(part, "/\\\x00") {
+		return manifestError(context, "path component '%v' contains a separator", part)
+	}
+	return nil
+}
+
+// getUrlList reads the web seeds of BEP 19, a single url or a list of them
+func getUrlList(dict map[string]interface{}) ([]string, error) {
+	value, err := getValue(dict, "url-list", "", false)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	switch value := value.(type) {
+	case []byte:
+		if len(value) == 0 {
+			return nil, nil
+		}
+		return []string{string(value)}, nil
+	case []interface{}:
+		urlList := []string{}
+		for i, url := range value {
+			url, ok := url.([]byte)
+			if !ok {
+				return nil, manifestError("", "url-list[%v] expected a string but got %v", i, typeName(value[i]))
+			}
+			if len(url) > 0 {
+				urlList = append(urlList, string(url))
+			}
+		}
+		return urlList, nil
+	default:
+		return nil, manifestError("", "'url-list' expected a string or a list but got %v", typeName(value))
+	}
+}
@@ -0,0 +1,283 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// v2File is a file of a BitTorrent v2 file tree
+type v2File struct {
+	parts      []string
+	length     int64
+	piecesRoot [32]byte
+}
+
+// decodeFileTree walks the BitTorrent v2 file tree in key order, which is also
+// the order of the files in the torrent's byte space
+func decodeFileTree(node map[string]interface{}, parts []string, context string, files *[]v2File) error {
+	keys := make([]string, 0, len(node))
+	for key := range node {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		child, ok := node[key].(map[string]interface{})
+		if !ok {
+			return manifestError(context, "'%v' expected a dictionary but got %v", key, typeName(node[key]))
+		}
+
+		if key == "" {
+			if len(parts) == 0 {
+				return manifestError(context, "file without a name")
+			}
+			length, _, err := getInt(child, "length", context, true)
+			if err != nil {
+				return err
+			}
+			if length < 0 {
+				return manifestError(context, "invalid length %v", length)
+			}
+
+			file := v2File{parts: parts, length: length}
+			if length > 0 {
+				root, err := getBytes(child, "pieces root", context, true)
+				if err != nil {
+					return err
+				}
+				if len(root) != 32 {
+					return manifestError(context, "pieces root is %v bytes instead of 32", len(root))
+				}
+				copy(file.piecesRoot[:], root)
+			}
+			*files = append(*files, file)
+			continue
+		}
+
+		childContext := context + "/" + key
+		if err := checkPathPart(key, childContext); err != nil {
+			return err
+		}
+		childParts := append(append([]string{}, parts...), key)
+		if err := decodeFileTree(child, childParts, childContext, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeV2 parses the file tree and the piece layers of a v2 or hybrid
+// torrent. Hybrid torrents keep the v1 files, which must match the file tree,
+// while v2 only torrents get padding files aligning every file to a piece
+// boundary like hybrid torrents have.
+func decodeV2(manifest *Manifest, data map[string]interface{}, info map[string]interface{}) error {
+	if manifest.PieceLength < MerkleBlockSize || manifest.PieceLength&(manifest.PieceLength-1) != 0 {
+		return manifestError("info", "piece length %v is not a power of two of at least 16 KiB", manifest.PieceLength)
+	}
+
+	tree, err := getDict(info, "file tree", "info", true)
+	if err != nil {
+		return err
+	}
+
+	files := []v2File{}
+	if err := decodeFileTree(tree, nil, "info.file tree", &files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return manifestError("info", "file tree is empty")
+	}
+
+	layers, err := getDict(data, "piece layers", "", false)
+	if err != nil {
+		return err
+	}
+
+	manifest.PieceLayers = map[[32]byte][]byte{}
+	blocksPerPiece := int(manifest.PieceLength / MerkleBlockSize)
+	pad := PadHash(blocksPerPiece)
+
+	for _, file := range files {
+		if file.length <= manifest.PieceLength {
+			continue
+		}
+		context := "piece layers"
+		layer, err := getBytes(layers, string(file.piecesRoot[:]), context, true)
+		if err != nil {
+			return manifestError(context, "missing layer of %v", path.Join(file.parts...))
+		}
+
+		pieces := int((file.length + manifest.PieceLength - 1) / manifest.PieceLength)
+		if len(layer) != pieces*32 {
+			return manifestError(context, "layer of %v has %v bytes instead of %v", path.Join(file.parts...), len(layer), pieces*32)
+		}
+		if MerkleRoot(SplitHashes(layer), NextPowerOfTwo(pieces), pad) != file.piecesRoot {
+			return manifestError(context, "layer of %v doesn't match its pieces root", path.Join(file.parts...))
+		}
+		manifest.PieceLayers[file.piecesRoot] = layer
+	}
+
+	if manifest.FileInfos != nil {
+		return matchV1Files(manifest, files)
+	}
+
+	// A single file named like the torrent is stored like a v1 single file torrent
+	manifest.MultiFile = len(files) > 1 || len(files[0].parts) > 1 || files[0].parts[0] != manifest.Name
+
+	var offset int64
+	for i, file := range files {
+		parts := append([]string{manifest.Name}, file.parts...)
+		if !manifest.MultiFile {
+			parts = []string{manifest.Name, manifest.Name}
+		}
+
+		manifest.FileInfos = append(manifest.FileInfos, FileInfo{
+			Path:       path.Join(parts...),
+			Name:       parts[len(parts)-1],
+			Length:     file.length,
+			Offset:     offset,
+			Priority:   PriorityNormal,
+			PiecesRoot: file.piecesRoot,
+		})
+		offset += file.length
+
+		if remainder := offset % manifest.PieceLength; remainder != 0 && i != len(files)-1 {
+			padding := manifest.PieceLength - remainder
+			manifest.FileInfos = append(manifest.FileInfos, FileInfo{
+				Path:     path.Join(manifest.Name, ".pad", fmt.Sprint(padding)),
+				Name:     fmt.Sprint(padding),
+				Length:   padding,
+				Offset:   offset,
+				Priority: PrioritySkip,
+				Padding:  true,
+			})
+			offset += padding
+		}
+	}
+	manifest.Length = offset
+	return nil
+}
+
+// matchV1Files checks that the v1 files of a hybrid torrent describe the same
+// files as the v2 file tree and copies their pieces roots
+func matchV1Files(manifest *Manifest, files []v2File) error {
+	next := 0
+	for i := range manifest.FileInfos {
+		fileInfo := &manifest.FileInfos[i]
+		if fileInfo.Padding {
+			continue
+		}
+		if next == len(files) {
+			return manifestError("info", "hybrid torrent has more v1 files than v2 files")
+		}
+
+		file := files[next]
+		next++
+
+		v1Path := strings.TrimPrefix(fileInfo.Path, manifest.Name+"/")
+		v2Path := path.Join(file.parts...)
+		if v1Path != v2Path || fileInfo.Length != file.length {
+			return manifestError("info", "hybrid torrent v1 file %v (%v bytes) doesn't match v2 file %v (%v bytes)", v1Path, fileInfo.Length, v2Path, file.length)
+		}
+		if file.length > 0 && fileInfo.Offset%manifest.PieceLength != 0 {
+			return manifestError("info", "hybrid torrent file %v is not aligned to a piece", v1Path)
+		}
+		fileInfo.PiecesRoot = file.piecesRoot
+	}
+	if next != len(files) {
+		return manifestError("info", "hybrid torrent has more v2 files than v1 files")
+	}
+	return nil
+}
+
+// PieceCount returns the number of pieces, v2 only torrents have no v1
+// piece hashes to count
+func (manifest *Manifest) PieceCount() int {
+	if len(manifest.PieceHashes) > 0 {
+		return len(manifest.PieceHashes)
+	}
+	return int((manifest.Length + manifest.PieceLength - 1) / manifest.PieceLength)
+}
+
+// IsV2 is true for v2 only and hybrid torrents
+func (manifest *Manifest) IsV2() bool {
+	return manifest.MetaVersion == 2
+}
+
+// IsHybrid is true for torrents usable by both v1 and v2 clients
+func (manifest *Manifest) IsHybrid() bool {
+	return manifest.IsV2() && len(manifest.PieceHashes) > 0
+}
+
+// TruncatedInfoHashV2 is the v2 info hash as used in handshakes and
+// tracker announces
+func (manifest *Manifest) TruncatedInfoHashV2() [20]byte {
+	var truncated [20]byte
+	copy(truncated[:], manifest.InfoHashV2[:20])
+	return truncated
+}
+
+// InfoHashes returns every info hash the torrent is known by, the v1 and the
+// truncated v2 one for hybrid torrents
+func (manifest *Manifest) InfoHashes() [][20]byte {
+	if manifest.IsHybrid() {
+		return [][20]byte{manifest.InfoHash, manifest.TruncatedInfoHashV2()}
+	}
+	return [][20]byte{manifest.InfoHash}
+}
+
+// HasInfoHash reports whether a handshake info hash belongs to the torrent
+func (manifest *Manifest) HasInfoHash(infoHash [20]byte) bool {
+	for _, hash := range manifest.InfoHashes() {
+		if bytes.Equal(hash[:], infoHash[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// PieceFile returns the index of the non padding file the piece starts in
+func (manifest *Manifest) PieceFile(index int) int {
+	pieceStart := int64(index) * manifest.PieceLength
+	for i := range manifest.FileInfos {
+		file := &manifest.FileInfos[i]
+		if !file.Padding && file.Length > 0 && file.Offset <= pieceStart && pieceStart < file.Offset+file.Length {
+			return i
+		}
+	}
+	return -1
+}
+
+// CheckPieceV2 verifies a piece against the merkle tree of the file it
+// belongs to
+func (manifest *Manifest) CheckPieceV2(index int, piece []byte) bool {
+	fileIndex := manifest.PieceFile(index)
+	if fileIndex == -1 {
+		return false
+	}
+	file := &manifest.FileInfos[fileIndex]
+
+	pieceStart := int64(index) * manifest.PieceLength
+	// The end of the piece may be padding
+	if dataEnd := file.Offset + file.Length - pieceStart; int64(len(piece)) > dataEnd {
+		piece = piece[:dataEnd]
+	}
+
+	blocks := BlockHashes(piece)
+	if file.Length <= manifest.PieceLength {
+		return MerkleRoot(blocks, NextPowerOfTwo(len(blocks)), [32]byte{}) == file.PiecesRoot
+	}
+
+	layer, ok := manifest.PieceLayers[file.PiecesRoot]
+	pieceInFile := int((pieceStart - file.Offset) / manifest.PieceLength)
+	if !ok || (pieceInFile+1)*32 > len(layer) {
+		return false
+	}
+
+	var expected [32]byte
+	copy(expected[:], layer[pieceInFile*32:])
+	return MerkleRoot(blocks, int(manifest.PieceLength/MerkleBlockSize), [32]byte{}) == expected
+}
@@ -0,0 +1,394 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/IncSW/go-bencode"
+)
+
+const v2PieceLength = 32768
+
+// merkleFile returns the pieces root and the piece layer of a file, the
+// layer is only kept for files longer than a piece
+func merkleFile(data []byte, pieceLength int) ([32]byte, []byte) {
+	blocks := BlockHashes(data)
+	if len(data) <= pieceLength {
+		return MerkleRoot(blocks, NextPowerOfTwo(len(blocks)), [32]byte{}), nil
+	}
+
+	blocksPerPiece := pieceLength / MerkleBlockSize
+	pieces := [][32]byte{}
+	layer := []byte{}
+	for start := 0; start < len(blocks); start += blocksPerPiece {
+		end := start + blocksPerPiece
+		if end > len(blocks) {
+			end = len(blocks)
+		}
+		piece := MerkleRoot(blocks[start:end], blocksPerPiece, [32]byte{})
+		pieces = append(pieces, piece)
+		layer = append(layer, piece[:]...)
+	}
+	return MerkleRoot(pieces, NextPowerOfTwo(len(pieces)), PadHash(blocksPerPiece)), layer
+}
+
+// v2TestFile is a file of the v2 test torrent
+type v2TestFile struct {
+	path   []string
+	data   []byte
+	root   [32]byte
+	layer  []byte
+	offset int64
+}
+
+// v2TestFiles returns the files of the v2 test torrent in file tree order,
+// with their offsets once every file is aligned to a piece: big spans three
+// pieces, the last one short, dir/small is smaller than a block and exact is
+// one full piece
+func v2TestFiles() []*v2TestFile {
+	files := []*v2TestFile{
+		{path: []string{"big"}, data: make([]byte, 2*v2PieceLength+14464), offset: 0},
+		{path: []string{"dir", "small"}, data: make([]byte, 1000), offset: 3 * v2PieceLength},
+		{path: []string{"exact"}, data: make([]byte, v2PieceLength), offset: 4 * v2PieceLength},
+	}
+	for _, file := range files {
+		rand.Read(file.data)
+		file.root, file.layer = merkleFile(file.data, v2PieceLength)
+	}
+	return files
+}
+
+// v2Torrent encodes a v2 only torrent of the files, edit changes its
+// dictionaries before they are encoded
+func v2Torrent(t *testing.T, files []*v2TestFile, edit func(torrent map[string]interface{}, info map[string]interface{}, tree map[string]interface{}, layers map[string]interface{})) []byte {
+	tree := map[string]interface{}{}
+	layers := map[string]interface{}{}
+	for _, file := range files {
+		node := tree
+		for _, part := range file.path {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			node = child
+		}
+		node[""] = map[string]interface{}{
+			"length":      int64(len(file.data)),
+			"pieces root": string(file.root[:]),
+		}
+		if file.layer != nil {
+			layers[string(file.root[:])] = string(file.layer)
+		}
+	}
+
+	info := map[string]interface{}{
+		"name":         "v2",
+		"piece length": int64(v2PieceLength),
+		"meta version": int64(2),
+		"file tree":    tree,
+	}
+	torrent := map[string]interface{}{
+		"announce":     "http://tracker/announce",
+		"info":         info,
+		"piece layers": layers,
+	}
+	if edit != nil {
+		edit(torrent, info, tree, layers)
+	}
+	content, err := bencode.Marshal(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// v1Pieces returns the v1 piece hashes of the files laid out with padding
+func v1Pieces(files []*v2TestFile) string {
+	last := files[len(files)-1]
+	data := make([]byte, last.offset+int64(len(last.data)))
+	for _, file := range files {
+		copy(data[file.offset:], file.data)
+	}
+	pieces := []byte{}
+	for start := 0; start < len(data); start += v2PieceLength {
+		end := start + v2PieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[start:end])
+		pieces = append(pieces, hash[:]...)
+	}
+	return string(pieces)
+}
+
+// hybrid adds the v1 files and pieces of the files, with padding files, to
+// a v2 torrent
+func hybrid(info map[string]interface{}, files []*v2TestFile) {
+	v1Files := []interface{}{}
+	var offset int64
+	for _, file := range files {
+		if padding := file.offset - offset; padding > 0 {
+			v1Files = append(v1Files, map[string]interface{}{
+				"length": padding,
+				"path":   []interface{}{".pad", "x"},
+				"attr":   "p",
+			})
+		}
+		path := []interface{}{}
+		for _, part := range file.path {
+			path = append(path, part)
+		}
+		v1Files = append(v1Files, map[string]interface{}{"length": int64(len(file.data)), "path": path})
+		offset = file.offset + int64(len(file.data))
+	}
+	info["files"] = v1Files
+	info["pieces"] = v1Pieces(files)
+}
+
+func TestDecodeV2Validation(t *testing.T) {
+	files := v2TestFiles()
+	big := string(files[0].root[:])
+
+	tests := []struct {
+		name  string
+		edit  func(torrent, info, tree, layers map[string]interface{})
+		error string
+	}{
+		{"piece length not a power of two", func(torrent, info, tree, layers map[string]interface{}) {
+			info["piece length"] = int64(3 * MerkleBlockSize)
+		}, "info: piece length 49152 is not a power of two of at least 16 KiB"},
+		{"piece length below a block", func(torrent, info, tree, layers map[string]interface{}) {
+			info["piece length"] = int64(8192)
+		}, "info: piece length 8192 is not a power of two"},
+		{"missing file tree", func(torrent, info, tree, layers map[string]interface{}) { delete(info, "file tree") }, "info: missing key 'file tree'"},
+		{"file tree not a dictionary", func(torrent, info, tree, layers map[string]interface{}) { info["file tree"] = "x" }, "info: 'file tree' expected a dictionary but got a string"},
+		{"empty file tree", func(torrent, info, tree, layers map[string]interface{}) {
+			info["file tree"] = map[string]interface{}{}
+		}, "info: file tree is empty"},
+		{"node not a dictionary", func(torrent, info, tree, layers map[string]interface{}) { tree["x"] = int64(1) }, "info.file tree: 'x' expected a dictionary but got an integer"},
+		{"file without a name", func(torrent, info, tree, layers map[string]interface{}) {
+			tree[""] = map[string]interface{}{"length": int64(0)}
+		}, "info.file tree: file without a name"},
+		{"missing length", func(torrent, info, tree, layers map[string]interface{}) {
+			tree["x"] = map[string]interface{}{"": map[string]interface{}{}}
+		}, "info.file tree/x: missing key 'length'"},
+		{"negative length", func(torrent, info, tree, layers map[string]interface{}) {
+			tree["x"] = map[string]interface{}{"": map[string]interface{}{"length": int64(-1)}}
+		}, "info.file tree/x: invalid length -1"},
+		{"missing pieces root", func(torrent, info, tree, layers map[string]interface{}) {
+			tree["x"] = map[string]interface{}{"": map[string]interface{}{"length": int64(1)}}
+		}, "info.file tree/x: missing key 'pieces root'"},
+		{"short pieces root", func(torrent, info, tree, layers map[string]interface{}) {
+			tree["x"] = map[string]interface{}{"": map[string]interface{}{"length": int64(1), "pieces root": "short"}}
+		}, "info.file tree/x: pieces root is 5 bytes instead of 32"},
+		{"path traversal", func(torrent, info, tree, layers map[string]interface{}) {
+			tree[".."] = map[string]interface{}{"x": tree["big"]}
+		}, "info.file tree/..: path traversal with '..'"},
+		{"separator in a name", func(torrent, info, tree, layers map[string]interface{}) {
+			tree["a/b"] = tree["big"]
+		}, "info.file tree/a/b: path component 'a/b' contains a separator"},
+		{"piece layers not a dictionary", func(torrent, info, tree, layers map[string]interface{}) {
+			torrent["piece layers"] = "x"
+		}, "'piece layers' expected a dictionary but got a string"},
+		{"missing layer", func(torrent, info, tree, layers map[string]interface{}) { delete(layers, big) }, "piece layers: missing layer of big"},
+		{"layer too short", func(torrent, info, tree, layers map[string]interface{}) {
+			layers[big] = string(files[0].layer[:64])
+		}, "piece layers: layer of big has 64 bytes instead of 96"},
+		{"layer of another file", func(torrent, info, tree, layers map[string]interface{}) {
+			layer := append([]byte{}, files[0].layer...)
+			layer[0] ^= 1
+			layers[big] = string(layer)
+		}, "piece layers: layer of big doesn't match its pieces root"},
+	}
+
+	for _, test := range tests {
+		_, err := DecodeManifestFile(v2Torrent(t, files, test.edit))
+		if err == nil {
+			t.Errorf("%v: accepted", test.name)
+			continue
+		}
+		if !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("%v: error %v isn't an ErrInvalidManifest", test.name, err)
+		}
+		if !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%v: got %q, want %q", test.name, err, test.error)
+		}
+	}
+}
+
+func TestDecodeV2(t *testing.T) {
+	files := v2TestFiles()
+	manifest, err := DecodeManifestFile(v2Torrent(t, files, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !manifest.IsV2() || manifest.IsHybrid() || !manifest.MultiFile {
+		t.Errorf("v2 %v, hybrid %v, multi file %v", manifest.IsV2(), manifest.IsHybrid(), manifest.MultiFile)
+	}
+	if manifest.InfoHash != manifest.TruncatedInfoHashV2() {
+		t.Error("v2 only torrent isn't known by its v2 info hash")
+	}
+
+	// Padding aligns every file but the last to a piece
+	want := []struct {
+		path    string
+		offset  int64
+		length  int64
+		padding bool
+	}{
+		{"v2/big", 0, 2*v2PieceLength + 14464, false},
+		{"v2/.pad/18304", 2*v2PieceLength + 14464, 18304, true},
+		{"v2/dir/small", 3 * v2PieceLength, 1000, false},
+		{"v2/.pad/31768", 3*v2PieceLength + 1000, 31768, true},
+		{"v2/exact", 4 * v2PieceLength, v2PieceLength, false},
+	}
+	if len(manifest.FileInfos) != len(want) {
+		t.Fatalf("got files %+v", manifest.FileInfos)
+	}
+	for i, file := range want {
+		got := manifest.FileInfos[i]
+		if got.Path != file.path || got.Offset != file.offset || got.Length != file.length || got.Padding != file.padding {
+			t.Errorf("file %v is %+v", i, got)
+		}
+	}
+	if manifest.Length != 5*v2PieceLength || manifest.PieceCount() != 5 {
+		t.Errorf("%v bytes in %v pieces", manifest.Length, manifest.PieceCount())
+	}
+	if len(manifest.PieceLayers) != 1 || !bytes.Equal(manifest.PieceLayers[files[0].root], files[0].layer) {
+		t.Errorf("piece layers %v", manifest.PieceLayers)
+	}
+
+	// A single file named like the torrent is stored like a v1 single file
+	single, err := DecodeManifestFile(v2Torrent(t, files[2:], func(torrent, info, tree, layers map[string]interface{}) {
+		info["name"] = "exact"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single.MultiFile || len(single.FileInfos) != 1 || single.FileInfos[0].Path != "exact/exact" {
+		t.Errorf("single file torrent has files %+v", single.FileInfos)
+	}
+}
+
+func TestCheckPieceV2(t *testing.T) {
+	files := v2TestFiles()
+	manifest, err := DecodeManifestFile(v2Torrent(t, files, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	big, small, exact := files[0].data, files[1].data, files[2].data
+	// Pieces are read from storage with the padding after the data
+	padded := func(data []byte) []byte {
+		return append(append([]byte{}, data...), make([]byte, v2PieceLength-len(data))...)
+	}
+	corrupt := func(data []byte) []byte {
+		data = append([]byte{}, data...)
+		data[len(data)/2] ^= 1
+		return data
+	}
+
+	tests := []struct {
+		name  string
+		index int
+		piece []byte
+		valid bool
+	}{
+		{"full piece", 0, big[:v2PieceLength], true},
+		{"second piece", 1, big[v2PieceLength : 2*v2PieceLength], true},
+		{"short last piece", 2, big[2*v2PieceLength:], true},
+		{"short last piece with padding", 2, padded(big[2*v2PieceLength:]), true},
+		{"file smaller than a piece", 3, small, true},
+		{"file smaller than a piece with padding", 3, padded(small), true},
+		{"file of one piece", 4, exact, true},
+		{"corrupt full piece", 0, corrupt(big[:v2PieceLength]), false},
+		{"corrupt last piece", 2, corrupt(big[2*v2PieceLength:]), false},
+		{"corrupt small file", 3, corrupt(small), false},
+		{"corrupt file of one piece", 4, corrupt(exact), false},
+		{"piece of another file", 1, big[:v2PieceLength], false},
+		{"short piece", 0, big[:v2PieceLength-1], false},
+		{"past the end", 5, exact, false},
+	}
+	for _, test := range tests {
+		if got := manifest.CheckPieceV2(test.index, test.piece); got != test.valid {
+			t.Errorf("%v: valid %v, want %v", test.name, got, test.valid)
+		}
+	}
+}
+
+func TestDecodeHybrid(t *testing.T) {
+	files := v2TestFiles()
+	manifest, err := DecodeManifestFile(v2Torrent(t, files, func(torrent, info, tree, layers map[string]interface{}) {
+		hybrid(info, files)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.IsHybrid() || len(manifest.InfoHashes()) != 2 || manifest.InfoHash == manifest.TruncatedInfoHashV2() {
+		t.Errorf("hybrid %v with info hashes %x", manifest.IsHybrid(), manifest.InfoHashes())
+	}
+	roots := 0
+	for _, fileInfo := range manifest.FileInfos {
+		if fileInfo.Padding {
+			continue
+		}
+		if fileInfo.PiecesRoot != files[roots].root {
+			t.Errorf("%v has the pieces root of another file", fileInfo.Path)
+		}
+		roots++
+	}
+	if roots != len(files) {
+		t.Errorf("%v files with a pieces root", roots)
+	}
+
+	tests := []struct {
+		name  string
+		edit  func(v1Files []interface{}) []interface{}
+		error string
+	}{
+		{"more v1 files", func(v1Files []interface{}) []interface{} {
+			return append(v1Files, map[string]interface{}{"length": int64(1), "path": []interface{}{"extra"}})
+		}, "hybrid torrent has more v1 files than v2 files"},
+		{"more v2 files", func(v1Files []interface{}) []interface{} {
+			return v1Files[:3]
+		}, "hybrid torrent has more v2 files than v1 files"},
+		{"other path", func(v1Files []interface{}) []interface{} {
+			v1Files[2].(map[string]interface{})["path"] = []interface{}{"dir", "other"}
+			return v1Files
+		}, "hybrid torrent v1 file dir/other (1000 bytes) doesn't match v2 file dir/small (1000 bytes)"},
+		{"other length", func(v1Files []interface{}) []interface{} {
+			v1Files[2].(map[string]interface{})["length"] = int64(999)
+			v1Files[3].(map[string]interface{})["length"] = int64(31769)
+			return v1Files
+		}, "hybrid torrent v1 file dir/small (999 bytes) doesn't match v2 file dir/small (1000 bytes)"},
+		{"file not aligned", func(v1Files []interface{}) []interface{} {
+			v1Files[1].(map[string]interface{})["length"] = int64(18303)
+			v1Files[3].(map[string]interface{})["length"] = int64(31769)
+			return v1Files
+		}, "hybrid torrent file dir/small is not aligned to a piece"},
+	}
+	for _, test := range tests {
+		_, err := DecodeManifestFile(v2Torrent(t, files, func(torrent, info, tree, layers map[string]interface{}) {
+			hybrid(info, files)
+			info["files"] = test.edit(info["files"].([]interface{}))
+			// Keep the piece count right, only the file matching is tested
+			var length int64
+			for _, file := range info["files"].([]interface{}) {
+				length += file.(map[string]interface{})["length"].(int64)
+			}
+			info["pieces"] = strings.Repeat("x", int(20*((length+v2PieceLength-1)/v2PieceLength)))
+		}))
+		if err == nil {
+			t.Errorf("%v: accepted", test.name)
+			continue
+		}
+		if !errors.Is(err, ErrInvalidManifest) || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%v: got %q, want %q", test.name, err, test.error)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package models
+
+import "crypto/sha256"
+
+// MerkleBlockSize is the size of the leaves of BitTorrent v2 merkle trees
+const MerkleBlockSize = 16384
+
+// BlockHashes returns the SHA-256 of every 16 KiB block of the data, the last
+// block may be shorter
+func BlockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+MerkleBlockSize-1)/MerkleBlockSize)
+	for start := 0; start < len(data); start += MerkleBlockSize {
+		end := start + MerkleBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha256.Sum256(data[start:end]))
+	}
+	return hashes
+}
+
+func hashPair(left [32]byte, right [32]byte) [32]byte {
+	var pair [64]byte
+	copy(pair[:32], left[:])
+	copy(pair[32:], right[:])
+	return sha256.Sum256(pair[:])
+}
+
+// NextPowerOfTwo returns the smallest power of two not below n
+func NextPowerOfTwo(n int) int {
+	power := 1
+	for power < n {
+		power *= 2
+	}
+	return power
+}
+
+// MerkleLayers builds every layer of a merkle tree of the given width, from
+// the leaves up to the root. Missing leaves are set to the pad hash.
+func MerkleLayers(leaves [][32]byte, width int, pad [32]byte) [][][32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, leaves)
+	for i := len(leaves); i < width; i++ {
+		layer[i] = pad
+	}
+
+	layers := [][][32]byte{layer}
+	for len(layer) > 1 {
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layers = append(layers, next)
+		layer = next
+	}
+	return layers
+}
+
+// MerkleRoot returns the root of a merkle tree of the given width
+func MerkleRoot(leaves [][32]byte, width int, pad [32]byte) [32]byte {
+	layers := MerkleLayers(leaves, width, pad)
+	return layers[len(layers)-1][0]
+}
+
+// PadHash returns the root of a subtree made of zero leaves, used to pad
+// layers above the leaves
+func PadHash(leafCount int) [32]byte {
+	return MerkleRoot(nil, NextPowerOfTwo(leafCount), [32]byte{})
+}
+
+// SplitHashes splits concatenated 32 byte hashes
+func SplitHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, len(data)/32)
+	for i := range hashes {
+		copy(hashes[i][:], data[i*32:])
+	}
+	return hashes
+}
@@ -1,6 +1,14 @@
 package models
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxMessageLength bounds the messages read from peers, above the largest
+// piece block and the bitfield of a torrent of millions of pieces
+const MaxMessageLength = 1 << 20
 
 type MessageType byte
 
@@ -15,6 +23,10 @@ const (
 	MsgTypePiece         MessageType = 7
 	MsgTypeCancel        MessageType = 8
 	MsgTypeKeepAlive     MessageType = 9
+	MsgTypeExtended      MessageType = 20
+	MsgTypeHashRequest   MessageType = 21
+	MsgTypeHashes        MessageType = 22
+	MsgTypeHashReject    MessageType = 23
 )
 
 type Message struct {
@@ -57,7 +69,41 @@ func (mType MessageType) String() string {
 		return "Piece"
 	case MsgTypeCancel:
 		return "Cancel"
+	case MsgTypeExtended:
+		return "Extended"
+	case MsgTypeHashRequest:
+		return "HashRequest"
+	case MsgTypeHashes:
+		return "Hashes"
+	case MsgTypeHashReject:
+		return "HashReject"
 	default:
 		return "Unknown"
 	}
 }
+
+// ReadMessage reads a length prefixed message, nil for keep-alives
+func ReadMessage(reader io.Reader) (*Message, error) {
+	var lengthBytes [4]byte
+	_, err := io.ReadFull(reader, lengthBytes[:])
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBytes[:])
+	if length == 0 {
+		return nil, nil
+	}
+	// The length comes from the peer, check it before allocating
+	if length > MaxMessageLength {
+		return nil, fmt.Errorf("message of %v bytes is longer than %v bytes", length, MaxMessageLength)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{Type: MessageType(payload[0]), Payload: payload[1:]}, nil
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	data := []byte{0, 0, 0, 5, byte(MsgTypeHave), 0, 0, 0, 7, 0, 0, 0, 0}
+	reader := bytes.NewReader(data)
+
+	message, err := ReadMessage(reader)
+	if err != nil || message.Type != MsgTypeHave || !bytes.Equal(message.Payload, []byte{0, 0, 0, 7}) {
+		t.Fatalf("got %+v, %v", message, err)
+	}
+	message, err = ReadMessage(reader)
+	if err != nil || message != nil {
+		t.Errorf("keep-alive read as %+v, %v", message, err)
+	}
+	if _, err = ReadMessage(reader); err != io.EOF {
+		t.Errorf("end of stream, got %v", err)
+	}
+}
+
+func TestReadMessageTooLong(t *testing.T) {
+	for _, length := range []uint32{MaxMessageLength + 1, 1 << 31, 1<<32 - 1} {
+		header := binary.BigEndian.AppendUint32(nil, length)
+		// Only the length is sent, a reader allocating it first would
+		// fail on the missing payload instead
+		_, err := ReadMessage(bytes.NewReader(header))
+		if err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("length %v, got %v", length, err)
+		}
+	}
+
+	payload := make([]byte, MaxMessageLength)
+	payload[0] = byte(MsgTypePiece)
+	data := append(binary.BigEndian.AppendUint32(nil, MaxMessageLength), payload...)
+	message, err := ReadMessage(bytes.NewReader(data))
+	if err != nil || len(message.Payload) != MaxMessageLength-1 {
+		t.Errorf("message of the maximum length, got %v", err)
+	}
+}
@@ -1,17 +1,363 @@
 package models
 
 import (
+	"errors"
 	"net"
+	"sync"
+	"time"
 )
 
+const (
+	// Messages waiting to be written before Send blocks
+	outboundQueueLength = 256
+	// Messages read ahead of the worker
+	incomingQueueLength = 64
+	// Peers send keep-alives every two minutes, silence longer than this is a
+	// dead connection
+	readTimeout       = 3 * time.Minute
+	writeTimeout      = 30 * time.Second
+	keepAliveInterval = 90 * time.Second
+)
+
+var (
+	ErrPeerClosed     = errors.New("peer connection closed")
+	ErrReceiveTimeout = errors.New("timeout waiting for a message")
+	ErrSendQueueFull  = errors.New("peer isn't reading its messages")
+)
+
+// Peer is a connection to a peer. After Start its connection is only written
+// by its writer goroutine, which sends the messages queued with Send, and
+// only read by its read loop, which queues the messages for Receive. The
+// state of the peer is safe to use from any goroutine.
 type Peer struct {
-	Conn       net.Conn
-	Address    PeerAddress
-	Interested bool
-	// IsChoked is true if the peer is not allowed to send us data
-	IsChoked bool
-	// IsChoking is true if we are not allowed to send data to the peer
-	IsChoking bool
-	// BitField is a list of booleans that indicate whether the peer has the corresponding piece
-	BitField Bitfield
+	Conn    net.Conn
+	Address PeerAddress
+	PeerId  [20]byte
+	// SupportsExtensions is true if the peer's handshake advertised the
+	// extension protocol
+	SupportsExtensions bool
+
+	mutex sync.Mutex
+	// interested is true if the peer wants data from us
+	interested bool
+	// amInterested is true if we told the peer we want data from it
+	amInterested bool
+	// isChoked is true if the peer is not allowed to send us data
+	isChoked bool
+	// isChoking is true if we are not allowed to send data to the peer
+	isChoking bool
+	// uploadOnly is true if the peer doesn't download anything
+	uploadOnly bool
+	// amUploadOnly is what our last extended handshake told the peer
+	amUploadOnly          bool
+	sentExtendedHandshake bool
+	// bitField has a bit set for every piece the peer has
+	bitField Bitfield
+	err      error
+
+	outbound  chan outboundMessage
+	incoming  chan *Message
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// outboundMessage is a message waiting for the writer, written is closed
+// once it is written to the connection if set
+type outboundMessage struct {
+	data    []byte
+	written chan struct{}
+}
+
+// NewPeer wraps a connection, both sides start choked
+func NewPeer(conn net.Conn, address PeerAddress, pieceCount int) *Peer {
+	return &Peer{
+		Conn:      conn,
+		Address:   address,
+		isChoked:  true,
+		isChoking: true,
+		bitField:  make(Bitfield, (pieceCount+7)/8),
+		outbound:  make(chan outboundMessage, outboundQueueLength),
+		incoming:  make(chan *Message, incomingQueueLength),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Start runs the writer and the read loop, the handshake has to be done
+// before since it uses the connection directly
+func (peer *Peer) Start() {
+	go peer.writeLoop()
+	go peer.readLoop()
+}
+
+func (peer *Peer) writeLoop() {
+	keepAlive := time.NewTimer(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		var message outboundMessage
+		select {
+		case message = <-peer.outbound:
+		case <-keepAlive.C:
+			message.data = (*Message)(nil).ToBytes()
+		case <-peer.closed:
+			return
+		}
+
+		peer.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err := peer.Conn.Write(message.data)
+		if err != nil {
+			peer.fail(err)
+			return
+		}
+		if message.written != nil {
+			close(message.written)
+		}
+
+		if !keepAlive.Stop() {
+			select {
+			case <-keepAlive.C:
+			default:
+			}
+		}
+		keepAlive.Reset(keepAliveInterval)
+	}
+}
+
+func (peer *Peer) readLoop() {
+	for {
+		peer.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+		message, err := ReadMessage(peer.Conn)
+		if err != nil {
+			peer.fail(err)
+			return
+		}
+
+		select {
+		case peer.incoming <- message:
+		case <-peer.closed:
+			return
+		}
+	}
+}
+
+// Send queues a message for the writer, it blocks while the queue is full
+func (peer *Peer) Send(message Message) error {
+	_, err := peer.send(message, false)
+	return err
+}
+
+// SendWritten queues a message like Send, the returned channel is closed
+// once the writer wrote the message to the connection
+func (peer *Peer) SendWritten(message Message) (<-chan struct{}, error) {
+	return peer.send(message, true)
+}
+
+func (peer *Peer) send(message Message, notify bool) (chan struct{}, error) {
+	select {
+	case <-peer.closed:
+		return nil, peer.Err()
+	default:
+	}
+
+	queued := outboundMessage{data: message.ToBytes()}
+	if notify {
+		queued.written = make(chan struct{})
+	}
+	select {
+	case peer.outbound <- queued:
+		return queued.written, nil
+	case <-peer.closed:
+		return nil, peer.Err()
+	}
+}
+
+// TrySend queues a message for the writer like Send, but fails with
+// ErrSendQueueFull instead of waiting for room in the queue
+func (peer *Peer) TrySend(message Message) error {
+	select {
+	case <-peer.closed:
+		return peer.Err()
+	default:
+	}
+
+	select {
+	case peer.outbound <- outboundMessage{data: message.ToBytes()}:
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// Receive waits for the next message read from the peer, nil for keep-alives.
+// A zero timeout waits until the connection closes.
+func (peer *Peer) Receive(timeout time.Duration) (*Message, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case message := <-peer.incoming:
+		return message, nil
+	case <-peer.closed:
+		return nil, peer.Err()
+	case <-expired:
+		return nil, ErrReceiveTimeout
+	}
+}
+
+func (peer *Peer) fail(err error) {
+	peer.mutex.Lock()
+	if peer.err == nil {
+		peer.err = err
+	}
+	peer.mutex.Unlock()
+
+	peer.Close()
+}
+
+// Err returns why the connection closed
+func (peer *Peer) Err() error {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	if peer.err == nil {
+		return ErrPeerClosed
+	}
+	return peer.err
+}
+
+// Close closes the connection and stops the writer and the read loop
+func (peer *Peer) Close() {
+	peer.closeOnce.Do(func() {
+		close(peer.closed)
+		peer.Conn.Close()
+	})
+}
+
+// Done is closed once the connection is closed
+func (peer *Peer) Done() <-chan struct{} {
+	return peer.closed
+}
+
+func (peer *Peer) Interested() bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return peer.interested
+}
+
+func (peer *Peer) SetInterested(interested bool) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	peer.interested = interested
+}
+
+func (peer *Peer) AmInterested() bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return peer.amInterested
+}
+
+// SetAmInterested returns whether our interest changed
+func (peer *Peer) SetAmInterested(interested bool) bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	changed := peer.amInterested != interested
+	peer.amInterested = interested
+	return changed
+}
+
+func (peer *Peer) UploadOnly() bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return peer.uploadOnly
+}
+
+func (peer *Peer) SetUploadOnly(uploadOnly bool) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	peer.uploadOnly = uploadOnly
+}
+
+// SetAmUploadOnly returns whether the peer has to be sent an extended
+// handshake, because it has none yet or the upload only state changed
+func (peer *Peer) SetAmUploadOnly(uploadOnly bool) bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	changed := !peer.sentExtendedHandshake || peer.amUploadOnly != uploadOnly
+	peer.sentExtendedHandshake = true
+	peer.amUploadOnly = uploadOnly
+	return changed
+}
+
+func (peer *Peer) IsChoked() bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return peer.isChoked
+}
+
+// SetChoked returns whether the choke state changed
+func (peer *Peer) SetChoked(choked bool) bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	changed := peer.isChoked != choked
+	peer.isChoked = choked
+	return changed
+}
+
+func (peer *Peer) IsChoking() bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return peer.isChoking
+}
+
+func (peer *Peer) SetChoking(choking bool) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	peer.isChoking = choking
+}
+
+func (peer *Peer) HasPiece(index int) bool {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return index >= 0 && index/8 < len(peer.bitField) && peer.bitField.HasPiece(index)
+}
+
+// MarkPiece records a have message, indexes past the bitfield are ignored
+func (peer *Peer) MarkPiece(index int) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	if index >= 0 && index/8 < len(peer.bitField) {
+		peer.bitField.MarkPiece(index)
+	}
+}
+
+func (peer *Peer) SetBitField(bitField Bitfield) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	copy(peer.bitField, bitField)
+}
+
+// BitField returns a copy of the pieces the peer has
+func (peer *Peer) BitField() Bitfield {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	return append(Bitfield{}, peer.bitField...)
 }
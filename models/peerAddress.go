@@ -1,8 +1,53 @@
 package models
 
-import "net"
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
 
 type PeerAddress struct {
 	IP   net.IP
 	Port uint16
+	// InfoHash is the info hash of the swarm the peer was found in, zero
+	// means the torrent's main info hash
+	InfoHash [20]byte
+	Source   PeerSource
+}
+
+// String returns the address in host:port form, IPv6 addresses are put in
+// brackets so the result can be dialed
+func (address PeerAddress) String() string {
+	return net.JoinHostPort(address.IP.String(), strconv.Itoa(int(address.Port)))
+}
+
+// Compact returns the compact form of the address, 6 bytes for IPv4 and 18
+// bytes for IPv6 addresses
+func (address PeerAddress) Compact() []byte {
+	ip := address.IP.To4()
+	if ip == nil {
+		ip = address.IP.To16()
+	}
+	compact := append([]byte{}, ip...)
+	return binary.BigEndian.AppendUint16(compact, address.Port)
+}
+
+// ParseCompactPeers parses a list of compact peer addresses as used by
+// trackers, PEX and DHT, ipLength is 4 for IPv4 and 16 for IPv6 lists
+func ParseCompactPeers(data []byte, ipLength int, source PeerSource) ([]PeerAddress, error) {
+	entryLength := ipLength + 2
+	if len(data)%entryLength != 0 {
+		return nil, errors.New("invalid compact peers list")
+	}
+
+	peers := make([]PeerAddress, 0, len(data)/entryLength)
+	for i := 0; i < len(data); i += entryLength {
+		peers = append(peers, PeerAddress{
+			IP:     append(net.IP{}, data[i:i+ipLength]...),
+			Port:   binary.BigEndian.Uint16(data[i+ipLength : i+entryLength]),
+			Source: source,
+		})
+	}
+	return peers, nil
 }
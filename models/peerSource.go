@@ -0,0 +1,49 @@
+package models
+
+// PeerSource is where the address of a peer was learned from
+type PeerSource int
+
+const (
+	// SourceUnknown is the zero value, peers from it are never used for
+	// private torrents
+	SourceUnknown PeerSource = iota
+	SourceTracker
+	// Peers connecting to our listener
+	SourceIncoming
+	SourceDHT
+	SourcePEX
+	SourceLSD
+)
+
+func (source PeerSource) String() string {
+	switch source {
+	case SourceTracker:
+		return "tracker"
+	case SourceIncoming:
+		return "incoming"
+	case SourceDHT:
+		return "dht"
+	case SourcePEX:
+		return "pex"
+	case SourceLSD:
+		return "lsd"
+	default:
+		return "unknown"
+	}
+}
+
+// AllowsPeerSource reports whether peers from the source may be used. Private
+// torrents (BEP 27) only use peers handed out by their trackers, so the swarm
+// never leaks through DHT, PEX or local discovery. Peers of an unknown source
+// are refused too.
+func (manifest *Manifest) AllowsPeerSource(source PeerSource) bool {
+	if !manifest.Private {
+		return true
+	}
+	switch source {
+	case SourceTracker, SourceIncoming:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,40 @@
+package models
+
+import "testing"
+
+func TestAllowsPeerSource(t *testing.T) {
+	tests := []struct {
+		source  PeerSource
+		private bool
+		public  bool
+	}{
+		{SourceUnknown, false, true},
+		{SourceTracker, true, true},
+		{SourceIncoming, true, true},
+		{SourceDHT, false, true},
+		{SourcePEX, false, true},
+		{SourceLSD, false, true},
+		{PeerSource(100), false, true},
+	}
+	for _, test := range tests {
+		private := &Manifest{Private: true}
+		if got := private.AllowsPeerSource(test.source); got != test.private {
+			t.Errorf("private torrent allows %v peers: %v", test.source, got)
+		}
+		public := &Manifest{}
+		if got := public.AllowsPeerSource(test.source); got != test.public {
+			t.Errorf("public torrent allows %v peers: %v", test.source, got)
+		}
+	}
+}
+
+func TestPeerSourceZeroValue(t *testing.T) {
+	// Addresses built without a source must not pass for tracker peers
+	var address PeerAddress
+	if address.Source != SourceUnknown || address.Source.String() != "unknown" {
+		t.Errorf("zero source is %v", address.Source)
+	}
+	if (&Manifest{Private: true}).AllowsPeerSource(address.Source) {
+		t.Error("private torrent allows peers without a source")
+	}
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTrySendDoesntWait(t *testing.T) {
+	// Nothing reads the other end, so the writer blocks on its first write
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peer := NewPeer(local, PeerAddress{IP: net.IPv4(192, 0, 2, 1), Port: 6881}, 8)
+	peer.Start()
+	defer peer.Close()
+
+	// The writer holds one message and the queue the rest
+	sent := 0
+	for ; sent <= outboundQueueLength+1; sent++ {
+		if peer.TrySend(Message{Type: MsgTypeHave, Payload: []byte{0, 0, 0, 1}}) != nil {
+			break
+		}
+	}
+	err := peer.TrySend(Message{Type: MsgTypeHave, Payload: []byte{0, 0, 0, 1}})
+	if err != ErrSendQueueFull {
+		t.Fatalf("send to a full queue, %v", err)
+	}
+	if sent < outboundQueueLength || sent > outboundQueueLength+1 {
+		t.Errorf("%v messages queued", sent)
+	}
+
+	peer.Close()
+	if err := peer.TrySend(Message{Type: MsgTypeHave}); err == nil || err == ErrSendQueueFull {
+		t.Errorf("send to a closed peer, %v", err)
+	}
+}
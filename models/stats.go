@@ -0,0 +1,26 @@
+package models
+
+import "sync/atomic"
+
+// Stats counts the bytes transferred for a torrent, safe to use from any
+// goroutine
+type Stats struct {
+	uploaded   int64
+	downloaded int64
+}
+
+func (stats *Stats) AddUploaded(n int) {
+	atomic.AddInt64(&stats.uploaded, int64(n))
+}
+
+func (stats *Stats) AddDownloaded(n int) {
+	atomic.AddInt64(&stats.downloaded, int64(n))
+}
+
+func (stats *Stats) Uploaded() int64 {
+	return atomic.LoadInt64(&stats.uploaded)
+}
+
+func (stats *Stats) Downloaded() int64 {
+	return atomic.LoadInt64(&stats.downloaded)
+}
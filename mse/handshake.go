@@ -0,0 +1,244 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// The whole encryption handshake has to be done in this time
+const handshakeTimeout = 10 * time.Second
+
+// Plaintext connections start with the BitTorrent handshake
+var plaintextHeader = []byte("\x13BitTorrent protocol")
+
+// syncTo skips the peer's padding up to the end of pattern
+func syncTo(reader *bufio.Reader, pattern []byte, maxSkip int) error {
+	window := make([]byte, 0, maxSkip+len(pattern))
+	for len(window) < maxSkip+len(pattern) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if len(window) >= len(pattern) && bytes.Equal(window[len(window)-len(pattern):], pattern) {
+			return nil
+		}
+	}
+	return errors.New("encryption handshake not found in the peer's padding")
+}
+
+// readEncrypted reads and decrypts length bytes
+func readEncrypted(reader io.Reader, decrypt interface{ XORKeyStream(dst, src []byte) }, length int) ([]byte, error) {
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(data, data)
+	return data, nil
+}
+
+// Initiate runs the encryption handshake of an outgoing connection to a peer
+// in the swarm of infoHash. Required only offers RC4, Preferred also offers
+// plaintext.
+func Initiate(conn net.Conn, infoHash [20]byte, mode Mode) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+
+	private, public, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPadding()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, padA...))
+	if err != nil {
+		return nil, err
+	}
+
+	peerPublic := make([]byte, keyLength)
+	_, err = io.ReadFull(reader, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(private, peerPublic)
+
+	encrypt := newCipher(hash([]byte("keyA"), secret, infoHash[:]))
+	decrypt := newCipher(hash([]byte("keyB"), secret, infoHash[:]))
+
+	provide := cryptoRC4
+	if mode == Preferred {
+		provide |= cryptoPlaintext
+	}
+
+	// VC, crypto_provide, len(PadC) and len(IA), without padding or initial
+	// payload
+	plain := append([]byte{}, vc...)
+	plain = binary.BigEndian.AppendUint32(plain, provide)
+	plain = append(plain, 0, 0, 0, 0)
+	encrypt.XORKeyStream(plain, plain)
+
+	message := hash([]byte("req1"), secret)
+	message = append(message, xor(hash([]byte("req2"), infoHash[:]), hash([]byte("req3"), secret))...)
+	message = append(message, plain...)
+	_, err = conn.Write(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// The peer's padding comes before its encrypted VC
+	encryptedVC := make([]byte, len(vc))
+	decrypt.XORKeyStream(encryptedVC, vc)
+	err = syncTo(reader, encryptedVC, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readEncrypted(reader, decrypt, 6)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(header[:4])
+	padLength := int(binary.BigEndian.Uint16(header[4:]))
+	if padLength > maxPadding {
+		return nil, errors.New("invalid padding length")
+	}
+	_, err = readEncrypted(reader, decrypt, padLength)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case selected == cryptoRC4:
+		return newConn(conn, reader, nil, encrypt, decrypt), nil
+	case selected == cryptoPlaintext && mode == Preferred:
+		return newConn(conn, reader, nil, nil, nil), nil
+	default:
+		return nil, errors.New("peer selected an encryption method we didn't offer")
+	}
+}
+
+// Accept runs the encryption handshake of an incoming connection for any of
+// the info hashes. Plaintext connections are passed through unless
+// encryption is required.
+func Accept(conn net.Conn, infoHashes [][20]byte, mode Mode) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+
+	start, err := reader.Peek(len(plaintextHeader))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, plaintextHeader) {
+		if mode == Required {
+			return nil, errors.New("plaintext connection refused, encryption is required")
+		}
+		return newConn(conn, reader, nil, nil, nil), nil
+	}
+	if mode == Disabled {
+		return nil, errors.New("encrypted connection refused, encryption is disabled")
+	}
+
+	peerPublic := make([]byte, keyLength)
+	_, err = io.ReadFull(reader, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	private, public, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPadding()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, padB...))
+	if err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(private, peerPublic)
+
+	// The peer's padding comes before the hash of the secret
+	err = syncTo(reader, hash([]byte("req1"), secret), maxPadding)
+	if err != nil {
+		return nil, err
+	}
+
+	skeyHash := make([]byte, 20)
+	_, err = io.ReadFull(reader, skeyHash)
+	if err != nil {
+		return nil, err
+	}
+	req3 := hash([]byte("req3"), secret)
+	var infoHash []byte
+	for _, candidate := range infoHashes {
+		if bytes.Equal(xor(hash([]byte("req2"), candidate[:]), req3), skeyHash) {
+			infoHash = candidate[:]
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, errors.New("peer wants a torrent we don't have")
+	}
+
+	decrypt := newCipher(hash([]byte("keyA"), secret, infoHash))
+	encrypt := newCipher(hash([]byte("keyB"), secret, infoHash))
+
+	header, err := readEncrypted(reader, decrypt, 14)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], vc) {
+		return nil, errors.New("invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLength := int(binary.BigEndian.Uint16(header[12:]))
+	if padLength > maxPadding {
+		return nil, errors.New("invalid padding length")
+	}
+
+	// PadC and len(IA)
+	rest, err := readEncrypted(reader, decrypt, padLength+2)
+	if err != nil {
+		return nil, err
+	}
+	initialPayload, err := readEncrypted(reader, decrypt, int(binary.BigEndian.Uint16(rest[padLength:])))
+	if err != nil {
+		return nil, err
+	}
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && mode == Preferred:
+		selected = cryptoPlaintext
+	default:
+		return nil, errors.New("no encryption method in common with the peer")
+	}
+
+	// VC, crypto_select and len(PadD), without padding
+	reply := append([]byte{}, vc...)
+	reply = binary.BigEndian.AppendUint32(reply, selected)
+	reply = append(reply, 0, 0)
+	encrypt.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	if selected == cryptoRC4 {
+		return newConn(conn, reader, initialPayload, encrypt, decrypt), nil
+	}
+	return newConn(conn, reader, initialPayload, nil, nil), nil
+}
@@ -0,0 +1,159 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// loopback returns both ends of a TCP connection
+func loopback(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func accept(conn net.Conn, infoHashes [][20]byte, mode Mode) <-chan acceptResult {
+	results := make(chan acceptResult, 1)
+	go func() {
+		accepted, err := Accept(conn, infoHashes, mode)
+		if err != nil {
+			// Like the listener, so the other side doesn't wait for the
+			// timeout
+			conn.Close()
+		}
+		results <- acceptResult{accepted, err}
+	}()
+	return results
+}
+
+// exchange checks that data passes both ways
+func exchange(t *testing.T, a net.Conn, b net.Conn) {
+	message := bytes.Repeat([]byte("piece data "), 10000)
+	for _, direction := range [][2]net.Conn{{a, b}, {b, a}} {
+		go direction[0].Write(message)
+		received := make([]byte, len(message))
+		_, err := io.ReadFull(direction[1], received)
+		if err != nil || !bytes.Equal(received, message) {
+			t.Fatalf("data differs, %v", err)
+		}
+	}
+}
+
+func TestInitiateAccept(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	// Hybrid torrents accept peers of both swarms
+	infoHashes := [][20]byte{{9}, infoHash}
+
+	tests := []struct {
+		initiate  Mode
+		accept    Mode
+		ok        bool
+		encrypted bool
+	}{
+		{Disabled, Disabled, true, false},
+		{Disabled, Preferred, true, false},
+		{Disabled, Required, false, false},
+		{Preferred, Disabled, false, false},
+		{Preferred, Preferred, true, true},
+		{Preferred, Required, true, true},
+		{Required, Disabled, false, false},
+		{Required, Preferred, true, true},
+		{Required, Required, true, true},
+	}
+	for _, test := range tests {
+		dialed, incoming := loopback(t)
+		results := accept(incoming, infoHashes, test.accept)
+
+		// Peers with encryption disabled start with the plaintext handshake
+		var initiated net.Conn = dialed
+		var err error
+		if test.initiate == Disabled {
+			_, err = dialed.Write(append(append([]byte{}, plaintextHeader...), "handshake"...))
+		} else {
+			initiated, err = Initiate(dialed, infoHash, test.initiate)
+		}
+		result := <-results
+
+		name := test.initiate.String() + " to " + test.accept.String()
+		if (err == nil && result.err == nil) != test.ok {
+			t.Errorf("%v: initiate %v, accept %v", name, err, result.err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+
+		encrypted := result.conn.(*Conn).Encrypted
+		if initiatedConn, ok := initiated.(*Conn); ok && initiatedConn.Encrypted != encrypted {
+			t.Errorf("%v: sides disagree on encryption", name)
+		}
+		if encrypted != test.encrypted {
+			t.Errorf("%v: encrypted %v", name, encrypted)
+		}
+		if test.initiate == Disabled {
+			header := make([]byte, len(plaintextHeader)+len("handshake"))
+			_, err := io.ReadFull(result.conn, header)
+			if err != nil || string(header) != string(plaintextHeader)+"handshake" {
+				t.Errorf("%v: plaintext handshake lost, %q %v", name, header, err)
+			}
+		}
+		exchange(t, initiated, result.conn)
+	}
+}
+
+func TestAcceptUnknownInfoHash(t *testing.T) {
+	dialed, incoming := loopback(t)
+	results := accept(incoming, [][20]byte{{7}}, Preferred)
+
+	_, err := Initiate(dialed, [20]byte{1}, Preferred)
+	if err == nil {
+		t.Error("handshake for a torrent the peer doesn't have succeeded")
+	}
+	if result := <-results; result.err == nil {
+		t.Error("unknown info hash accepted")
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, mode := range []Mode{Disabled, Preferred, Required} {
+		parsed, err := ParseMode(mode.String())
+		if err != nil || parsed != mode {
+			t.Errorf("%v parsed as %v, %v", mode, parsed, err)
+		}
+	}
+	if _, err := ParseMode("sometimes"); err == nil {
+		t.Error("unknown mode parsed")
+	}
+}
@@ -0,0 +1,162 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+)
+
+// Mode decides whether connections are encrypted with Message Stream
+// Encryption
+type Mode int
+
+const (
+	// Disabled only makes and accepts plaintext connections
+	Disabled Mode = iota
+	// Preferred encrypts whenever the peer supports it and falls back to
+	// plaintext otherwise
+	Preferred
+	// Required refuses plaintext connections
+	Required
+)
+
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+
+	keyLength = 96
+	// Padding is random and at most this long
+	maxPadding = 512
+	// RC4 keystream bytes dropped before use
+	rc4Discard = 1024
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	// The verification constant is 8 zero bytes
+	vc = make([]byte, 8)
+)
+
+func (mode Mode) String() string {
+	switch mode {
+	case Disabled:
+		return "disable"
+	case Preferred:
+		return "prefer"
+	case Required:
+		return "require"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseMode(value string) (Mode, error) {
+	switch value {
+	case "disable":
+		return Disabled, nil
+	case "prefer":
+		return Preferred, nil
+	case "require":
+		return Required, nil
+	default:
+		return Disabled, errors.New("unknown encryption mode " + value)
+	}
+}
+
+// Conn is a connection after the encryption handshake, with RC4 applied to
+// both directions unless plaintext was selected
+type Conn struct {
+	net.Conn
+	reader io.Reader
+	writer io.Writer
+	// Encrypted is false if the peers agreed on plaintext
+	Encrypted bool
+}
+
+func (conn *Conn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn *Conn) Write(b []byte) (int, error) {
+	return conn.writer.Write(b)
+}
+
+// newConn puts the ciphers on the connection, data already buffered by the
+// handshake is read first
+func newConn(conn net.Conn, buffered *bufio.Reader, initialPayload []byte, encrypt *rc4.Cipher, decrypt *rc4.Cipher) *Conn {
+	if encrypt == nil {
+		return &Conn{
+			Conn:   conn,
+			reader: io.MultiReader(bytes.NewReader(initialPayload), buffered),
+			writer: conn,
+		}
+	}
+	return &Conn{
+		Conn:      conn,
+		reader:    io.MultiReader(bytes.NewReader(initialPayload), cipher.StreamReader{S: decrypt, R: buffered}),
+		writer:    cipher.StreamWriter{S: encrypt, W: conn},
+		Encrypted: true,
+	}
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a []byte, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
+
+// newKeyPair returns a random private key and the public key sent to the peer
+func newKeyPair() (*big.Int, []byte, error) {
+	privateBytes := make([]byte, 20)
+	_, err := rand.Read(privateBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(privateBytes)
+	public := new(big.Int).Exp(generator, private, prime)
+	return private, public.FillBytes(make([]byte, keyLength)), nil
+}
+
+// sharedSecret computes S from our private key and the peer's public key
+func sharedSecret(private *big.Int, peerPublic []byte) []byte {
+	secret := new(big.Int).Exp(new(big.Int).SetBytes(peerPublic), private, prime)
+	return secret.FillBytes(make([]byte, keyLength))
+}
+
+func newCipher(key []byte) *rc4.Cipher {
+	// Keys are 20 bytes long, rc4 only fails for empty or too long keys
+	c, _ := rc4.NewCipher(key)
+	discard := make([]byte, rc4Discard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPadding() ([]byte, error) {
+	var length [2]byte
+	_, err := rand.Read(length[:])
+	if err != nil {
+		return nil, err
+	}
+	padding := make([]byte, (int(length[0])<<8|int(length[1]))%(maxPadding+1))
+	_, err = rand.Read(padding)
+	return padding, err
+}
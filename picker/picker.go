@@ -0,0 +1,225 @@
+package picker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"torrentClient/common"
+	"torrentClient/models"
+)
+
+// Picker hands out the pieces still missing to the peer workers. Pieces are
+// picked by the highest priority of the files they overlap and pieces only
+// overlapping skipped files are never picked, unless they are inside the
+// readahead window of a stream reader.
+type Picker struct {
+	mutex         sync.Mutex
+	manifest      *models.Manifest
+	have          *models.Bitfield
+	inProgress    []bool
+	piecePriority []models.FilePriority
+	sequential    bool
+	readahead     int
+	cursors       map[int]int
+	nextCursor    int
+	waiters       map[int][]chan struct{}
+}
+
+func New(manifest *models.Manifest, have *models.Bitfield) *Picker {
+	picker := &Picker{
+		manifest:      manifest,
+		have:          have,
+		inProgress:    make([]bool, manifest.PieceCount()),
+		piecePriority: make([]models.FilePriority, manifest.PieceCount()),
+		readahead:     DefaultReadahead,
+		cursors:       map[int]int{},
+		waiters:       map[int][]chan struct{}{},
+	}
+	picker.updatePiecePriorities()
+	return picker
+}
+
+func (picker *Picker) updatePiecePriorities() {
+	for index := range picker.piecePriority {
+		picker.piecePriority[index] = models.PrioritySkip
+	}
+
+	for fileIndex, file := range picker.manifest.FileInfos {
+		if file.Length == 0 {
+			continue
+		}
+		first, last := picker.manifest.FilePieces(fileIndex)
+		for index := first; index <= last; index++ {
+			if file.Priority > picker.piecePriority[index] {
+				picker.piecePriority[index] = file.Priority
+			}
+		}
+	}
+}
+
+func hasPiece(bitfield models.Bitfield, index int) bool {
+	return index/8 < len(bitfield) && bitfield.HasPiece(index)
+}
+
+// Next returns the most important missing piece the peer has
+func (picker *Picker) Next(peerBitField models.Bitfield) (models.PieceJob, bool) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	best := -1
+	bestScore := 0
+	for index := range picker.piecePriority {
+		if picker.inProgress[index] || picker.have.HasPiece(index) || !hasPiece(peerBitField, index) {
+			continue
+		}
+		if score := picker.score(index); score > bestScore {
+			best = index
+			bestScore = score
+		}
+	}
+
+	if best == -1 {
+		return models.PieceJob{}, false
+	}
+
+	picker.inProgress[best] = true
+	pieceJob := models.PieceJob{
+		PieceIndex:  best,
+		PieceLength: common.GetPieceLength(best, int(picker.manifest.PieceLength), int(picker.manifest.Length)),
+	}
+	// v2 only torrents have no SHA-1 piece hashes
+	if best < len(picker.manifest.PieceHashes) {
+		pieceJob.PieceHash = picker.manifest.PieceHashes[best]
+	}
+	return pieceJob, true
+}
+
+// Interesting reports whether the peer has a missing piece we want, whether
+// or not it is being downloaded already
+func (picker *Picker) Interesting(peerBitField models.Bitfield) bool {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	for index := range picker.piecePriority {
+		if !picker.have.HasPiece(index) && hasPiece(peerBitField, index) && picker.score(index) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Requeue gives back a piece a worker failed to download
+func (picker *Picker) Requeue(pieceJob models.PieceJob) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	picker.inProgress[pieceJob.PieceIndex] = false
+}
+
+// Done marks a downloaded and verified piece
+func (picker *Picker) Done(index int) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	picker.inProgress[index] = false
+	picker.have.MarkPiece(index)
+
+	for _, waiter := range picker.waiters[index] {
+		close(waiter)
+	}
+	delete(picker.waiters, index)
+}
+
+// Finished reports whether every piece of the wanted files is downloaded
+func (picker *Picker) Finished() bool {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	for index, priority := range picker.piecePriority {
+		if priority != models.PrioritySkip && !picker.have.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
+
+// Wanted returns the number of pieces overlapping wanted files
+func (picker *Picker) Wanted() int {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	wanted := 0
+	for _, priority := range picker.piecePriority {
+		if priority != models.PrioritySkip {
+			wanted++
+		}
+	}
+	return wanted
+}
+
+// Left returns the bytes of the wanted pieces still missing
+func (picker *Picker) Left() int64 {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	left := int64(0)
+	for index, priority := range picker.piecePriority {
+		if priority != models.PrioritySkip && !picker.have.HasPiece(index) {
+			left += int64(common.GetPieceLength(index, int(picker.manifest.PieceLength), int(picker.manifest.Length)))
+		}
+	}
+	return left
+}
+
+// Missing returns the bytes of every piece still missing, wanted or not
+func (picker *Picker) Missing() int64 {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	missing := int64(0)
+	for index := range picker.piecePriority {
+		if !picker.have.HasPiece(index) {
+			missing += int64(common.GetPieceLength(index, int(picker.manifest.PieceLength), int(picker.manifest.Length)))
+		}
+	}
+	return missing
+}
+
+func (picker *Picker) FilePriority(fileIndex int) models.FilePriority {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	return picker.manifest.FileInfos[fileIndex].Priority
+}
+
+func (picker *Picker) SetFilePriority(fileIndex int, priority models.FilePriority) error {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	if fileIndex < 0 || fileIndex >= len(picker.manifest.FileInfos) {
+		return errors.New("invalid file index " + fmt.Sprint(fileIndex))
+	}
+	if picker.manifest.FileInfos[fileIndex].Padding {
+		return errors.New("file " + fmt.Sprint(fileIndex) + " is padding")
+	}
+
+	picker.manifest.FileInfos[fileIndex].Priority = priority
+	picker.updatePiecePriorities()
+	return nil
+}
+
+// Has reports whether a piece is downloaded and verified
+func (picker *Picker) Has(index int) bool {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	return hasPiece(*picker.have, index)
+}
+
+// Bitfield returns a copy of the downloaded pieces, safe to send to peers
+func (picker *Picker) Bitfield() models.Bitfield {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	return append(models.Bitfield{}, *picker.have...)
+}
@@ -0,0 +1,209 @@
+package picker
+
+import (
+	"testing"
+	"torrentClient/models"
+)
+
+// newTestPicker returns a picker of nothing downloaded for three files in
+// pieces of 100 bytes: a covers pieces 0 to 2, b pieces 2 and 3, c pieces 4
+// and 5, the last piece being 80 bytes long
+func newTestPicker(a models.FilePriority, b models.FilePriority, c models.FilePriority) *Picker {
+	manifest := &models.Manifest{
+		Name:        "files",
+		PieceLength: 100,
+		Length:      580,
+		MultiFile:   true,
+		FileInfos: []models.FileInfo{
+			{Path: "files/a", Name: "a", Length: 250, Offset: 0, Priority: a},
+			{Path: "files/b", Name: "b", Length: 150, Offset: 250, Priority: b},
+			{Path: "files/c", Name: "c", Length: 180, Offset: 400, Priority: c},
+		},
+		PieceHashes: make([][20]byte, 6),
+	}
+	have := make(models.Bitfield, 1)
+	return New(manifest, &have)
+}
+
+// allPieces is the bitfield of a peer having every piece
+var allPieces = models.Bitfield{0xfc}
+
+// pickAll returns the pieces handed out one after the other until none is
+// left
+func pickAll(picker *Picker, peerBitField models.Bitfield) []int {
+	picked := []int{}
+	for {
+		pieceJob, ok := picker.Next(peerBitField)
+		if !ok {
+			return picked
+		}
+		picked = append(picked, pieceJob.PieceIndex)
+	}
+}
+
+func equalPieces(got []int, want []int) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPriorityOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities [3]models.FilePriority
+		sequential bool
+		want       []int
+	}{
+		{"all normal", [3]models.FilePriority{models.PriorityNormal, models.PriorityNormal, models.PriorityNormal}, false, []int{0, 1, 2, 3, 4, 5}},
+		// Piece 2 is shared by a and b and takes the higher priority
+		{"by file priority", [3]models.FilePriority{models.PriorityLow, models.PriorityHigh, models.PriorityNormal}, false, []int{2, 3, 4, 5, 0, 1}},
+		{"high last file", [3]models.FilePriority{models.PriorityNormal, models.PriorityLow, models.PriorityHigh}, false, []int{4, 5, 0, 1, 2, 3}},
+		{"sequential ignores priorities", [3]models.FilePriority{models.PriorityLow, models.PriorityHigh, models.PriorityNormal}, true, []int{0, 1, 2, 3, 4, 5}},
+		{"skipped file", [3]models.FilePriority{models.PriorityNormal, models.PrioritySkip, models.PriorityHigh}, false, []int{4, 5, 0, 1, 2}},
+		{"skipped file sequential", [3]models.FilePriority{models.PriorityNormal, models.PrioritySkip, models.PriorityNormal}, true, []int{0, 1, 2, 4, 5}},
+		{"only the middle file", [3]models.FilePriority{models.PrioritySkip, models.PriorityLow, models.PrioritySkip}, false, []int{2, 3}},
+		{"everything skipped", [3]models.FilePriority{models.PrioritySkip, models.PrioritySkip, models.PrioritySkip}, false, []int{}},
+	}
+	for _, test := range tests {
+		picker := newTestPicker(test.priorities[0], test.priorities[1], test.priorities[2])
+		picker.SetSequential(test.sequential)
+		if got := pickAll(picker, allPieces); !equalPieces(got, test.want) {
+			t.Errorf("%v: picked %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNextOnlyPicksPiecesOfThePeer(t *testing.T) {
+	picker := newTestPicker(models.PriorityHigh, models.PriorityNormal, models.PrioritySkip)
+
+	// Pieces 3 and 4, piece 4 only overlaps the skipped file
+	peerBitField := models.Bitfield{0x18}
+	if got := pickAll(picker, peerBitField); !equalPieces(got, []int{3}) {
+		t.Errorf("picked %v", got)
+	}
+	if picker.Interesting(models.Bitfield{0x08}) {
+		t.Error("peer with only a skipped piece is interesting")
+	}
+	if !picker.Interesting(peerBitField) {
+		t.Error("peer with a wanted piece in progress isn't interesting")
+	}
+
+	// A short or empty bitfield has nothing
+	if got := pickAll(picker, nil); len(got) != 0 {
+		t.Errorf("picked %v from a peer without a bitfield", got)
+	}
+
+	pieceJob, ok := picker.Next(allPieces)
+	if !ok || pieceJob.PieceIndex != 0 || pieceJob.PieceLength != 100 {
+		t.Errorf("picked %+v", pieceJob)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	picker := newTestPicker(models.PriorityNormal, models.PriorityNormal, models.PriorityNormal)
+
+	first, _ := picker.Next(allPieces)
+	second, _ := picker.Next(allPieces)
+	if first.PieceIndex != 0 || second.PieceIndex != 1 {
+		t.Fatalf("picked %v and %v", first.PieceIndex, second.PieceIndex)
+	}
+
+	// A failed piece is handed out again before the pieces after it
+	picker.Requeue(first)
+	if again, _ := picker.Next(allPieces); again.PieceIndex != 0 {
+		t.Errorf("picked %v after a requeue", again.PieceIndex)
+	}
+
+	// Done pieces are never handed out again, even requeued
+	picker.Done(1)
+	picker.Requeue(second)
+	if got := pickAll(picker, allPieces); !equalPieces(got, []int{2, 3, 4, 5}) {
+		t.Errorf("picked %v", got)
+	}
+	if !picker.Has(1) || picker.Has(0) || picker.Has(6) || picker.Has(-1) {
+		t.Error("wrong pieces downloaded")
+	}
+	if bitfield := picker.Bitfield(); bitfield[0] != 0x40 {
+		t.Errorf("bitfield %08b", bitfield[0])
+	}
+
+	// The last piece is short
+	picker.Requeue(models.PieceJob{PieceIndex: 5})
+	if last, ok := picker.Next(models.Bitfield{0x04}); !ok || last.PieceLength != 80 {
+		t.Errorf("last piece of %v bytes", last.PieceLength)
+	}
+}
+
+func TestFinishedAndLeftUnderPriorities(t *testing.T) {
+	picker := newTestPicker(models.PriorityNormal, models.PrioritySkip, models.PrioritySkip)
+
+	if picker.Wanted() != 3 || picker.Left() != 300 || picker.Missing() != 580 || picker.Finished() {
+		t.Fatalf("wanted %v, left %v, missing %v", picker.Wanted(), picker.Left(), picker.Missing())
+	}
+
+	// Piece 2 is shared with the skipped file b and still needed for a
+	picker.Done(0)
+	picker.Done(1)
+	if picker.Finished() || picker.Left() != 100 {
+		t.Errorf("finished %v with %v bytes left", picker.Finished(), picker.Left())
+	}
+	picker.Done(2)
+	if !picker.Finished() || picker.Left() != 0 || picker.Missing() != 280 {
+		t.Errorf("finished %v with %v bytes left, %v missing", picker.Finished(), picker.Left(), picker.Missing())
+	}
+
+	// Wanting another file resumes the download, with the short last piece
+	if err := picker.SetFilePriority(2, models.PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	if picker.Finished() || picker.Wanted() != 5 || picker.Left() != 180 {
+		t.Errorf("finished %v with %v wanted pieces, %v bytes left", picker.Finished(), picker.Wanted(), picker.Left())
+	}
+	if picker.FilePriority(2) != models.PriorityLow {
+		t.Errorf("file priority %v", picker.FilePriority(2))
+	}
+
+	// Skipping it again finishes the download without its pieces
+	if err := picker.SetFilePriority(2, models.PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+	if !picker.Finished() || picker.Left() != 0 {
+		t.Errorf("finished %v with %v bytes left", picker.Finished(), picker.Left())
+	}
+
+	// Everything skipped is finished from the start
+	if skipped := newTestPicker(models.PrioritySkip, models.PrioritySkip, models.PrioritySkip); !skipped.Finished() || skipped.Left() != 0 {
+		t.Error("nothing wanted isn't finished")
+	}
+}
+
+func TestSetFilePriorityErrors(t *testing.T) {
+	picker := newTestPicker(models.PriorityNormal, models.PriorityNormal, models.PriorityNormal)
+	picker.manifest.FileInfos = append(picker.manifest.FileInfos, models.FileInfo{Path: "files/.pad/20", Length: 20, Offset: 580, Priority: models.PrioritySkip, Padding: true})
+
+	for _, index := range []int{-1, 4} {
+		if picker.SetFilePriority(index, models.PriorityHigh) == nil {
+			t.Errorf("file %v accepted", index)
+		}
+	}
+	if picker.SetFilePriority(3, models.PriorityHigh) == nil {
+		t.Error("padding file wanted")
+	}
+}
+
+func TestReadaheadPicksSkippedPieces(t *testing.T) {
+	picker := newTestPicker(models.PriorityHigh, models.PrioritySkip, models.PriorityLow)
+	picker.SetReadahead(2)
+
+	// A reader in the skipped file gets its pieces before any other
+	picker.AddCursor(3)
+	if got := pickAll(picker, allPieces); !equalPieces(got, []int{3, 4, 0, 1, 2, 5}) {
+		t.Errorf("picked %v", got)
+	}
+}
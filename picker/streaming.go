@@ -0,0 +1,126 @@
+package picker
+
+import "torrentClient/models"
+
+// DefaultReadahead is the number of pieces ahead of a read cursor that are
+// downloaded before any other piece
+const DefaultReadahead = 8
+
+// urgentScore is above any file priority so readahead pieces always win
+const urgentScore = 1000
+
+// score ranks a missing piece, pieces with a higher score are picked first
+// and pieces scoring zero are never picked
+func (picker *Picker) score(index int) int {
+	score := 0
+	for _, cursor := range picker.cursors {
+		if index >= cursor && index < cursor+picker.readahead {
+			if urgency := urgentScore + picker.readahead - (index - cursor); urgency > score {
+				score = urgency
+			}
+		}
+	}
+	if score > 0 {
+		return score
+	}
+
+	priority := picker.piecePriority[index]
+	if priority == models.PrioritySkip {
+		return 0
+	}
+	// In sequential mode every wanted piece scores the same, so the lowest
+	// index wins
+	if picker.sequential {
+		return 1
+	}
+	return int(priority)
+}
+
+// SetSequential makes the picker download wanted pieces in order instead of
+// by file priority
+func (picker *Picker) SetSequential(sequential bool) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	picker.sequential = sequential
+}
+
+func (picker *Picker) Sequential() bool {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	return picker.sequential
+}
+
+// SetReadahead changes the size of the window, in pieces, prioritized ahead
+// of every read cursor
+func (picker *Picker) SetReadahead(pieces int) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	if pieces < 1 {
+		pieces = 1
+	}
+	picker.readahead = pieces
+}
+
+// AddCursor registers a read position and returns its id
+func (picker *Picker) AddCursor(piece int) int {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	id := picker.nextCursor
+	picker.nextCursor++
+	picker.cursors[id] = piece
+	return id
+}
+
+func (picker *Picker) MoveCursor(id int, piece int) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	if _, ok := picker.cursors[id]; ok {
+		picker.cursors[id] = piece
+	}
+}
+
+func (picker *Picker) RemoveCursor(id int) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	delete(picker.cursors, id)
+}
+
+// PieceReady returns a channel that is closed once the piece is downloaded
+func (picker *Picker) PieceReady(index int) <-chan struct{} {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	ready := make(chan struct{})
+	if picker.have.HasPiece(index) {
+		close(ready)
+		return ready
+	}
+	picker.waiters[index] = append(picker.waiters[index], ready)
+	return ready
+}
+
+// CancelPieceReady forgets a channel returned by PieceReady that is no longer
+// waited on
+func (picker *Picker) CancelPieceReady(index int, ready <-chan struct{}) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	waiters := picker.waiters[index]
+	for i, waiter := range waiters {
+		if waiter == ready {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(picker.waiters, index)
+	} else {
+		picker.waiters[index] = waiters
+	}
+}
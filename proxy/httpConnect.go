@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// HTTPConnect connects through an HTTP proxy with the CONNECT method. HTTP
+// proxies can't relay UDP.
+type HTTPConnect struct {
+	Address string
+	// Username and Password are sent with basic authentication if set
+	Username string
+	Password string
+}
+
+func (proxy *HTTPConnect) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("HTTP proxy can't dial " + network)
+	}
+
+	conn, err := Direct{}.DialContext(ctx, "tcp", proxy.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	err = withContext(ctx, conn, func() error {
+		// CONNECT requests name the target host and port only
+		request := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: http.Header{},
+		}
+		if proxy.Username != "" {
+			credentials := base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+			request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		}
+		err := request.Write(conn)
+		if err != nil {
+			return err
+		}
+
+		response, err := http.ReadResponse(reader, request)
+		if err != nil {
+			return err
+		}
+		// The body of a refusal may only end when the proxy closes the
+		// connection, it is closed with the connection instead
+		if response.StatusCode != http.StatusOK {
+			return errors.New("HTTP proxy refused the connection, " + response.Status)
+		}
+		response.Body.Close()
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return withBuffered(conn, reader), nil
+}
+
+func (proxy *HTTPConnect) ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	return nil, errors.New("HTTP proxies can't relay UDP")
+}
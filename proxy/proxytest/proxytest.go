@@ -0,0 +1,349 @@
+// Package proxytest runs SOCKS5 and HTTP CONNECT proxies on loopback for
+// tests, they count what they relay
+package proxytest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Server is a proxy listening on a loopback port
+type Server struct {
+	// Address is where the proxy listens, host:port
+	Address  string
+	username string
+	password string
+	listener net.Listener
+	connects int32
+	packets  int32
+
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewSOCKS5 starts a SOCKS5 proxy with CONNECT and UDP ASSOCIATE, clients
+// have to log in if username is set
+func NewSOCKS5(username string, password string) (*Server, error) {
+	return start(username, password, (*Server).serveSOCKS5)
+}
+
+// NewHTTPConnect starts an HTTP proxy only allowing CONNECT, clients have to
+// use basic authentication if username is set
+func NewHTTPConnect(username string, password string) (*Server, error) {
+	return start(username, password, (*Server).serveHTTPConnect)
+}
+
+func start(username string, password string, serve func(*Server, net.Conn)) (*Server, error) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{
+		Address:  listener.Addr().String(),
+		username: username,
+		password: password,
+		listener: listener,
+		conns:    map[net.Conn]struct{}{},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if !server.track(conn) {
+				conn.Close()
+				return
+			}
+			go func() {
+				defer server.untrack(conn)
+				serve(server, conn)
+			}()
+		}
+	}()
+	return server, nil
+}
+
+// Connects returns the number of TCP connections relayed
+func (server *Server) Connects() int {
+	return int(atomic.LoadInt32(&server.connects))
+}
+
+// Packets returns the number of UDP packets relayed from clients
+func (server *Server) Packets() int {
+	return int(atomic.LoadInt32(&server.packets))
+}
+
+// Close stops the proxy and closes the connections it relays
+func (server *Server) Close() {
+	server.listener.Close()
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.conns = nil
+}
+
+func (server *Server) track(conn net.Conn) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.conns == nil {
+		return false
+	}
+	server.conns[conn] = struct{}{}
+	return true
+}
+
+func (server *Server) untrack(conn net.Conn) {
+	conn.Close()
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	delete(server.conns, conn)
+}
+
+// relay copies between the client and the target until either side closes,
+// reader has the client's data already buffered
+func (server *Server) relay(client net.Conn, reader io.Reader, target net.Conn) {
+	if !server.track(target) {
+		target.Close()
+		return
+	}
+	defer server.untrack(target)
+
+	atomic.AddInt32(&server.connects, 1)
+	go func() {
+		io.Copy(target, reader)
+		target.Close()
+	}()
+	io.Copy(client, target)
+}
+
+func (server *Server) serveSOCKS5(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	var greeting [2]byte
+	if _, err := io.ReadFull(reader, greeting[:]); err != nil || greeting[0] != 5 {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	method := byte(0x00)
+	if server.username != "" {
+		method = 0x02
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, method})
+
+	if method == 0x02 {
+		username, password, err := readCredentials(reader)
+		if err != nil {
+			return
+		}
+		if username != server.username || password != server.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	var request [3]byte
+	if _, err := io.ReadFull(reader, request[:]); err != nil {
+		return
+	}
+	address, err := readAddress(reader)
+	if err != nil {
+		return
+	}
+
+	switch request[1] {
+	case 0x01:
+		target, err := net.Dial("tcp", address)
+		if err != nil {
+			conn.Write(socksReply(0x05, &net.TCPAddr{IP: net.IPv4zero}))
+			return
+		}
+		conn.Write(socksReply(0, target.LocalAddr()))
+		server.relay(conn, reader, target)
+	case 0x03:
+		server.associate(conn, reader)
+	default:
+		conn.Write(socksReply(0x07, &net.TCPAddr{IP: net.IPv4zero}))
+	}
+}
+
+// associate relays UDP until the control connection closes. The first
+// client packet fixes the client's address, packets from anyone else are
+// answers sent back to it.
+func (server *Server) associate(control net.Conn, reader io.Reader) {
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		control.Write(socksReply(0x01, &net.TCPAddr{IP: net.IPv4zero}))
+		return
+	}
+	defer relay.Close()
+
+	// Like many proxies, the relay is reached at the control connection's
+	// address
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+	control.Write(socksReply(0, &net.UDPAddr{IP: net.IPv4zero, Port: port}))
+
+	go func() {
+		var client *net.UDPAddr
+		buffer := make([]byte, 65536)
+		for {
+			n, from, err := relay.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			if client == nil || from.String() == client.String() {
+				// Reserved bytes, no fragments, then the destination
+				if n < 4 || buffer[2] != 0 {
+					continue
+				}
+				packet := bytes.NewReader(buffer[3:n])
+				destination, err := readAddress(packet)
+				if err != nil {
+					continue
+				}
+				target, err := net.ResolveUDPAddr("udp4", destination)
+				if err != nil {
+					continue
+				}
+				client = from
+				atomic.AddInt32(&server.packets, 1)
+				relay.WriteToUDP(buffer[n-packet.Len():n], target)
+				continue
+			}
+
+			answer := append([]byte{0, 0, 0}, encodeAddress(from)...)
+			relay.WriteToUDP(append(answer, buffer[:n]...), client)
+		}
+	}()
+	io.Copy(io.Discard, reader)
+}
+
+func (server *Server) serveHTTPConnect(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	if request.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	if server.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(server.username + ":" + server.password))
+		if request.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+			return
+		}
+	}
+
+	target, err := net.Dial("tcp", request.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	server.relay(conn, reader, target)
+}
+
+func readCredentials(reader io.Reader) (string, string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return "", "", err
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, username); err != nil {
+		return "", "", err
+	}
+	var length [1]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return "", "", err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(reader, password); err != nil {
+		return "", "", err
+	}
+	return string(username), string(password), nil
+}
+
+func readAddress(reader io.Reader) (string, error) {
+	var addressType [1]byte
+	if _, err := io.ReadFull(reader, addressType[:]); err != nil {
+		return "", err
+	}
+
+	var host []byte
+	switch addressType[0] {
+	case 0x01:
+		host = make([]byte, net.IPv4len)
+	case 0x04:
+		host = make([]byte, net.IPv6len)
+	case 0x03:
+		var length [1]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return "", err
+		}
+		host = make([]byte, length[0])
+	default:
+		return "", errors.New("unknown address type")
+	}
+	if _, err := io.ReadFull(reader, host); err != nil {
+		return "", err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(reader, port[:]); err != nil {
+		return "", err
+	}
+
+	hostname := string(host)
+	if addressType[0] != 0x03 {
+		hostname = net.IP(host).String()
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func encodeAddress(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+
+	encoded := []byte{0x04}
+	if ip4 := ip.To4(); ip4 != nil {
+		encoded = append([]byte{0x01}, ip4...)
+	} else {
+		encoded = append(encoded, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(encoded, uint16(port))
+}
+
+func socksReply(code byte, bound net.Addr) []byte {
+	return append([]byte{5, code, 0}, encodeAddress(bound)...)
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socksVersion = 5
+
+	socksMethodNone     = 0x00
+	socksMethodPassword = 0x02
+
+	socksCommandConnect      = 0x01
+	socksCommandUDPAssociate = 0x03
+
+	socksAddressIPv4   = 0x01
+	socksAddressDomain = 0x03
+	socksAddressIPv6   = 0x04
+
+	// Username and password authentication, RFC 1929
+	socksPasswordVersion = 1
+)
+
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5 connects through a SOCKS5 proxy, RFC 1928. UDP goes through the
+// proxy's UDP relay.
+type SOCKS5 struct {
+	Address string
+	// Username and Password are sent if the proxy asks for them
+	Username string
+	Password string
+}
+
+func (proxy *SOCKS5) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("SOCKS5 can't dial " + network)
+	}
+
+	conn, err := Direct{}.DialContext(ctx, "tcp", proxy.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	err = withContext(ctx, conn, func() error {
+		err := proxy.authenticate(conn, reader)
+		if err != nil {
+			return err
+		}
+		_, err = proxy.request(conn, reader, socksCommandConnect, address)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return withBuffered(conn, reader), nil
+}
+
+// ListenPacket opens a UDP association, its packets are relayed by the proxy
+// until the returned connection is closed
+func (proxy *SOCKS5) ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	control, err := Direct{}.DialContext(ctx, "tcp", proxy.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	var relay *net.UDPAddr
+	err = withContext(ctx, control, func() error {
+		reader := bufio.NewReader(control)
+		err := proxy.authenticate(control, reader)
+		if err != nil {
+			return err
+		}
+		// We don't know the address our packets will come from, the proxy
+		// takes them from any
+		bound, err := proxy.request(control, reader, socksCommandUDPAssociate, "0.0.0.0:0")
+		if err != nil {
+			return err
+		}
+		relay, err = net.ResolveUDPAddr("udp", bound)
+		return err
+	})
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	// Proxies answering with an unspecified address relay on their own
+	if relay.IP.IsUnspecified() {
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	local, err := Direct{}.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	conn := &socksPacketConn{PacketConn: local, control: control, relay: relay}
+	// The association ends with the control connection
+	go func() {
+		io.Copy(io.Discard, control)
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+// authenticate negotiates the authentication method and logs in
+func (proxy *SOCKS5) authenticate(conn net.Conn, reader *bufio.Reader) error {
+	methods := []byte{socksMethodNone}
+	if proxy.Username != "" {
+		methods = append(methods, socksMethodPassword)
+	}
+	_, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	_, err = io.ReadFull(reader, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("not a SOCKS5 proxy")
+	}
+
+	switch reply[1] {
+	case socksMethodNone:
+		return nil
+	case socksMethodPassword:
+		if proxy.Username == "" {
+			return errors.New("SOCKS5 proxy asked for a username")
+		}
+	default:
+		return errors.New("SOCKS5 proxy accepted none of our authentication methods")
+	}
+
+	if len(proxy.Username) > 255 || len(proxy.Password) > 255 {
+		return errors.New("SOCKS5 username or password too long")
+	}
+	request := []byte{socksPasswordVersion, byte(len(proxy.Username))}
+	request = append(request, proxy.Username...)
+	request = append(request, byte(len(proxy.Password)))
+	request = append(request, proxy.Password...)
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(reader, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("SOCKS5 proxy refused the username and password")
+	}
+	return nil
+}
+
+// request sends a command and returns the address the proxy bound for it
+func (proxy *SOCKS5) request(conn net.Conn, reader *bufio.Reader, command byte, address string) (string, error) {
+	encoded, err := encodeSocksAddress(address)
+	if err != nil {
+		return "", err
+	}
+	_, err = conn.Write(append([]byte{socksVersion, command, 0}, encoded...))
+	if err != nil {
+		return "", err
+	}
+
+	var reply [3]byte
+	_, err = io.ReadFull(reader, reply[:])
+	if err != nil {
+		return "", err
+	}
+	if reply[0] != socksVersion {
+		return "", errors.New("not a SOCKS5 proxy")
+	}
+	if reply[1] != 0 {
+		message, ok := socksReplies[reply[1]]
+		if !ok {
+			message = "unknown SOCKS5 error " + strconv.Itoa(int(reply[1]))
+		}
+		return "", errors.New(message)
+	}
+	return readSocksAddress(reader)
+}
+
+// encodeSocksAddress encodes host:port as the address type, the address and
+// the port, hostnames are resolved by the proxy
+func encodeSocksAddress(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid port " + portString)
+	}
+
+	var encoded []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		encoded = append([]byte{socksAddressIPv4}, ip.To4()...)
+	case ip != nil:
+		encoded = append([]byte{socksAddressIPv6}, ip.To16()...)
+	case len(host) > 255:
+		return nil, errors.New("host name too long " + host)
+	default:
+		encoded = append([]byte{socksAddressDomain, byte(len(host))}, host...)
+	}
+	return binary.BigEndian.AppendUint16(encoded, uint16(port)), nil
+}
+
+func readSocksAddress(reader io.Reader) (string, error) {
+	var addressType [1]byte
+	_, err := io.ReadFull(reader, addressType[:])
+	if err != nil {
+		return "", err
+	}
+
+	var host string
+	switch addressType[0] {
+	case socksAddressIPv4, socksAddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addressType[0] == socksAddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(reader, ip)
+		host = ip.String()
+	case socksAddressDomain:
+		var length [1]byte
+		_, err = io.ReadFull(reader, length[:])
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		_, err = io.ReadFull(reader, name)
+		host = string(name)
+	default:
+		return "", errors.New("unknown SOCKS5 address type")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var port [2]byte
+	_, err = io.ReadFull(reader, port[:])
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksPacketConn sends its packets through the relay of a UDP association,
+// each with a header telling the relay where it goes
+type socksPacketConn struct {
+	net.PacketConn
+	control net.Conn
+	relay   *net.UDPAddr
+}
+
+func (conn *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// Reserved bytes and the fragment number, fragments aren't used
+	header, err := encodeSocksAddress(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	packet := append([]byte{0, 0, 0}, header...)
+	_, err = conn.PacketConn.WriteTo(append(packet, b...), conn.relay)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := conn.PacketConn.ReadFrom(b)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// Only the relay may send us packets, fragments are dropped
+		fromUDP, ok := from.(*net.UDPAddr)
+		if !ok || !fromUDP.IP.Equal(conn.relay.IP) || fromUDP.Port != conn.relay.Port || n < 4 || b[2] != 0 {
+			continue
+		}
+
+		reader := bytes.NewReader(b[3:n])
+		source, err := readSocksAddress(reader)
+		if err != nil {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", source)
+		if err != nil {
+			continue
+		}
+		// The payload is what's left after the header
+		return copy(b, b[n-reader.Len():n]), addr, nil
+	}
+}
+
+func (conn *socksPacketConn) Close() error {
+	conn.control.Close()
+	return conn.PacketConn.Close()
+}
@@ -0,0 +1,73 @@
+package seed
+
+import (
+	"fmt"
+	"math/bits"
+	"torrentClient/common"
+	"torrentClient/models"
+)
+
+// HandleHashRequest answers a BEP 52 hash request from the piece layers of the
+// manifest. Only requests based on the piece layer can be served, everything
+// else is rejected.
+func HandleHashRequest(req *SeedRequest, manifest *models.Manifest) {
+	hashRequest, err := models.ReadHashRequest(req.Message.Payload)
+	if err != nil {
+		fmt.Printf("Error reading hash request message from peer %v, %v\n", req.Peer.Address, err)
+		return
+	}
+
+	hashes, ok := pieceLayerHashes(manifest, hashRequest)
+	if !ok {
+		fmt.Printf("Rejecting hash request from peer %v\n", req.Peer.Address)
+		common.SendMessage(req.Peer, models.Message{
+			Type:    models.MsgTypeHashReject,
+			Payload: hashRequest.ToBytes(),
+		})
+		return
+	}
+
+	payload := hashRequest.ToBytes()
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
+	}
+	common.SendMessage(req.Peer, models.Message{
+		Type:    models.MsgTypeHashes,
+		Payload: payload,
+	})
+}
+
+// pieceLayerHashes returns the requested hashes followed by the uncle hashes
+// proving them up to the number of proof layers asked for
+func pieceLayerHashes(manifest *models.Manifest, req models.HashRequest) ([][32]byte, bool) {
+	layer, ok := manifest.PieceLayers[req.PiecesRoot]
+	if !ok {
+		return nil, false
+	}
+
+	blocksPerPiece := int(manifest.PieceLength / models.MerkleBlockSize)
+	if req.BaseLayer != bits.TrailingZeros(uint(blocksPerPiece)) {
+		return nil, false
+	}
+
+	leaves := models.SplitHashes(layer)
+	width := models.NextPowerOfTwo(len(leaves))
+	if req.Length < 2 || req.Length > width || req.Length&(req.Length-1) != 0 ||
+		req.Index < 0 || req.Index%req.Length != 0 || req.Index >= width {
+		return nil, false
+	}
+
+	layers := models.MerkleLayers(leaves, width, models.PadHash(blocksPerPiece))
+	hashes := append([][32]byte{}, layers[0][req.Index:req.Index+req.Length]...)
+
+	// Walk up from the root of the requested range, the root of the file
+	// itself is known to the peer
+	level := bits.TrailingZeros(uint(req.Length))
+	position := req.Index / req.Length
+	for proof := 0; proof < req.ProofLayers && level < len(layers)-1; proof++ {
+		hashes = append(hashes, layers[level][position^1])
+		level++
+		position /= 2
+	}
+	return hashes, true
+}
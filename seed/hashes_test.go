@@ -0,0 +1,160 @@
+package seed
+
+import (
+	"crypto/sha256"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+	"torrentClient/models"
+)
+
+// newHashesManifest returns a manifest with the piece layer of a file of
+// five pieces of two blocks, and the file's pieces root
+func newHashesManifest() (*models.Manifest, [][32]byte, [32]byte) {
+	leaves := make([][32]byte, 5)
+	layer := []byte{}
+	for i := range leaves {
+		rand.Read(leaves[i][:])
+		layer = append(layer, leaves[i][:]...)
+	}
+	root := models.MerkleRoot(leaves, 8, models.PadHash(2))
+	manifest := &models.Manifest{
+		PieceLength: 2 * models.MerkleBlockSize,
+		PieceLayers: map[[32]byte][]byte{root: layer},
+	}
+	return manifest, leaves, root
+}
+
+// proofRoot hashes the requested hashes and their proof up to the highest
+// node they prove
+func proofRoot(req models.HashRequest, hashes [][32]byte) [32]byte {
+	node := models.MerkleRoot(hashes[:req.Length], req.Length, [32]byte{})
+	position := req.Index / req.Length
+	for _, uncle := range hashes[req.Length:] {
+		var pair [64]byte
+		if position%2 == 0 {
+			copy(pair[:32], node[:])
+			copy(pair[32:], uncle[:])
+		} else {
+			copy(pair[:32], uncle[:])
+			copy(pair[32:], node[:])
+		}
+		node = sha256.Sum256(pair[:])
+		position /= 2
+	}
+	return node
+}
+
+func TestPieceLayerHashes(t *testing.T) {
+	manifest, leaves, root := newHashesManifest()
+	pad := models.PadHash(2)
+
+	tests := []struct {
+		name string
+		req  models.HashRequest
+		// Number of hashes answered, zero for a rejected request
+		hashes int
+		// Whether the hashes prove the pieces root
+		proven bool
+	}{
+		{"whole layer", models.HashRequest{BaseLayer: 1, Index: 0, Length: 8}, 8, true},
+		{"whole layer with proofs", models.HashRequest{BaseLayer: 1, Index: 0, Length: 8, ProofLayers: 3}, 8, true},
+		{"pair with its proof", models.HashRequest{BaseLayer: 1, Index: 2, Length: 2, ProofLayers: 2}, 4, true},
+		{"padded pair with its proof", models.HashRequest{BaseLayer: 1, Index: 6, Length: 2, ProofLayers: 2}, 4, true},
+		{"half with more proofs than layers", models.HashRequest{BaseLayer: 1, Index: 4, Length: 4, ProofLayers: 10}, 5, true},
+		{"pair without proof", models.HashRequest{BaseLayer: 1, Index: 4, Length: 2}, 2, false},
+		{"pair with part of its proof", models.HashRequest{BaseLayer: 1, Index: 0, Length: 2, ProofLayers: 1}, 3, false},
+		{"unknown file", models.HashRequest{PiecesRoot: [32]byte{1}, BaseLayer: 1, Index: 0, Length: 2}, 0, false},
+		{"block layer", models.HashRequest{BaseLayer: 0, Index: 0, Length: 2}, 0, false},
+		{"layer above the pieces", models.HashRequest{BaseLayer: 2, Index: 0, Length: 2}, 0, false},
+		{"single hash", models.HashRequest{BaseLayer: 1, Index: 0, Length: 1}, 0, false},
+		{"length not a power of two", models.HashRequest{BaseLayer: 1, Index: 0, Length: 6}, 0, false},
+		{"longer than the layer", models.HashRequest{BaseLayer: 1, Index: 0, Length: 16}, 0, false},
+		{"unaligned index", models.HashRequest{BaseLayer: 1, Index: 1, Length: 2}, 0, false},
+		{"index past the layer", models.HashRequest{BaseLayer: 1, Index: 8, Length: 2}, 0, false},
+		{"negative index", models.HashRequest{BaseLayer: 1, Index: -2, Length: 2}, 0, false},
+	}
+	for _, test := range tests {
+		if test.req.PiecesRoot == ([32]byte{}) {
+			test.req.PiecesRoot = root
+		}
+		hashes, ok := pieceLayerHashes(manifest, test.req)
+		if !ok {
+			if test.hashes != 0 {
+				t.Errorf("%v: rejected", test.name)
+			}
+			continue
+		}
+		if len(hashes) != test.hashes {
+			t.Errorf("%v: %v hashes, want %v", test.name, len(hashes), test.hashes)
+			continue
+		}
+
+		// The requested hashes come first, padded past the last piece
+		for i := 0; i < test.req.Length; i++ {
+			want := pad
+			if test.req.Index+i < len(leaves) {
+				want = leaves[test.req.Index+i]
+			}
+			if hashes[i] != want {
+				t.Errorf("%v: hash %v differs", test.name, i)
+			}
+		}
+		if proven := proofRoot(test.req, hashes) == root; proven != test.proven {
+			t.Errorf("%v: proves the root %v, want %v", test.name, proven, test.proven)
+		}
+	}
+}
+
+func TestHandleHashRequest(t *testing.T) {
+	manifest, leaves, root := newHashesManifest()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peer := models.NewPeer(local, models.PeerAddress{IP: net.IPv4(192, 0, 2, 1), Port: 6881}, 5)
+	peer.Start()
+	defer peer.Close()
+
+	tests := []struct {
+		req    models.HashRequest
+		answer models.MessageType
+	}{
+		{models.HashRequest{PiecesRoot: root, BaseLayer: 1, Index: 2, Length: 2, ProofLayers: 2}, models.MsgTypeHashes},
+		{models.HashRequest{PiecesRoot: root, BaseLayer: 1, Index: 3, Length: 2}, models.MsgTypeHashReject},
+		{models.HashRequest{PiecesRoot: [32]byte{1}, BaseLayer: 1, Index: 0, Length: 2}, models.MsgTypeHashReject},
+	}
+	for _, test := range tests {
+		go HandleHashRequest(&SeedRequest{Peer: peer, Message: &models.Message{Type: models.MsgTypeHashRequest, Payload: test.req.ToBytes()}}, manifest)
+
+		remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		message, err := models.ReadMessage(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Type != test.answer {
+			t.Errorf("%+v: answered %v", test.req, message.Type)
+			continue
+		}
+
+		req, hashes, err := models.ReadHashesMessage(message.Payload)
+		if err != nil || req != test.req {
+			t.Errorf("%+v: answer is for %+v, %v", test.req, req, err)
+			continue
+		}
+		if message.Type == models.MsgTypeHashes {
+			if len(hashes) != 4 || hashes[0] != leaves[2] || hashes[1] != leaves[3] || proofRoot(req, hashes) != root {
+				t.Errorf("%+v: got %v hashes not proving the root", test.req, len(hashes))
+			}
+		} else if len(hashes) != 0 {
+			t.Errorf("%+v: reject with %v hashes", test.req, len(hashes))
+		}
+	}
+
+	// A request too short to read isn't answered
+	HandleHashRequest(&SeedRequest{Peer: peer, Message: &models.Message{Type: models.MsgTypeHashRequest, Payload: make([]byte, 47)}}, manifest)
+	remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if message, err := models.ReadMessage(remote); err == nil {
+		t.Errorf("short request answered with %v", message.Type)
+	}
+}
@@ -0,0 +1,126 @@
+package seed
+
+import (
+	"fmt"
+	"sync"
+	"torrentClient/common"
+	"torrentClient/models"
+	"torrentClient/picker"
+)
+
+// superSeedPeer is what a peer was shown of our pieces
+type superSeedPeer struct {
+	peer *models.Peer
+	// offer is the piece the peer may download from us, -1 for none
+	offer    int
+	revealed map[int]bool
+}
+
+// SuperSeeder hides our pieces and reveals them one at a time, a peer gets a
+// new piece once the one it was offered shows up at another peer (BEP 16)
+type SuperSeeder struct {
+	mutex       sync.Mutex
+	manifest    *models.Manifest
+	piecePicker *picker.Picker
+	// offered counts how often every piece was offered
+	offered []int
+	peers   map[*models.Peer]*superSeedPeer
+}
+
+func newSuperSeeder(manifest *models.Manifest, piecePicker *picker.Picker) *SuperSeeder {
+	return &SuperSeeder{
+		manifest:    manifest,
+		piecePicker: piecePicker,
+		offered:     make([]int, manifest.PieceCount()),
+		peers:       map[*models.Peer]*superSeedPeer{},
+	}
+}
+
+func (superSeeder *SuperSeeder) addPeer(peer *models.Peer) {
+	superSeeder.mutex.Lock()
+	defer superSeeder.mutex.Unlock()
+
+	state := &superSeedPeer{peer: peer, offer: -1, revealed: map[int]bool{}}
+	superSeeder.peers[peer] = state
+	superSeeder.offerNext(state)
+}
+
+func (superSeeder *SuperSeeder) removePeer(peer *models.Peer) {
+	superSeeder.mutex.Lock()
+	defer superSeeder.mutex.Unlock()
+
+	delete(superSeeder.peers, peer)
+}
+
+// revealed reports whether the peer was told we have the piece
+func (superSeeder *SuperSeeder) revealed(peer *models.Peer, index int) bool {
+	superSeeder.mutex.Lock()
+	defer superSeeder.mutex.Unlock()
+
+	state, ok := superSeeder.peers[peer]
+	return ok && state.revealed[index]
+}
+
+// peerHas handles a have message. Peers whose offer reached another peer get
+// a new piece, the peer downloading its own offer waits for it to spread
+// unless there is nobody to spread it to.
+func (superSeeder *SuperSeeder) peerHas(peer *models.Peer, index int) {
+	superSeeder.mutex.Lock()
+	defer superSeeder.mutex.Unlock()
+
+	for _, state := range superSeeder.peers {
+		if state.offer != index {
+			continue
+		}
+		if state.peer != peer || len(superSeeder.peers) == 1 {
+			superSeeder.offerNext(state)
+		}
+	}
+}
+
+// peerBitField handles a bitfield message, a peer that already had its offer
+// gets another piece
+func (superSeeder *SuperSeeder) peerBitField(peer *models.Peer) {
+	superSeeder.mutex.Lock()
+	defer superSeeder.mutex.Unlock()
+
+	state, ok := superSeeder.peers[peer]
+	if ok && (state.offer == -1 || peer.HasPiece(state.offer)) {
+		superSeeder.offerNext(state)
+	}
+}
+
+// offerNext reveals the piece the peer lacks that is the rarest among the
+// peers and was offered the least. Called with the mutex held.
+func (superSeeder *SuperSeeder) offerNext(state *superSeedPeer) {
+	availability := make([]int, len(superSeeder.offered))
+	for _, other := range superSeeder.peers {
+		bitField := other.peer.BitField()
+		for index := range availability {
+			if bitField.HasPiece(index) {
+				availability[index]++
+			}
+		}
+	}
+
+	best := -1
+	for index := range availability {
+		if state.revealed[index] || state.peer.HasPiece(index) || !superSeeder.piecePicker.Has(index) {
+			continue
+		}
+		if best == -1 || availability[index] < availability[best] ||
+			(availability[index] == availability[best] && superSeeder.offered[index] < superSeeder.offered[best]) {
+			best = index
+		}
+	}
+
+	state.offer = best
+	if best == -1 {
+		return
+	}
+
+	state.revealed[best] = true
+	superSeeder.offered[best]++
+	fmt.Printf("Offering piece %v to peer %v\n", best, state.peer.Address)
+	go common.SendHaveMessage(state.peer, best)
+}
@@ -0,0 +1,201 @@
+package seed
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+	"torrentClient/models"
+	"torrentClient/picker"
+	"torrentClient/storage"
+	"torrentClient/torrenttest"
+)
+
+// testSuperSeedPeer is a peer connected to a super seeding uploader, remote is
+// the peer's end of the connection
+type testSuperSeedPeer struct {
+	queue  *UploadQueue
+	peer   *models.Peer
+	remote net.Conn
+}
+
+// newSuperSeedUploader returns a super seeding uploader of a downloaded
+// torrent of four pieces
+func newSuperSeedUploader(t *testing.T) *Uploader {
+	torrent := torrenttest.SingleFile(t, "data.bin", 4*16384, 16384)
+	manifest := torrent.Manifest
+
+	store, err := storage.Open(&manifest, filepath.Join(t.TempDir(), "download"), storage.AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, err := store.WriteAt(torrent.Data, 0); err != nil {
+		t.Fatal(err)
+	}
+	have := torrent.Complete()
+	uploader, err := NewUploader(store, picker.New(&manifest, &have), &manifest, &models.Stats{}, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploader.EnableSuperSeeding()
+	return uploader
+}
+
+// connectSuperSeedPeer connects a peer having the given pieces to the
+// uploader, as the connection does once the peer's bitfield arrived
+func connectSuperSeedPeer(t *testing.T, uploader *Uploader, pieces ...int) *testSuperSeedPeer {
+	local, remote := net.Pipe()
+	peer := models.NewPeer(local, models.PeerAddress{IP: net.IPv4(192, 0, 2, 1), Port: 6881}, uploader.manifest.PieceCount())
+	for _, index := range pieces {
+		peer.MarkPiece(index)
+	}
+	peer.SetChoked(false)
+	peer.Start()
+	t.Cleanup(func() {
+		peer.Close()
+		remote.Close()
+	})
+
+	queue := uploader.NewQueue(peer)
+	go queue.Run()
+	return &testSuperSeedPeer{queue: queue, peer: peer, remote: remote}
+}
+
+// has tells the uploader about a have message of the peer
+func (peer *testSuperSeedPeer) has(index int) {
+	peer.peer.MarkPiece(index)
+	peer.queue.PeerHas(index)
+}
+
+// readOffer returns the piece of the next have message the peer receives
+func (peer *testSuperSeedPeer) readOffer(t *testing.T) int {
+	t.Helper()
+	peer.remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message, err := models.ReadMessage(peer.remote)
+	if err != nil {
+		t.Fatal("no offer,", err)
+	}
+	if message.Type != models.MsgTypeHave {
+		t.Fatalf("got %v instead of an offer", message.Type)
+	}
+	return int(binary.BigEndian.Uint32(message.Payload))
+}
+
+// expectNothing fails if the peer receives a message
+func (peer *testSuperSeedPeer) expectNothing(t *testing.T) {
+	t.Helper()
+	peer.remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if message, err := models.ReadMessage(peer.remote); err == nil {
+		if message.Type == models.MsgTypeHave {
+			t.Fatalf("unexpected offer of piece %v", binary.BigEndian.Uint32(message.Payload))
+		}
+		t.Fatalf("unexpected %v", message.Type)
+	}
+}
+
+func TestSuperSeedInitialOffers(t *testing.T) {
+	uploader := newSuperSeedUploader(t)
+
+	// Every peer is shown one piece, the least offered one
+	first := connectSuperSeedPeer(t, uploader)
+	if offer := first.readOffer(t); offer != 0 {
+		t.Errorf("first peer offered %v", offer)
+	}
+	first.expectNothing(t)
+	second := connectSuperSeedPeer(t, uploader)
+	if offer := second.readOffer(t); offer != 1 {
+		t.Errorf("second peer offered %v", offer)
+	}
+	second.expectNothing(t)
+
+	// Only the offered piece is served
+	first.queue.Add(requestMessage(1, 0, 16384))
+	first.expectNothing(t)
+	first.queue.Add(requestMessage(0, 0, 16384))
+	first.remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message, err := models.ReadMessage(first.remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Type != models.MsgTypePiece || binary.BigEndian.Uint32(message.Payload) != 0 {
+		t.Errorf("got %v instead of piece 0", message.Type)
+	}
+}
+
+func TestSuperSeedRevealsAfterSpread(t *testing.T) {
+	uploader := newSuperSeedUploader(t)
+	first := connectSuperSeedPeer(t, uploader)
+	first.readOffer(t)
+	second := connectSuperSeedPeer(t, uploader)
+	second.readOffer(t)
+
+	// Downloading its offer isn't enough, the piece has to reach another
+	// peer
+	first.has(0)
+	first.expectNothing(t)
+
+	// Piece 0 spread, the first peer gets the piece nobody has and that was
+	// offered the least
+	second.has(0)
+	if offer := first.readOffer(t); offer != 2 {
+		t.Errorf("first peer offered %v after its piece spread", offer)
+	}
+	second.expectNothing(t)
+
+	// Pieces revealed before stay requestable
+	if !uploader.superSeeder.revealed(first.peer, 0) || !uploader.superSeeder.revealed(first.peer, 2) {
+		t.Error("revealed pieces hidden again")
+	}
+	if uploader.superSeeder.revealed(second.peer, 0) {
+		t.Error("piece revealed to a peer it wasn't offered to")
+	}
+}
+
+func TestSuperSeedSinglePeer(t *testing.T) {
+	uploader := newSuperSeedUploader(t)
+	only := connectSuperSeedPeer(t, uploader)
+
+	// With nobody to spread to, every downloaded offer gets the next piece
+	for want := 0; want < 4; want++ {
+		offer := only.readOffer(t)
+		if offer != want {
+			t.Errorf("offered %v, want %v", offer, want)
+		}
+		only.has(offer)
+	}
+	only.expectNothing(t)
+}
+
+func TestSuperSeedPeersWithPieces(t *testing.T) {
+	uploader := newSuperSeedUploader(t)
+
+	// Pieces the peer has aren't offered
+	seeder := connectSuperSeedPeer(t, uploader, 0, 1)
+	if offer := seeder.readOffer(t); offer != 2 {
+		t.Errorf("peer with pieces 0 and 1 offered %v", offer)
+	}
+
+	// The rarest piece comes first, 0 and 1 are at the other peer
+	newcomer := connectSuperSeedPeer(t, uploader)
+	if offer := newcomer.readOffer(t); offer != 3 {
+		t.Errorf("new peer offered %v", offer)
+	}
+
+	// A bitfield arriving with the offer gets another one
+	newcomer.peer.SetBitField(models.Bitfield{0x10})
+	newcomer.queue.PeerBitField()
+	if offer := newcomer.readOffer(t); offer != 2 {
+		t.Errorf("new peer offered %v after its bitfield", offer)
+	}
+
+	// A bitfield without the offer changes nothing
+	newcomer.peer.SetBitField(models.Bitfield{0x10 | 0x80})
+	newcomer.queue.PeerBitField()
+	newcomer.expectNothing(t)
+
+	// Peers having everything are offered nothing
+	complete := connectSuperSeedPeer(t, uploader, 0, 1, 2, 3)
+	complete.expectNothing(t)
+}
@@ -0,0 +1,158 @@
+package seed
+
+import (
+	"fmt"
+	"sync"
+	"torrentClient/models"
+)
+
+// queuedRequest is a block or hash request waiting to be served
+type queuedRequest struct {
+	message *models.Message
+	request models.RequestMessage
+}
+
+// UploadQueue holds the requests of a peer until they are served, one at a
+// time and in order. Cancelled requests are removed before they are read
+// from disk. A block is only read once the previous one is written to the
+// connection, so a peer not reading its data holds at most two blocks.
+type UploadQueue struct {
+	uploader *Uploader
+	peer     *models.Peer
+	mutex    sync.Mutex
+	requests []queuedRequest
+	wake     chan struct{}
+}
+
+func (uploader *Uploader) NewQueue(peer *models.Peer) *UploadQueue {
+	return &UploadQueue{
+		uploader: uploader,
+		peer:     peer,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Add queues a request of the peer, invalid requests, requests of a choked
+// peer and requests past MaxQueuedRequests are dropped
+func (queue *UploadQueue) Add(message *models.Message) {
+	queued := queuedRequest{message: message}
+
+	if message.Type == models.MsgTypeRequest {
+		// Requests of choked peers are discarded (BEP 3), answering each
+		// with a choke would flood peers pipelining requests
+		if queue.peer.IsChoked() {
+			return
+		}
+
+		request, err := models.ReadRequestMessage(message.Payload)
+		if err != nil {
+			fmt.Printf("Error reading request message from peer %v, %v\n", queue.peer.Address, err)
+			return
+		}
+		err = queue.uploader.checkRequest(queue.peer, request)
+		if err != nil {
+			fmt.Printf("Received request message from peer %v with %v\n", queue.peer.Address, err)
+			return
+		}
+		queued.request = request
+	}
+
+	queue.mutex.Lock()
+	if len(queue.requests) >= MaxQueuedRequests {
+		queue.mutex.Unlock()
+		fmt.Printf("Dropping request from peer %v, too many queued requests\n", queue.peer.Address)
+		return
+	}
+	queue.requests = append(queue.requests, queued)
+	queue.mutex.Unlock()
+
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel removes a queued block request, blocks already sent can't be
+// cancelled
+func (queue *UploadQueue) Cancel(payload []byte) {
+	cancel, err := models.ReadRequestMessage(payload)
+	if err != nil {
+		fmt.Printf("Error reading cancel message from peer %v, %v\n", queue.peer.Address, err)
+		return
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for i, queued := range queue.requests {
+		if queued.message.Type == models.MsgTypeRequest && queued.request == cancel {
+			queue.requests = append(queue.requests[:i], queue.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+func (queue *UploadQueue) pop() (queuedRequest, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if len(queue.requests) == 0 {
+		return queuedRequest{}, false
+	}
+	queued := queue.requests[0]
+	queue.requests = queue.requests[1:]
+	return queued, true
+}
+
+// PeerHas tells the super seeder about a have message of the peer
+func (queue *UploadQueue) PeerHas(index int) {
+	if queue.uploader.superSeeder != nil {
+		queue.uploader.superSeeder.peerHas(queue.peer, index)
+	}
+}
+
+// PeerBitField tells the super seeder about a bitfield message of the peer
+func (queue *UploadQueue) PeerBitField() {
+	if queue.uploader.superSeeder != nil {
+		queue.uploader.superSeeder.peerBitField(queue.peer)
+	}
+}
+
+// Run serves the queued requests until the connection closes
+func (queue *UploadQueue) Run() {
+	if superSeeder := queue.uploader.superSeeder; superSeeder != nil {
+		superSeeder.addPeer(queue.peer)
+		defer superSeeder.removePeer(queue.peer)
+	}
+
+	// written is closed once the last block sent is written
+	var written <-chan struct{}
+	for {
+		select {
+		case <-queue.wake:
+		case <-queue.peer.Done():
+			return
+		}
+
+		for queued, ok := queue.pop(); ok; queued, ok = queue.pop() {
+			if queued.message.Type == models.MsgTypeHashRequest {
+				HandleHashRequest(&SeedRequest{Peer: queue.peer, Message: queued.message}, queue.uploader.manifest)
+				continue
+			}
+
+			if written != nil {
+				select {
+				case <-written:
+				case <-queue.peer.Done():
+					return
+				}
+			}
+
+			// Requests are dropped once the peer is choked
+			if queue.peer.IsChoked() {
+				continue
+			}
+			written = queue.uploader.serve(queue.peer, queued.request)
+		}
+	}
+}
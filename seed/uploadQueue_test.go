@@ -0,0 +1,136 @@
+package seed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+	"torrentClient/models"
+	"torrentClient/picker"
+	"torrentClient/storage"
+	"torrentClient/torrenttest"
+)
+
+// newTestQueue returns the upload queue of a peer connected through a pipe to
+// remote, the torrent is fully downloaded
+func newTestQueue(t *testing.T) (*UploadQueue, *models.Peer, net.Conn, []byte) {
+	torrent := torrenttest.SingleFile(t, "data.bin", 40000, 16384)
+	manifest := torrent.Manifest
+	data := torrent.Data
+
+	store, err := storage.Open(&manifest, filepath.Join(t.TempDir(), "download"), storage.AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, err := store.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	have := torrent.Complete()
+	uploader, err := NewUploader(store, picker.New(&manifest, &have), &manifest, &models.Stats{}, DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	peer := models.NewPeer(local, models.PeerAddress{IP: net.IPv4(192, 0, 2, 1), Port: 6881}, manifest.PieceCount())
+	peer.Start()
+	t.Cleanup(func() {
+		peer.Close()
+		remote.Close()
+	})
+
+	queue := uploader.NewQueue(peer)
+	go queue.Run()
+	return queue, peer, remote, data
+}
+
+func requestMessage(index int, begin int, length int) *models.Message {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(begin))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(length))
+	return &models.Message{Type: models.MsgTypeRequest, Payload: payload}
+}
+
+func TestUploadQueueDropsRequestsOfChokedPeers(t *testing.T) {
+	queue, peer, remote, data := newTestQueue(t)
+
+	// A choked peer pipelining requests gets nothing back, not even chokes
+	for i := 0; i < 100; i++ {
+		queue.Add(requestMessage(0, 0, 16384))
+	}
+	remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if message, err := models.ReadMessage(remote); err == nil {
+		t.Fatalf("choked peer was sent %v", message.Type)
+	}
+
+	peer.SetChoked(false)
+	queue.Add(requestMessage(1, 100, 1000))
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message, err := models.ReadMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Type != models.MsgTypePiece || !bytes.Equal(message.Payload[8:], data[16384+100:16384+1100]) {
+		t.Errorf("got %v of %v bytes", message.Type, len(message.Payload))
+	}
+}
+
+func TestUploadQueueDropsInvalidRequests(t *testing.T) {
+	queue, peer, remote, data := newTestQueue(t)
+	peer.SetChoked(false)
+
+	invalid := []*models.Message{
+		requestMessage(3, 0, 100),
+		requestMessage(0, 0, DefaultBlockSize+1),
+		requestMessage(2, 7000, 1000),
+		{Type: models.MsgTypeRequest, Payload: []byte{0, 0}},
+	}
+	for _, message := range invalid {
+		queue.Add(message)
+	}
+	queue.Add(requestMessage(2, 0, 7232))
+
+	// Only the last, valid, request is answered
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message, err := models.ReadMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Type != models.MsgTypePiece || binary.BigEndian.Uint32(message.Payload) != 2 || !bytes.Equal(message.Payload[8:], data[32768:]) {
+		t.Errorf("got %v of %v bytes", message.Type, len(message.Payload))
+	}
+}
+
+func TestUploadQueueWaitsForSlowReaders(t *testing.T) {
+	queue, peer, remote, _ := newTestQueue(t)
+	peer.SetChoked(false)
+
+	// The remote side reads nothing, only the block being written is read
+	// from disk
+	const requests = 50
+	for i := 0; i < requests; i++ {
+		queue.Add(requestMessage(i%2, 0, 16384))
+	}
+	time.Sleep(200 * time.Millisecond)
+	if uploaded := queue.uploader.stats.Uploaded(); uploaded != 16384 {
+		t.Fatalf("%v bytes read for a stalled peer", uploaded)
+	}
+
+	// Each block read lets the next one through
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < requests; i++ {
+		message, err := models.ReadMessage(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Type != models.MsgTypePiece {
+			t.Fatalf("got %v", message.Type)
+		}
+	}
+	if uploaded := queue.uploader.stats.Uploaded(); uploaded != requests*16384 {
+		t.Errorf("%v bytes uploaded", uploaded)
+	}
+}
@@ -0,0 +1,96 @@
+package seed
+
+import (
+	"errors"
+	"fmt"
+	"torrentClient/common"
+	"torrentClient/models"
+	"torrentClient/picker"
+	"torrentClient/storage"
+)
+
+const (
+	// Bounds of the largest block a peer may request, peers normally
+	// request 16 KiB blocks
+	MinBlockSize     = 16 * 1024
+	MaxBlockSize     = 128 * 1024
+	DefaultBlockSize = MaxBlockSize
+	// Requests a peer may have waiting, further requests are dropped
+	MaxQueuedRequests = 250
+)
+
+// Uploader serves the requests of every connection of a torrent
+type Uploader struct {
+	store        *storage.Storage
+	piecePicker  *picker.Picker
+	manifest     *models.Manifest
+	stats        *models.Stats
+	maxBlockSize int
+	superSeeder  *SuperSeeder
+}
+
+func NewUploader(store *storage.Storage, piecePicker *picker.Picker, manifest *models.Manifest, stats *models.Stats, maxBlockSize int) (*Uploader, error) {
+	if maxBlockSize < MinBlockSize || maxBlockSize > MaxBlockSize {
+		return nil, fmt.Errorf("max block size must be between %v and %v", MinBlockSize, MaxBlockSize)
+	}
+
+	return &Uploader{
+		store:        store,
+		piecePicker:  piecePicker,
+		manifest:     manifest,
+		stats:        stats,
+		maxBlockSize: maxBlockSize,
+	}, nil
+}
+
+// EnableSuperSeeding hides our pieces from new connections, it has to be
+// called before any connection starts
+func (uploader *Uploader) EnableSuperSeeding() {
+	uploader.superSeeder = newSuperSeeder(uploader.manifest, uploader.piecePicker)
+}
+
+// SuperSeeding reports whether our bitfield is hidden from the peers
+func (uploader *Uploader) SuperSeeding() bool {
+	return uploader.superSeeder != nil
+}
+
+// checkRequest rejects requests for blocks we don't have or that don't fit
+// inside their piece
+func (uploader *Uploader) checkRequest(peer *models.Peer, request models.RequestMessage) error {
+	if request.PieceIndex < 0 || request.PieceIndex >= uploader.manifest.PieceCount() || !uploader.piecePicker.Has(request.PieceIndex) {
+		return errors.New("invalid index " + fmt.Sprint(request.PieceIndex))
+	}
+
+	if uploader.superSeeder != nil && !uploader.superSeeder.revealed(peer, request.PieceIndex) {
+		return errors.New("hidden index " + fmt.Sprint(request.PieceIndex))
+	}
+
+	if request.Length <= 0 || request.Length > uploader.maxBlockSize {
+		return errors.New("invalid length " + fmt.Sprint(request.Length))
+	}
+
+	pieceLength := common.GetPieceLength(request.PieceIndex, int(uploader.manifest.PieceLength), int(uploader.manifest.Length))
+	if request.Begin < 0 || request.Begin+request.Length > pieceLength {
+		return errors.New("invalid begin " + fmt.Sprint(request.Begin))
+	}
+
+	return nil
+}
+
+// serve sends a requested block to the peer, the returned channel is closed
+// once the block is written to the connection. Nil is returned when nothing
+// was sent.
+func (uploader *Uploader) serve(peer *models.Peer, request models.RequestMessage) <-chan struct{} {
+	block, err := uploader.store.ReadBlock(request.PieceIndex, request.Begin, request.Length)
+	if err != nil {
+		fmt.Printf("Error reading block from storage %v\n", err)
+		return nil
+	}
+
+	written, err := peer.SendWritten(*common.WritePieceMessage(request.PieceIndex, request.Begin, block))
+	if err != nil {
+		return nil
+	}
+	uploader.stats.AddUploaded(len(block))
+	return written
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"torrentClient/common"
+	"torrentClient/models"
+	"torrentClient/storage"
+)
+
+// How often the seeding limits are checked
+const seedLimitInterval = 10 * time.Second
+
+// verifyPieces hashes every piece of the files on disk and returns the pieces
+// that are complete and valid
+func verifyPieces(manifest *models.Manifest, store *storage.Storage) models.Bitfield {
+	verified := make(models.Bitfield, (manifest.PieceCount()+7)/8)
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				piece, err := store.ReadBlock(index, 0, common.GetPieceLength(index, int(manifest.PieceLength), int(manifest.Length)))
+				if err != nil || !common.CheckPiece(manifest, index, piece) {
+					continue
+				}
+				mutex.Lock()
+				verified.MarkPiece(index)
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for index := 0; index < manifest.PieceCount(); index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	return verified
+}
+
+// seedUntil stops the client once we uploaded ratio times the torrent's size
+// or seeded for seedTime, zero disables a limit. The limits only apply while
+// finished reports every wanted file downloaded, the seed time starts over
+// when the download resumes.
+func seedUntil(ctx context.Context, stop func(), stats *models.Stats, manifest *models.Manifest, finished func() bool, ratio float64, seedTime time.Duration) {
+	if ratio <= 0 && seedTime <= 0 {
+		return
+	}
+
+	var started time.Time
+	ticker := time.NewTicker(seedLimitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if !finished() {
+			started = time.Time{}
+			continue
+		}
+		if started.IsZero() {
+			started = time.Now()
+		}
+
+		uploadRatio := float64(stats.Uploaded()) / float64(manifest.Length)
+		if ratio > 0 && uploadRatio >= ratio {
+			fmt.Printf("Reached ratio %.2f, stopping\n", uploadRatio)
+			stop()
+			return
+		}
+		if seedTime > 0 && time.Since(started) >= seedTime {
+			fmt.Printf("Seeded for %v, stopping\n", seedTime)
+			stop()
+			return
+		}
+	}
+}
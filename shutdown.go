@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"torrentClient/common"
+	"torrentClient/models"
+	"torrentClient/storage"
+)
+
+const (
+	// The whole shutdown gives up after this long
+	shutdownTimeout = 10 * time.Second
+	// Trackers get this long to acknowledge the stopped announce
+	stoppedAnnounceTimeout = 5 * time.Second
+)
+
+// shutdown tells the trackers we left and flushes the downloaded data and the
+// progress to disk, giving up after shutdownTimeout
+func shutdown(network *common.Network, manifest models.Manifest, id [20]byte, announce common.Announce, store *storage.Storage, currentBitField *models.Bitfield, httpServer *http.Server) {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if httpServer != nil {
+			httpServer.Close()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+		common.AnnounceStopped(ctx, network, manifest, id, common.Port, announce)
+		cancel()
+
+		if err := store.SaveProgress(*currentBitField); err != nil {
+			fmt.Println("Can't save progress", err)
+		}
+		if err := store.Sync(); err != nil {
+			fmt.Println("Can't flush downloaded data", err)
+		}
+		if err := store.Close(); err != nil {
+			fmt.Println("Can't close files", err)
+		}
+	}()
+
+	select {
+	case <-done:
+		fmt.Println("Shutdown complete")
+	case <-time.After(shutdownTimeout):
+		fmt.Println("Shutdown timed out")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type AllocationMode int
+
+const (
+	// AllocateNone lets files grow as pieces are written
+	AllocateNone AllocationMode = iota
+	// AllocateSparse sizes files up front without reserving disk blocks
+	AllocateSparse
+	// AllocateFull reserves every disk block of the file up front
+	AllocateFull
+)
+
+func (mode AllocationMode) String() string {
+	switch mode {
+	case AllocateNone:
+		return "none"
+	case AllocateSparse:
+		return "sparse"
+	case AllocateFull:
+		return "full"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseAllocationMode(value string) (AllocationMode, error) {
+	switch strings.ToLower(value) {
+	case "none":
+		return AllocateNone, nil
+	case "sparse":
+		return AllocateSparse, nil
+	case "full":
+		return AllocateFull, nil
+	}
+	return AllocateNone, errors.New("invalid allocation mode '" + value + "', expected none, sparse or full")
+}
+
+func allocateFile(file *os.File, length int64, mode AllocationMode) error {
+	switch mode {
+	case AllocateSparse:
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() >= length {
+			return nil
+		}
+		return file.Truncate(length)
+	case AllocateFull:
+		return preallocate(file, length)
+	}
+	return nil
+}
+
+// zeroBlockSize is the granularity holes are looked for at, no smaller than
+// the blocks of common filesystems
+const zeroBlockSize = 4096
+
+// writeZeros allocates the file up to the given length by writing zeros over
+// every block still reading as zeros, the data already written is kept. Holes
+// of sparse files read as zeros, so they are filled too.
+func writeZeros(file *os.File, length int64) error {
+	chunk := make([]byte, 1<<20)
+	zeros := make([]byte, len(chunk))
+	for offset := int64(0); offset < length; offset += int64(len(chunk)) {
+		if length-offset < int64(len(chunk)) {
+			chunk = chunk[:length-offset]
+		}
+		n, err := file.ReadAt(chunk, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// Past the end of the file reads as zeros too
+		copy(chunk[n:], zeros)
+
+		// Write the runs of zero blocks, leaving the blocks with data
+		run := -1
+		for block := 0; block < len(chunk); block += zeroBlockSize {
+			end := block + zeroBlockSize
+			if end > len(chunk) {
+				end = len(chunk)
+			}
+			zero := bytes.Equal(chunk[block:end], zeros[:end-block])
+			if zero && run == -1 {
+				run = block
+			}
+			if !zero && run != -1 {
+				if _, err := file.WriteAt(zeros[:block-run], offset+int64(run)); err != nil {
+					return err
+				}
+				run = -1
+			}
+		}
+		if run != -1 {
+			if _, err := file.WriteAt(zeros[:len(chunk)-run], offset+int64(run)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// missingBytes returns how many more bytes of disk the file needs once every
+// piece of it is written
+func missingBytes(filePath string, length int64) int64 {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return length
+	}
+	allocated := allocatedSize(info)
+	if allocated >= length {
+		return 0
+	}
+	return length - allocated
+}
+
+func checkDiskSpace(dir string, needed int64) error {
+	if needed <= 0 {
+		return nil
+	}
+
+	// Walk up to the closest directory that already exists
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	available, ok := availableSpace(dir)
+	if !ok {
+		return nil
+	}
+	if available < needed {
+		return fmt.Errorf("not enough disk space in %v, need %v bytes but only %v are available", dir, needed, available)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+func preallocate(file *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, length)
+	// Not every filesystem supports fallocate
+	if err == syscall.EOPNOTSUPP {
+		return writeZeros(file, length)
+	}
+	return err
+}
+
+func allocatedSize(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
+
+func availableSpace(dir string) (int64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import "os"
+
+func preallocate(file *os.File, length int64) error {
+	return writeZeros(file, length)
+}
+
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+// availableSpace is unknown here, the disk space check is skipped
+func availableSpace(dir string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteZerosFillsSparseFile(t *testing.T) {
+	const length = 3<<20 + 123
+	file, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// A file sized by sparse allocation with a few pieces written
+	err = file.Truncate(length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := map[int64][]byte{
+		0:             bytes.Repeat([]byte{1}, 100),
+		1<<20 - 50:    bytes.Repeat([]byte{2}, 100),
+		2<<20 + 10000: bytes.Repeat([]byte{3}, 5000),
+		length - 10:   bytes.Repeat([]byte{4}, 10),
+	}
+	for offset, data := range written {
+		if _, err := file.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = writeZeros(file, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != length {
+		t.Errorf("size %v, want %v", info.Size(), length)
+	}
+	if allocated := allocatedSize(info); allocated < length {
+		t.Errorf("only %v of %v bytes allocated", allocated, length)
+	}
+	for offset, data := range written {
+		got := make([]byte, len(data))
+		if _, err := file.ReadAt(got, offset); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("data at %v lost, %v", offset, err)
+		}
+	}
+}
+
+func TestWriteZerosExtendsFile(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "short"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	err = writeZeros(file, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 10000 || string(content[:4]) != "data" || bytes.Count(content[4:], []byte{0}) != 9996 {
+		t.Errorf("got %v bytes starting with %q", len(content), content[:4])
+	}
+}
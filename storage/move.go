@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Dir returns the directory the torrent's files are stored in
+func (storage *Storage) Dir() string {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	return storage.dir
+}
+
+// Move relocates the torrent's files and progress to another directory,
+// possibly on another filesystem. Reads and writes wait until the move is
+// over and when any file fails to move the files already moved are put back.
+// When they can't be put back every later read and write fails.
+func (storage *Storage) Move(dir string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.failed != nil {
+		return storage.failed
+	}
+	if filepath.Clean(dir) == filepath.Clean(storage.dir) {
+		return nil
+	}
+
+	oldDir := storage.dir
+	hadParts := storage.parts != nil
+	hadProgress := storage.progress != nil
+	open := []int{}
+	for i, file := range storage.files {
+		if file != nil {
+			open = append(open, i)
+		}
+	}
+
+	err := storage.closeFiles()
+	if err != nil {
+		if reopenErr := storage.reopenFiles(open, hadParts, hadProgress); reopenErr != nil {
+			return storage.fail(reopenErr)
+		}
+		return err
+	}
+
+	sources := []string{}
+	for _, i := range open {
+		sources = append(sources, filepath.FromSlash(storage.manifest.FileInfos[i].Path))
+	}
+	if hadParts {
+		sources = append(sources, storage.relativePartsPath())
+	}
+	if hadProgress {
+		sources = append(sources, storage.relativeProgressPath())
+	}
+
+	moved := []string{}
+	for _, source := range sources {
+		err = moveFile(filepath.Join(oldDir, source), filepath.Join(dir, source))
+		if err != nil {
+			err = fmt.Errorf("can't move %v to %v: %w", source, dir, err)
+			break
+		}
+		moved = append(moved, source)
+	}
+
+	if err != nil {
+		rollbackFailed := false
+		for i := len(moved) - 1; i >= 0; i-- {
+			rollbackErr := moveFile(filepath.Join(dir, moved[i]), filepath.Join(oldDir, moved[i]))
+			if rollbackErr != nil {
+				fmt.Printf("Can't move %v back to %v, %v\n", moved[i], oldDir, rollbackErr)
+				rollbackFailed = true
+			}
+		}
+		removeEmptyDirs(dir, moved)
+		if rollbackFailed {
+			return storage.fail(fmt.Errorf("%w, moving the files back failed too and they are split between %v and %v", err, oldDir, dir))
+		}
+		if reopenErr := storage.reopenFiles(open, hadParts, hadProgress); reopenErr != nil {
+			return storage.fail(reopenErr)
+		}
+		return err
+	}
+
+	storage.dir = dir
+	removeEmptyDirs(oldDir, moved)
+	if err = storage.reopenFiles(open, hadParts, hadProgress); err != nil {
+		return storage.fail(err)
+	}
+	return nil
+}
+
+// fail stops every later read and write of the storage, the pieces marked
+// downloaded can't be trusted to be on disk anymore
+func (storage *Storage) fail(err error) error {
+	storage.failed = fmt.Errorf("storage failed, %w", err)
+	return storage.failed
+}
+
+func (storage *Storage) relativePartsPath() string {
+	return filepath.Join(storage.manifest.Name, "."+storage.manifest.Name+".parts")
+}
+
+func (storage *Storage) closeFiles() error {
+	var firstErr error
+	for i, file := range storage.files {
+		if file == nil {
+			continue
+		}
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		storage.files[i] = nil
+	}
+	if storage.parts != nil {
+		if err := storage.parts.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		storage.parts = nil
+	}
+	if storage.progress != nil {
+		if err := storage.progress.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		storage.progress = nil
+	}
+	return firstErr
+}
+
+// reopenFiles opens the files closed for a move, they must exist, creating
+// them would turn the missing data into zeros
+func (storage *Storage) reopenFiles(open []int, parts bool, progress bool) error {
+	var firstErr error
+	for _, i := range open {
+		file, err := os.OpenFile(storage.filePath(i), os.O_RDWR, 0)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		storage.files[i] = file
+	}
+	if parts {
+		file, err := os.OpenFile(storage.partsPath(), os.O_RDWR, 0)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		storage.parts = file
+	}
+	if progress {
+		file, err := os.OpenFile(storage.progressPath(), os.O_RDWR, 0)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		storage.progress = file
+	}
+	return firstErr
+}
+
+// moveFile renames the file and falls back to copying it when the
+// destination is on another filesystem
+func moveFile(source string, destination string) error {
+	if _, err := os.Stat(destination); err == nil {
+		return errors.New("destination " + destination + " already exists")
+	}
+
+	err := os.MkdirAll(filepath.Dir(destination), 0700)
+	if err != nil {
+		return err
+	}
+
+	if os.Rename(source, destination) == nil {
+		return nil
+	}
+
+	err = copyFile(source, destination)
+	if err != nil {
+		os.Remove(destination)
+		return err
+	}
+	return os.Remove(source)
+}
+
+func copyFile(source string, destination string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destinationFile, err := os.OpenFile(destination, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destinationFile, sourceFile)
+	if err == nil {
+		err = destinationFile.Sync()
+	}
+	if closeErr := destinationFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeEmptyDirs removes the directories left empty after moving the files
+// out of them
+func removeEmptyDirs(root string, files []string) {
+	for _, file := range files {
+		for dir := filepath.Dir(file); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+			if os.Remove(filepath.Join(root, dir)) != nil {
+				break
+			}
+		}
+	}
+}
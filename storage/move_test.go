@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"torrentClient/models"
+	"torrentClient/torrenttest"
+)
+
+// newMoveStorage returns a storage of three files with the middle one
+// skipped, so it has a parts file, and with progress saved
+func newMoveStorage(t *testing.T) (*Storage, *torrenttest.Torrent, *models.Bitfield) {
+	torrent := torrenttest.MultiFile(t, "files", 16384,
+		torrenttest.File{Path: "a", Length: 10000},
+		torrenttest.File{Path: "b", Length: 60000},
+		torrenttest.File{Path: "sub/c", Length: 10000},
+	)
+	manifest := torrent.Manifest
+	manifest.FileInfos[1].Priority = models.PrioritySkip
+
+	store, err := Open(&manifest, filepath.Join(t.TempDir(), "old"), AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	progress, err := store.LoadProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []int{0, 4} {
+		if err := store.WritePiece(index, torrent.Piece(index)); err != nil {
+			t.Fatal(err)
+		}
+		progress.MarkPiece(index)
+	}
+	if err := store.SaveProgress(*progress); err != nil {
+		t.Fatal(err)
+	}
+	return store, torrent, progress
+}
+
+// checkPieces fails unless the stored pieces read back intact
+func checkPieces(t *testing.T, store *Storage, torrent *torrenttest.Torrent) {
+	t.Helper()
+	for _, index := range []int{0, 4} {
+		piece := torrent.Piece(index)
+		block, err := store.ReadBlock(index, 0, len(piece))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(block, piece) {
+			t.Errorf("piece %v differs", index)
+		}
+	}
+}
+
+// relativePaths lists the files under dir
+func relativePaths(t *testing.T, dir string) []string {
+	t.Helper()
+	paths := []string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			relative, _ := filepath.Rel(dir, path)
+			paths = append(paths, filepath.ToSlash(relative))
+		}
+		return nil
+	})
+	return paths
+}
+
+func TestMove(t *testing.T) {
+	store, torrent, progress := newMoveStorage(t)
+	oldDir := store.Dir()
+	newDir := filepath.Join(t.TempDir(), "new", "nested")
+
+	err := store.Move(newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Dir() != newDir {
+		t.Errorf("storage is in %v", store.Dir())
+	}
+	want := ".files.bitfield files/.files.parts files/a files/sub/c"
+	if got := strings.Join(relativePaths(t, newDir), " "); got != want {
+		t.Errorf("moved %v, want %v", got, want)
+	}
+	if _, err := os.Stat(oldDir); err != nil {
+		t.Errorf("the storage directory itself is removed, %v", err)
+	}
+	if left := relativePaths(t, oldDir); len(left) != 0 {
+		t.Errorf("%v left behind", left)
+	}
+	if _, err := os.Stat(filepath.Join(oldDir, "files")); !os.IsNotExist(err) {
+		t.Error("emptied torrent directory left behind")
+	}
+	checkPieces(t, store, torrent)
+
+	// Writes and progress go to the new directory
+	if err := store.WritePiece(2, torrent.Piece(2)); err != nil {
+		t.Fatal(err)
+	}
+	progress.MarkPiece(2)
+	if err := store.SaveProgress(*progress); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(filepath.Join(newDir, ".files.bitfield"))
+	if err != nil || !bytes.Equal(saved, *progress) {
+		t.Errorf("saved progress %v, %v", saved, err)
+	}
+
+	// Moving to the same directory does nothing
+	if err := store.Move(newDir + string(filepath.Separator)); err != nil {
+		t.Error(err)
+	}
+	checkPieces(t, store, torrent)
+}
+
+func TestMoveRollsBack(t *testing.T) {
+	store, torrent, _ := newMoveStorage(t)
+	oldDir := store.Dir()
+	before := strings.Join(relativePaths(t, oldDir), " ")
+
+	// The second file can't be moved, the first is put back
+	newDir := filepath.Join(t.TempDir(), "new")
+	conflict := filepath.Join(newDir, "files", "sub", "c")
+	if err := os.MkdirAll(filepath.Dir(conflict), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(conflict, []byte("someone else's"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := store.Move(newDir)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("move onto an existing file, %v", err)
+	}
+	if store.Dir() != oldDir {
+		t.Errorf("storage is in %v", store.Dir())
+	}
+	if after := strings.Join(relativePaths(t, oldDir), " "); after != before {
+		t.Errorf("%v after the rollback, %v before", after, before)
+	}
+	if got := strings.Join(relativePaths(t, newDir), " "); got != "files/sub/c" {
+		t.Errorf("%v left in the destination", got)
+	}
+	if data, _ := os.ReadFile(conflict); string(data) != "someone else's" {
+		t.Error("existing file overwritten")
+	}
+
+	// The storage still works where it was
+	checkPieces(t, store, torrent)
+	if err := store.WritePiece(2, torrent.Piece(2)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMoveFails(t *testing.T) {
+	store, torrent, _ := newMoveStorage(t)
+	oldDir := store.Dir()
+
+	// No directory can be made below a file
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Move(filepath.Join(blocker, "new")); err == nil {
+		t.Fatal("moved below a file")
+	}
+	if store.Dir() != oldDir {
+		t.Errorf("storage is in %v", store.Dir())
+	}
+	checkPieces(t, store, torrent)
+}
+
+func TestLoadProgress(t *testing.T) {
+	store, _, progress := newMoveStorage(t)
+	store.Close()
+
+	// Progress saved before is loaded again
+	reopened, err := Open(store.manifest, store.Dir(), AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	loaded, err := reopened.LoadProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(*loaded, *progress) {
+		t.Errorf("loaded %v, saved %v", *loaded, *progress)
+	}
+
+	// A bitfield older versions left in the working directory is moved next
+	// to the files
+	workDir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(workDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	legacy := models.Bitfield{0x40}
+	if err := os.WriteFile("files.bitfield", legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := Open(store.manifest, filepath.Join(workDir, "downloads"), AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	loaded, err = fresh.LoadProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(*loaded, legacy) {
+		t.Errorf("loaded %v from the old location", *loaded)
+	}
+	if _, err := os.Stat("files.bitfield"); !os.IsNotExist(err) {
+		t.Error("old progress file left in place")
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "downloads", ".files.bitfield")); err != nil {
+		t.Error(err)
+	}
+}
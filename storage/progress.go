@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"torrentClient/models"
+)
+
+// relativeProgressPath is where the bitfield of the downloaded pieces is
+// kept, next to the torrent's files so it moves with them
+func (storage *Storage) relativeProgressPath() string {
+	return "." + storage.manifest.Name + ".bitfield"
+}
+
+func (storage *Storage) progressPath() string {
+	return filepath.Join(storage.dir, storage.relativeProgressPath())
+}
+
+// LoadProgress returns the bitfield of the pieces downloaded before, empty
+// for a new download. A bitfield left in the working directory by older
+// versions is moved into the storage directory.
+func (storage *Storage) LoadProgress() (*models.Bitfield, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.failed != nil {
+		return nil, storage.failed
+	}
+
+	// One bit per piece, as sent to peers in bitfield messages
+	bitfield := make(models.Bitfield, (storage.manifest.PieceCount()+7)/8)
+
+	progressPath := storage.progressPath()
+	legacyPath := storage.manifest.Name + ".bitfield"
+	if _, err := os.Stat(progressPath); os.IsNotExist(err) {
+		if _, err := os.Stat(legacyPath); err == nil {
+			err = moveFile(legacyPath, progressPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if storage.progress == nil {
+		progress, err := openFile(progressPath)
+		if err != nil {
+			return nil, err
+		}
+		storage.progress = progress
+	}
+
+	err := storage.progress.Truncate(int64(len(bitfield)))
+	if err != nil {
+		return nil, err
+	}
+	_, err = storage.progress.ReadAt(bitfield, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &bitfield, nil
+}
+
+// SaveProgress writes the bitfield of the downloaded pieces
+func (storage *Storage) SaveProgress(bitfield models.Bitfield) error {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	if storage.failed != nil {
+		return storage.failed
+	}
+	if storage.progress == nil {
+		return os.ErrClosed
+	}
+	_, err := storage.progress.WriteAt(bitfield, 0)
+	return err
+}
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"torrentClient/models"
+)
+
+// Storage maps the torrent's contiguous byte space onto the files of the
+// manifest. Data of skipped files that shares a piece with a wanted file is
+// kept in a sparse parts file until the file is wanted again. The bitfield of
+// the downloaded pieces is kept next to the files.
+type Storage struct {
+	mutex    sync.RWMutex
+	manifest *models.Manifest
+	dir      string
+	mode     AllocationMode
+	files    []*os.File
+	parts    *os.File
+	progress *os.File
+	// failed is set when the files on disk no longer match the pieces
+	// verified, every later read and write returns it
+	failed error
+}
+
+// Open creates the wanted files of the torrent inside dir, failing early when
+// the disk can't hold them
+func Open(manifest *models.Manifest, dir string, mode AllocationMode) (*Storage, error) {
+	storage := &Storage{
+		manifest: manifest,
+		dir:      dir,
+		mode:     mode,
+		files:    make([]*os.File, len(manifest.FileInfos)),
+	}
+
+	var needed int64
+	for i, file := range manifest.FileInfos {
+		if file.Priority != models.PrioritySkip {
+			needed += missingBytes(storage.filePath(i), file.Length)
+		}
+	}
+	err := checkDiskSpace(dir, needed)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, file := range manifest.FileInfos {
+		if file.Padding {
+			continue
+		}
+		filePath := storage.filePath(i)
+		_, err := os.Stat(filePath)
+		if file.Priority == models.PrioritySkip && os.IsNotExist(err) {
+			continue
+		}
+
+		storage.files[i], err = openFile(filePath)
+		if err == nil && file.Priority != models.PrioritySkip {
+			err = allocateFile(storage.files[i], file.Length, mode)
+		}
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+
+	return storage, nil
+}
+
+func openFile(filePath string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(filePath), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+func (storage *Storage) filePath(index int) string {
+	return filepath.Join(storage.dir, filepath.FromSlash(storage.manifest.FileInfos[index].Path))
+}
+
+func (storage *Storage) partsPath() string {
+	return filepath.Join(storage.dir, storage.relativePartsPath())
+}
+
+func (storage *Storage) openParts() (*os.File, error) {
+	if storage.parts != nil {
+		return storage.parts, nil
+	}
+	parts, err := openFile(storage.partsPath())
+	if err != nil {
+		return nil, err
+	}
+	storage.parts = parts
+	return parts, nil
+}
+
+// segment is the part of a read or write that falls inside a single file
+type segment struct {
+	file       int
+	fileOffset int64
+	start      int
+	end        int
+	padding    bool
+}
+
+func (storage *Storage) segments(length int, offset int64) []segment {
+	segments := []segment{}
+	for i := range storage.manifest.FileInfos {
+		file := &storage.manifest.FileInfos[i]
+		start := file.Offset
+		end := file.Offset + file.Length
+		if end <= offset || start >= offset+int64(length) {
+			continue
+		}
+		if start < offset {
+			start = offset
+		}
+		if end > offset+int64(length) {
+			end = offset + int64(length)
+		}
+		segments = append(segments, segment{
+			file:       i,
+			fileOffset: start - file.Offset,
+			start:      int(start - offset),
+			end:        int(end - offset),
+			padding:    file.Padding,
+		})
+	}
+	return segments
+}
+
+// WriteAt writes data at an offset of the torrent's byte space
+func (storage *Storage) WriteAt(data []byte, offset int64) (int, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.failed != nil {
+		return 0, storage.failed
+	}
+
+	written := 0
+	for _, seg := range storage.segments(len(data), offset) {
+		// Padding is always zeros, nothing to store
+		if seg.padding {
+			written += seg.end - seg.start
+			continue
+		}
+
+		var err error
+		if file := storage.files[seg.file]; file != nil {
+			_, err = file.WriteAt(data[seg.start:seg.end], seg.fileOffset)
+		} else {
+			var parts *os.File
+			parts, err = storage.openParts()
+			if err == nil {
+				_, err = parts.WriteAt(data[seg.start:seg.end], offset+int64(seg.start))
+			}
+		}
+		if err != nil {
+			return written, err
+		}
+		written += seg.end - seg.start
+	}
+	return written, nil
+}
+
+// ReadAt reads data from an offset of the torrent's byte space
+func (storage *Storage) ReadAt(data []byte, offset int64) (int, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	if storage.failed != nil {
+		return 0, storage.failed
+	}
+
+	read := 0
+	for _, seg := range storage.segments(len(data), offset) {
+		var err error
+		if seg.padding {
+			for i := seg.start; i < seg.end; i++ {
+				data[i] = 0
+			}
+		} else if file := storage.files[seg.file]; file != nil {
+			_, err = file.ReadAt(data[seg.start:seg.end], seg.fileOffset)
+		} else if storage.parts != nil {
+			_, err = storage.parts.ReadAt(data[seg.start:seg.end], offset+int64(seg.start))
+		} else {
+			err = io.EOF
+		}
+		// Files may be shorter than their length until they are complete,
+		// missing data reads as zeros
+		if err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return read, err
+		}
+		read += seg.end - seg.start
+	}
+	if read < len(data) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (storage *Storage) WritePiece(index int, data []byte) error {
+	_, err := storage.WriteAt(data, int64(index)*storage.manifest.PieceLength)
+	return err
+}
+
+func (storage *Storage) ReadBlock(index int, begin int, length int) ([]byte, error) {
+	block := make([]byte, length)
+	_, err := storage.ReadAt(block, int64(index)*storage.manifest.PieceLength+int64(begin))
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// SetFilePriority creates the file when it becomes wanted and moves its data
+// kept in the parts file into it
+func (storage *Storage) SetFilePriority(index int, priority models.FilePriority) error {
+	if index < 0 || index >= len(storage.files) {
+		return errors.New("invalid file index " + fmt.Sprint(index))
+	}
+	if storage.manifest.FileInfos[index].Padding {
+		return errors.New("file " + fmt.Sprint(index) + " is padding")
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.failed != nil {
+		return storage.failed
+	}
+	if priority == models.PrioritySkip || storage.files[index] != nil {
+		return nil
+	}
+
+	fileInfo := &storage.manifest.FileInfos[index]
+	filePath := storage.filePath(index)
+	err := checkDiskSpace(storage.dir, missingBytes(filePath, fileInfo.Length))
+	if err != nil {
+		return err
+	}
+
+	file, err := openFile(filePath)
+	if err != nil {
+		return err
+	}
+	storage.files[index] = file
+
+	err = allocateFile(file, fileInfo.Length, storage.mode)
+	if err != nil {
+		return err
+	}
+
+	if storage.parts == nil {
+		return nil
+	}
+
+	// Readahead and the boundary pieces of wanted neighbours may have stored
+	// any part of the file, copy all the parts file holds of it
+	buffer := make([]byte, storage.manifest.PieceLength)
+	for start := int64(0); start < fileInfo.Length; start += int64(len(buffer)) {
+		if fileInfo.Length-start < int64(len(buffer)) {
+			buffer = buffer[:fileInfo.Length-start]
+		}
+		n, err := storage.parts.ReadAt(buffer, fileInfo.Offset+start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		_, err = file.WriteAt(buffer[:n], start)
+		if err != nil {
+			return err
+		}
+		if n < len(buffer) {
+			break
+		}
+	}
+	return nil
+}
+
+func (storage *Storage) Close() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return storage.closeFiles()
+}
+
+// Sync flushes the written pieces to disk
+func (storage *Storage) Sync() error {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+
+	if storage.failed != nil {
+		return storage.failed
+	}
+
+	var firstErr error
+	for _, file := range append(storage.files, storage.parts, storage.progress) {
+		if file == nil {
+			continue
+		}
+		if err := file.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
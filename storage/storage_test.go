@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"torrentClient/models"
+	"torrentClient/torrenttest"
+)
+
+func TestSkippedFileDataMovesWhenWanted(t *testing.T) {
+	// The middle file covers pieces 0 to 4, pieces 1 to 3 lie inside it
+	torrent := torrenttest.MultiFile(t, "files", 16384,
+		torrenttest.File{Path: "a", Length: 10000},
+		torrenttest.File{Path: "b", Length: 60000},
+		torrenttest.File{Path: "c", Length: 10000},
+	)
+	manifest := torrent.Manifest
+	manifest.FileInfos[1].Priority = models.PrioritySkip
+
+	store, err := Open(&manifest, t.TempDir(), AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := os.Stat(store.filePath(1)); !os.IsNotExist(err) {
+		t.Fatal("skipped file created")
+	}
+
+	// Readahead stores a piece only the skipped file has, the boundary
+	// pieces are stored for the wanted files
+	for _, index := range []int{0, 1, 4} {
+		err := store.WritePiece(index, torrent.Piece(index))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest.FileInfos[1].Priority = models.PriorityNormal
+	err = store.SetFilePriority(1, models.PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, index := range []int{0, 1, 4} {
+		piece := torrent.Piece(index)
+		block, err := store.ReadBlock(index, 0, len(piece))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(block, piece) {
+			t.Errorf("piece %v differs after the file became wanted", index)
+		}
+	}
+
+	// The data is in the file itself
+	data, err := os.ReadFile(store.filePath(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := torrent.File(1)
+	pieceLength := int(manifest.PieceLength)
+	start := pieceLength - 10000
+	if !bytes.Equal(data[start:start+pieceLength], file[start:start+pieceLength]) {
+		t.Error("piece 1 isn't in the file")
+	}
+	// Pieces never stored stay empty
+	if !bytes.Equal(data[start+pieceLength:start+2*pieceLength], make([]byte, pieceLength)) {
+		t.Error("piece 2 has data")
+	}
+}
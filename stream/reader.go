@@ -0,0 +1,129 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"torrentClient/models"
+	"torrentClient/picker"
+	"torrentClient/storage"
+)
+
+var ErrReaderClosed = errors.New("stream reader closed")
+
+// Reader reads a single file of the torrent while it downloads. Reads block
+// until the pieces they need are downloaded and the pieces ahead of the read
+// position are downloaded first.
+type Reader struct {
+	manifest   *models.Manifest
+	picker     *picker.Picker
+	store      *storage.Storage
+	fileOffset int64
+	fileLength int64
+	offset     int64
+	cursor     int
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	// The piece a Read is waiting for, removed from the picker on Close
+	waitMutex sync.Mutex
+	waitPiece int
+	waiting   <-chan struct{}
+}
+
+func NewReader(manifest *models.Manifest, piecePicker *picker.Picker, store *storage.Storage, fileIndex int) (*Reader, error) {
+	if fileIndex < 0 || fileIndex >= len(manifest.FileInfos) {
+		return nil, errors.New("invalid file index")
+	}
+
+	file := &manifest.FileInfos[fileIndex]
+	return &Reader{
+		manifest:   manifest,
+		picker:     piecePicker,
+		store:      store,
+		fileOffset: file.Offset,
+		fileLength: file.Length,
+		cursor:     piecePicker.AddCursor(int(file.Offset / manifest.PieceLength)),
+		closed:     make(chan struct{}),
+	}, nil
+}
+
+func (reader *Reader) Read(p []byte) (int, error) {
+	if reader.offset >= reader.fileLength {
+		return 0, io.EOF
+	}
+
+	position := reader.fileOffset + reader.offset
+	piece := int(position / reader.manifest.PieceLength)
+	reader.picker.MoveCursor(reader.cursor, piece)
+
+	// Registered under the lock so a concurrent Close sees the wait
+	reader.waitMutex.Lock()
+	select {
+	case <-reader.closed:
+		reader.waitMutex.Unlock()
+		return 0, ErrReaderClosed
+	default:
+	}
+	ready := reader.picker.PieceReady(piece)
+	reader.waitPiece, reader.waiting = piece, ready
+	reader.waitMutex.Unlock()
+
+	select {
+	case <-ready:
+	case <-reader.closed:
+		return 0, ErrReaderClosed
+	}
+
+	// Only read up to the end of the piece, the next one may still be missing
+	pieceEnd := int64(piece+1) * reader.manifest.PieceLength
+	fileEnd := reader.fileOffset + reader.fileLength
+	if pieceEnd > fileEnd {
+		pieceEnd = fileEnd
+	}
+	if int64(len(p)) > pieceEnd-position {
+		p = p[:pieceEnd-position]
+	}
+
+	n, err := reader.store.ReadAt(p, position)
+	reader.offset += int64(n)
+	return n, err
+}
+
+func (reader *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.fileLength
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	reader.offset = offset
+	if offset < reader.fileLength {
+		reader.picker.MoveCursor(reader.cursor, int((reader.fileOffset+offset)/reader.manifest.PieceLength))
+	}
+	return offset, nil
+}
+
+// Close stops prioritizing the pieces ahead of the reader and unblocks a
+// pending Read
+func (reader *Reader) Close() error {
+	reader.closeOnce.Do(func() {
+		reader.picker.RemoveCursor(reader.cursor)
+		close(reader.closed)
+
+		reader.waitMutex.Lock()
+		if reader.waiting != nil {
+			reader.picker.CancelPieceReady(reader.waitPiece, reader.waiting)
+		}
+		reader.waitMutex.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,165 @@
+package stream
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"torrentClient/models"
+	"torrentClient/picker"
+	"torrentClient/storage"
+)
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Dir}}</title></head>
+<body>
+<h1>{{.Dir}}</h1>
+<ul>
+{{range .Entries}}<li><a href="{{.Link}}">{{.Name}}</a>{{if not .IsDir}} ({{.Length}} bytes){{end}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type listingEntry struct {
+	Name   string
+	Link   string
+	IsDir  bool
+	Length int64
+}
+
+// Server serves the files of a torrent over HTTP while they download. Files
+// are served at their path inside the torrent and every directory gets a
+// listing of its entries.
+type Server struct {
+	manifest *models.Manifest
+	picker   *picker.Picker
+	store    *storage.Storage
+}
+
+func NewServer(manifest *models.Manifest, piecePicker *picker.Picker, store *storage.Storage) *Server {
+	return &Server{
+		manifest: manifest,
+		picker:   piecePicker,
+		store:    store,
+	}
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestPath := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+	for i := range server.manifest.FileInfos {
+		file := &server.manifest.FileInfos[i]
+		if file.Path == requestPath && !file.Padding {
+			server.serveFile(w, r, i)
+			return
+		}
+	}
+
+	server.serveListing(w, r, requestPath)
+}
+
+func (server *Server) serveFile(w http.ResponseWriter, r *http.Request, fileIndex int) {
+	reader, err := NewReader(server.manifest, server.picker, server.store, fileIndex)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	// Stop waiting for pieces once the client goes away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			reader.Close()
+		case <-done:
+		}
+	}()
+
+	// ServeContent handles range requests and picks the content type from
+	// the file extension
+	http.ServeContent(w, r, server.manifest.FileInfos[fileIndex].Name, time.Time{}, reader)
+}
+
+func (server *Server) serveListing(w http.ResponseWriter, r *http.Request, dir string) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	entries := map[string]*listingEntry{}
+	for i := range server.manifest.FileInfos {
+		file := &server.manifest.FileInfos[i]
+		if file.Padding || !strings.HasPrefix(file.Path, prefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(file.Path, prefix)
+		isDir := false
+		if slash := strings.Index(name, "/"); slash != -1 {
+			name = name[:slash]
+			isDir = true
+		}
+
+		if _, ok := entries[name]; ok {
+			continue
+		}
+
+		link := "/" + escapePath(prefix+name)
+		if isDir {
+			link += "/"
+		}
+		entries[name] = &listingEntry{
+			Name:   name,
+			Link:   link,
+			IsDir:  isDir,
+			Length: file.Length,
+		}
+	}
+
+	if len(entries) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	sorted := make([]*listingEntry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := listingTemplate.Execute(w, struct {
+		Dir     string
+		Entries []*listingEntry
+	}{
+		Dir:     "/" + prefix,
+		Entries: sorted,
+	})
+	if err != nil {
+		fmt.Printf("Error writing listing of %v, %v\n", dir, err)
+	}
+}
+
+func escapePath(filePath string) string {
+	parts := strings.Split(filePath, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,270 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"torrentClient/picker"
+	"torrentClient/storage"
+	"torrentClient/torrenttest"
+)
+
+const testPieceLength = 16384
+
+type testTorrent struct {
+	*torrenttest.Torrent
+	store  *storage.Storage
+	picker *picker.Picker
+}
+
+// newTestTorrent creates a torrent of a directory with a video and a text
+// file in a subdirectory, nothing is downloaded yet
+func newTestTorrent(t *testing.T) *testTorrent {
+	torrent := torrenttest.MultiFile(t, "movie", testPieceLength,
+		torrenttest.File{Path: "a.mp4", Length: 3*testPieceLength + 100},
+		torrenttest.File{Path: "sub/b.txt", Length: 20000},
+	)
+	store, err := storage.Open(&torrent.Manifest, filepath.Join(t.TempDir(), "download"), storage.AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	have := torrent.Bitfield()
+	return &testTorrent{
+		Torrent: torrent,
+		store:   store,
+		picker:  picker.New(&torrent.Manifest, &have),
+	}
+}
+
+// download stores a piece and marks it done like the piece workers do
+func (torrent *testTorrent) download(t *testing.T, index int) {
+	err := torrent.store.WritePiece(index, torrent.Piece(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.picker.Done(index)
+}
+
+func (torrent *testTorrent) downloadAll(t *testing.T) {
+	for index := 0; index < torrent.Manifest.PieceCount(); index++ {
+		torrent.download(t, index)
+	}
+}
+
+func get(t *testing.T, url string, header http.Header) (*http.Response, []byte) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, body
+}
+
+func TestServeFile(t *testing.T) {
+	torrent := newTestTorrent(t)
+	torrent.downloadAll(t)
+	server := httptest.NewServer(NewServer(&torrent.Manifest, torrent.picker, torrent.store))
+	defer server.Close()
+
+	videoLength := torrent.Manifest.FileInfos[0].Length
+	response, body := get(t, server.URL+"/movie/a.mp4", nil)
+	if response.StatusCode != http.StatusOK || !bytes.Equal(body, torrent.Data[:videoLength]) {
+		t.Fatalf("status %v, %v bytes", response.Status, len(body))
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "video/mp4" {
+		t.Errorf("content type %q", contentType)
+	}
+
+	response, body = get(t, server.URL+"/movie/sub/b.txt", nil)
+	if !bytes.Equal(body, torrent.Data[videoLength:]) {
+		t.Errorf("text file differs, %v bytes", len(body))
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("content type %q", contentType)
+	}
+}
+
+func TestServeRange(t *testing.T) {
+	torrent := newTestTorrent(t)
+	torrent.downloadAll(t)
+	server := httptest.NewServer(NewServer(&torrent.Manifest, torrent.picker, torrent.store))
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		header       string
+		start        int
+		end          int
+		contentRange string
+	}{
+		{"inside a piece", "bytes=100-199", 100, 200, "bytes 100-199/49252"},
+		{"across pieces", "bytes=16000-17000", 16000, 17001, "bytes 16000-17000/49252"},
+		{"suffix", "bytes=-52", 49200, 49252, "bytes 49200-49251/49252"},
+		{"open ended", "bytes=49000-", 49000, 49252, "bytes 49000-49251/49252"},
+	}
+	for _, test := range tests {
+		response, body := get(t, server.URL+"/movie/a.mp4", http.Header{"Range": {test.header}})
+		if response.StatusCode != http.StatusPartialContent {
+			t.Errorf("%v: status %v", test.name, response.Status)
+			continue
+		}
+		if !bytes.Equal(body, torrent.Data[test.start:test.end]) {
+			t.Errorf("%v: got %v bytes of the wrong data", test.name, len(body))
+		}
+		if contentRange := response.Header.Get("Content-Range"); contentRange != test.contentRange {
+			t.Errorf("%v: content range %q", test.name, contentRange)
+		}
+	}
+
+	response, _ := get(t, server.URL+"/movie/a.mp4", http.Header{"Range": {"bytes=60000-"}})
+	if response.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end, status %v", response.Status)
+	}
+}
+
+func TestServeListing(t *testing.T) {
+	torrent := newTestTorrent(t)
+	server := httptest.NewServer(NewServer(&torrent.Manifest, torrent.picker, torrent.store))
+	defer server.Close()
+
+	tests := []struct {
+		path  string
+		links []string
+	}{
+		{"/", []string{`href="/movie/"`}},
+		{"/movie", []string{`href="/movie/a.mp4"`, "(49252 bytes)", `href="/movie/sub/"`}},
+		{"/movie/sub/", []string{`href="/movie/sub/b.txt"`, "(20000 bytes)"}},
+	}
+	for _, test := range tests {
+		response, body := get(t, server.URL+test.path, nil)
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("%v: status %v", test.path, response.Status)
+			continue
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+			t.Errorf("%v: content type %q", test.path, contentType)
+		}
+		for _, link := range test.links {
+			if !strings.Contains(string(body), link) {
+				t.Errorf("%v: listing misses %v\n%s", test.path, link, body)
+			}
+		}
+	}
+
+	response, _ := get(t, server.URL+"/movie/missing", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("missing file, status %v", response.Status)
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/movie/a.mp4", nil)
+	postResponse, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postResponse.Body.Close()
+	if postResponse.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("post, status %v", postResponse.Status)
+	}
+}
+
+func TestServeBlocksUntilPieceReady(t *testing.T) {
+	torrent := newTestTorrent(t)
+	server := httptest.NewServer(NewServer(&torrent.Manifest, torrent.picker, torrent.store))
+	defer server.Close()
+
+	type result struct {
+		response *http.Response
+		body     []byte
+	}
+	results := make(chan result)
+	go func() {
+		response, body := get(t, server.URL+"/movie/a.mp4", http.Header{"Range": {"bytes=20000-20099"}})
+		results <- result{response, body}
+	}()
+
+	select {
+	case <-results:
+		t.Fatal("read returned before the piece was downloaded")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	torrent.download(t, 1)
+	select {
+	case result := <-results:
+		if result.response.StatusCode != http.StatusPartialContent || !bytes.Equal(result.body, torrent.Data[20000:20100]) {
+			t.Errorf("status %v, %v bytes", result.response.Status, len(result.body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after the piece was downloaded")
+	}
+}
+
+func TestReaderBlocksUntilPieceReady(t *testing.T) {
+	torrent := newTestTorrent(t)
+	reader, err := NewReader(&torrent.Manifest, torrent.picker, torrent.store, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, 2*testPieceLength)
+	results := make(chan result)
+	go func() {
+		n, err := reader.Read(buf)
+		results <- result{n, err}
+	}()
+
+	select {
+	case <-results:
+		t.Fatal("read returned before the piece was downloaded")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	torrent.download(t, 0)
+	select {
+	case result := <-results:
+		// Reads stop at the end of the piece, the next one may be missing
+		if result.err != nil || result.n != testPieceLength || !bytes.Equal(buf[:result.n], torrent.Data[:testPieceLength]) {
+			t.Errorf("read %v bytes, %v", result.n, result.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after the piece was downloaded")
+	}
+
+	go func() {
+		n, err := reader.Read(buf)
+		results <- result{n, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	reader.Close()
+	select {
+	case result := <-results:
+		if result.err != ErrReaderClosed {
+			t.Errorf("read after close, %v", result.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didn't unblock the read")
+	}
+}
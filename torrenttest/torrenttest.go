@@ -0,0 +1,128 @@
+// Package torrenttest builds torrents of random data for tests, the files
+// are written to a temporary directory so they can be seeded or served
+package torrenttest
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"torrentClient/models"
+)
+
+// File is a file of a multi-file torrent, Path is relative to the torrent's
+// directory and uses slashes
+type File struct {
+	Path   string
+	Length int
+}
+
+// Torrent is a test torrent and its data
+type Torrent struct {
+	Manifest models.Manifest
+	// Content is the .torrent file
+	Content []byte
+	// Data is the content of every file one after the other
+	Data []byte
+	// Source is the file or directory holding the data
+	Source string
+}
+
+// SingleFile returns a torrent of one file of random data
+func SingleFile(t testing.TB, name string, length int, pieceLength int64) *Torrent {
+	return build(t, name, false, pieceLength, []File{{Path: name, Length: length}})
+}
+
+// MultiFile returns a torrent of a directory with files of random data
+func MultiFile(t testing.TB, name string, pieceLength int64, files ...File) *Torrent {
+	return build(t, name, true, pieceLength, files)
+}
+
+func build(t testing.TB, name string, multiFile bool, pieceLength int64, files []File) *Torrent {
+	t.Helper()
+
+	torrent := &Torrent{Source: filepath.Join(t.TempDir(), name)}
+	manifest := models.Manifest{
+		Name:        name,
+		PieceLength: pieceLength,
+		MultiFile:   multiFile,
+	}
+	for _, file := range files {
+		data := make([]byte, file.Length)
+		rand.Read(data)
+
+		filePath := torrent.Source
+		if multiFile {
+			filePath = filepath.Join(torrent.Source, filepath.FromSlash(file.Path))
+		}
+		err := os.MkdirAll(filepath.Dir(filePath), 0700)
+		if err == nil {
+			err = os.WriteFile(filePath, data, 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		manifest.FileInfos = append(manifest.FileInfos, models.FileInfo{
+			Path:   name + "/" + file.Path,
+			Length: int64(file.Length),
+		})
+		manifest.Length += int64(file.Length)
+		torrent.Data = append(torrent.Data, data...)
+	}
+
+	for start := int64(0); start < manifest.Length; start += pieceLength {
+		end := start + pieceLength
+		if end > manifest.Length {
+			end = manifest.Length
+		}
+		manifest.PieceHashes = append(manifest.PieceHashes, sha1.Sum(torrent.Data[start:end]))
+	}
+
+	// The manifest is decoded from the file, like the client's own
+	content, err := models.EncodeManifestFile(&manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.Content = content
+	torrent.Manifest, err = models.DecodeManifestFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent
+}
+
+// Piece returns the data of a piece
+func (torrent *Torrent) Piece(index int) []byte {
+	start := int64(index) * torrent.Manifest.PieceLength
+	end := start + torrent.Manifest.PieceLength
+	if end > torrent.Manifest.Length {
+		end = torrent.Manifest.Length
+	}
+	return torrent.Data[start:end]
+}
+
+// File returns the data of a file
+func (torrent *Torrent) File(index int) []byte {
+	file := torrent.Manifest.FileInfos[index]
+	return torrent.Data[file.Offset : file.Offset+file.Length]
+}
+
+// Bitfield returns a bitfield of the torrent with the given pieces set
+func (torrent *Torrent) Bitfield(pieces ...int) models.Bitfield {
+	bitfield := make(models.Bitfield, (torrent.Manifest.PieceCount()+7)/8)
+	for _, index := range pieces {
+		bitfield.MarkPiece(index)
+	}
+	return bitfield
+}
+
+// Complete returns a bitfield with every piece set
+func (torrent *Torrent) Complete() models.Bitfield {
+	bitfield := torrent.Bitfield()
+	for index := 0; index < torrent.Manifest.PieceCount(); index++ {
+		bitfield.MarkPiece(index)
+	}
+	return bitfield
+}
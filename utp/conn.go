@@ -0,0 +1,627 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Packets stay below the MTU of most links
+	maxPayload = 1350
+	// Bytes received but not read yet, advertised as our window
+	receiveBufferSize = 1 << 20
+	// Bytes written but not sent yet, writes block beyond it
+	sendBufferSize = 1 << 18
+	// Packets further ahead than this are dropped
+	maxOutOfOrder = 1024
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	// The connection fails after this many timeouts in a row
+	maxTimeouts = 6
+	// NATs forget idle UDP mappings, an ack is sent after this long
+	keepaliveInterval = 29 * time.Second
+	// A lost packet is resent once this many later packets were acked
+	duplicateAcks = 3
+)
+
+var (
+	errReset   = errors.New("connection reset by peer")
+	errTimeout = errors.New("connection timed out")
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+// outgoing is a sent packet waiting for its ack
+type outgoing struct {
+	seqNr         uint16
+	kind          int
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	// fastResent is set once the packet was resent because later ones were
+	// acked
+	fastResent bool
+	// needResend is set for packets lost in a timeout, they are resent as
+	// the window allows and don't count as in flight until then
+	needResend bool
+}
+
+// Conn is a uTP connection, it implements net.Conn
+type Conn struct {
+	socket *Socket
+	remote net.Addr
+	// Packets we receive carry recvId, packets we send carry sendId
+	recvId uint16
+	sendId uint16
+
+	mutex sync.Mutex
+	// cond wakes readers, writers and dialers waiting on the connection
+	cond  *sync.Cond
+	state connState
+	// err is why the connection broke, reads and writes return it
+	err error
+	// closed is set by Close, the written data and a FIN are still sent
+	closed  bool
+	finSent bool
+
+	seqNr uint16
+	// initialSeqNr is the first sequence number of an incoming connection,
+	// every ack of the SYN carries it
+	initialSeqNr  uint16
+	pending       []byte
+	inflight      []*outgoing
+	inflightBytes int
+	peerWindow    int
+	congestion    ledbat
+	// Loss halves the window once per window of packets, until recoverySeq
+	// is acked
+	inRecovery  bool
+	recoverySeq uint16
+	lastAckNr   uint16
+	duplicates  int
+
+	rtt      time.Duration
+	rttVar   time.Duration
+	timeout  time.Duration
+	timeouts int
+	lastSent time.Time
+
+	ackNr          uint16
+	readBuffer     bytes.Buffer
+	outOfOrder     map[uint16][]byte
+	outOfOrderSize int
+	finReceived    bool
+	finSeq         uint16
+	// eof is set once everything before the peer's FIN was received
+	eof bool
+	// replyMicro is the one way delay of the last packet received, sent
+	// back to the peer for its congestion control
+	replyMicro uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newConn(socket *Socket, remote net.Addr, recvId uint16, sendId uint16) *Conn {
+	conn := &Conn{
+		socket:     socket,
+		remote:     remote,
+		recvId:     recvId,
+		sendId:     sendId,
+		peerWindow: maxPayload,
+		congestion: newLedbat(),
+		timeout:    initialTimeout,
+		outOfOrder: map[uint16][]byte{},
+	}
+	conn.cond = sync.NewCond(&conn.mutex)
+	return conn
+}
+
+func (conn *Conn) Read(b []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for conn.readBuffer.Len() == 0 && !conn.eof && conn.err == nil && !conn.closed && !expired(conn.readDeadline) {
+		conn.cond.Wait()
+	}
+
+	switch {
+	case conn.closed:
+		return 0, net.ErrClosed
+	case conn.readBuffer.Len() > 0:
+		windowBefore := conn.receiveWindow()
+		n, _ := conn.readBuffer.Read(b)
+		// A sender stopped by our full window learns it opened again
+		if windowBefore < 4*maxPayload && conn.state == stateConnected {
+			conn.sendState()
+		}
+		return n, nil
+	case conn.err != nil:
+		return 0, conn.err
+	case conn.eof:
+		return 0, io.EOF
+	default:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (conn *Conn) Write(b []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	written := 0
+	for written < len(b) {
+		for len(conn.pending) >= sendBufferSize && conn.err == nil && !conn.closed && !expired(conn.writeDeadline) {
+			conn.cond.Wait()
+		}
+
+		switch {
+		case conn.closed:
+			return written, net.ErrClosed
+		case conn.err != nil:
+			return written, conn.err
+		case expired(conn.writeDeadline):
+			return written, os.ErrDeadlineExceeded
+		}
+
+		n := len(b) - written
+		if n > sendBufferSize-len(conn.pending) {
+			n = sendBufferSize - len(conn.pending)
+		}
+		conn.pending = append(conn.pending, b[written:written+n]...)
+		written += n
+		conn.flush()
+	}
+	return written, nil
+}
+
+// Close sends the data written so far and a FIN, the connection is dropped
+// once they are acked
+func (conn *Conn) Close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.closed {
+		return net.ErrClosed
+	}
+	conn.closed = true
+
+	if conn.state == stateConnected && conn.err == nil {
+		conn.flush()
+		conn.checkDone()
+	} else {
+		conn.drop()
+	}
+	conn.cond.Broadcast()
+	return nil
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.socket.Addr()
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *Conn) SetDeadline(t time.Time) error {
+	conn.SetReadDeadline(t)
+	return conn.SetWriteDeadline(t)
+}
+
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.readDeadline = t
+	conn.readTimer = conn.wakeAt(conn.readTimer, t)
+	return nil
+}
+
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.writeDeadline = t
+	conn.writeTimer = conn.wakeAt(conn.writeTimer, t)
+	return nil
+}
+
+// wakeAt replaces timer with one waking the waiting readers and writers at
+// the deadline
+func (conn *Conn) wakeAt(timer *time.Timer, deadline time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	conn.cond.Broadcast()
+	if deadline.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(deadline), func() {
+		conn.mutex.Lock()
+		defer conn.mutex.Unlock()
+		conn.cond.Broadcast()
+	})
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// window is how many bytes may be in flight
+func (conn *Conn) window() int {
+	window := int(conn.congestion.window)
+	if conn.peerWindow < window {
+		window = conn.peerWindow
+	}
+	return window
+}
+
+func (conn *Conn) receiveWindow() int {
+	window := receiveBufferSize - conn.readBuffer.Len() - conn.outOfOrderSize
+	if window < 0 {
+		return 0
+	}
+	return window
+}
+
+// flush resends the packets lost in a timeout and sends as much of the
+// written data as the window allows, and the FIN after it once the
+// connection is closed. A packet is always allowed when nothing is in
+// flight, so a zero window is probed.
+func (conn *Conn) flush() {
+	for _, packet := range conn.inflight {
+		if !packet.needResend {
+			continue
+		}
+		if conn.inflightBytes > 0 && conn.inflightBytes+len(packet.payload) > conn.window() {
+			return
+		}
+		packet.needResend = false
+		conn.inflightBytes += len(packet.payload)
+		conn.transmit(packet)
+	}
+
+	for len(conn.pending) > 0 {
+		size := len(conn.pending)
+		if size > maxPayload {
+			size = maxPayload
+		}
+		if conn.inflightBytes > 0 && conn.inflightBytes+size > conn.window() {
+			return
+		}
+
+		payload := make([]byte, size)
+		copy(payload, conn.pending)
+		conn.pending = conn.pending[size:]
+		conn.sendNew(stData, payload)
+		conn.cond.Broadcast()
+	}
+
+	if conn.closed && !conn.finSent {
+		conn.finSent = true
+		conn.sendNew(stFin, nil)
+	}
+}
+
+// sendNew sends a packet taking a sequence number, it is resent until acked
+func (conn *Conn) sendNew(kind int, payload []byte) {
+	packet := &outgoing{seqNr: conn.seqNr, kind: kind, payload: payload}
+	conn.seqNr++
+	conn.inflight = append(conn.inflight, packet)
+	conn.inflightBytes += len(payload)
+	conn.transmit(packet)
+}
+
+func (conn *Conn) transmit(packet *outgoing) {
+	packet.transmissions++
+	packet.sentAt = time.Now()
+	conn.send(header{kind: packet.kind, seqNr: packet.seqNr}, packet.payload)
+}
+
+// sendState acks what was received
+func (conn *Conn) sendState() {
+	conn.send(header{kind: stState, seqNr: conn.seqNr}, nil)
+}
+
+func (conn *Conn) send(h header, payload []byte) {
+	now := time.Now()
+	h.connectionId = conn.sendId
+	if h.kind == stSyn {
+		h.connectionId = conn.recvId
+	}
+	h.timestamp = timestampMicro(now)
+	h.timestampDifference = conn.replyMicro
+	h.windowSize = uint32(conn.receiveWindow())
+	h.ackNr = conn.ackNr
+	h.selectiveAck = conn.selectiveAck()
+
+	conn.socket.write(h.marshal(payload), conn.remote)
+	conn.lastSent = now
+}
+
+// selectiveAck marks the packets received after the first missing one
+func (conn *Conn) selectiveAck() []byte {
+	if len(conn.outOfOrder) == 0 {
+		return nil
+	}
+	mask := make([]byte, selectiveAckLength)
+	for seqNr := range conn.outOfOrder {
+		i := int(seqNr - conn.ackNr - 2)
+		if i >= 0 && i < len(mask)*8 {
+			mask[i/8] |= 1 << (i % 8)
+		}
+	}
+	return mask
+}
+
+// handlePacket processes a packet of the connection, its payload is only
+// valid during the call
+func (conn *Conn) handlePacket(h header, payload []byte, now time.Time) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.state == stateClosed {
+		return
+	}
+	conn.replyMicro = timestampMicro(now) - h.timestamp
+	conn.peerWindow = int(h.windowSize)
+
+	switch h.kind {
+	case stReset:
+		conn.fail(errReset)
+		return
+	case stSyn:
+		// Our ack of the SYN was lost
+		conn.send(header{kind: stState, seqNr: conn.initialSeqNr}, nil)
+		return
+	}
+
+	// The ack of our SYN tells where the data of the peer starts, data
+	// overtaking it is resent later
+	if conn.state == stateSynSent {
+		if h.kind != stState {
+			return
+		}
+		conn.state = stateConnected
+		conn.ackNr = h.seqNr - 1
+	}
+
+	conn.processAck(h, now)
+	if h.kind == stData || h.kind == stFin {
+		conn.receive(h, payload)
+	}
+	conn.flush()
+	conn.checkDone()
+	conn.cond.Broadcast()
+}
+
+// processAck drops the acked packets from the ones in flight, feeding their
+// round trip and delay to the congestion control, and resends lost ones
+func (conn *Conn) processAck(h header, now time.Time) {
+	acked := 0
+	ackPacket := func(packet *outgoing) {
+		acked += len(packet.payload)
+		if !packet.needResend {
+			conn.inflightBytes -= len(packet.payload)
+		}
+		// Resent packets don't tell which transmission was acked
+		if packet.transmissions == 1 {
+			conn.sampleRtt(now.Sub(packet.sentAt))
+		}
+	}
+
+	progress := false
+	for len(conn.inflight) > 0 && !seqLess(h.ackNr, conn.inflight[0].seqNr) {
+		ackPacket(conn.inflight[0])
+		conn.inflight = conn.inflight[1:]
+		progress = true
+	}
+
+	// Positions after ackNr+1 of the packets the peer has
+	selected := []int{}
+	if h.selectiveAck != nil {
+		remaining := conn.inflight[:0]
+		for _, packet := range conn.inflight {
+			i := int(packet.seqNr - h.ackNr - 2)
+			if i >= 0 && i < len(h.selectiveAck)*8 && h.selectiveAck[i/8]&(1<<(i%8)) != 0 {
+				ackPacket(packet)
+				continue
+			}
+			remaining = append(remaining, packet)
+		}
+		conn.inflight = remaining
+
+		for i := 0; i < len(h.selectiveAck)*8; i++ {
+			if h.selectiveAck[i/8]&(1<<(i%8)) != 0 {
+				selected = append(selected, i)
+			}
+		}
+	}
+
+	if progress {
+		conn.duplicates = 0
+	} else if h.kind == stState && h.ackNr == conn.lastAckNr && len(conn.inflight) > 0 {
+		conn.duplicates++
+	}
+	conn.lastAckNr = h.ackNr
+
+	if progress || acked > 0 {
+		conn.timeouts = 0
+		if conn.rtt != 0 {
+			conn.setTimeout(conn.rtt + 4*conn.rttVar)
+		}
+	}
+	if acked > 0 {
+		conn.congestion.onAck(acked, h.timestampDifference, now)
+	}
+	if conn.inRecovery && !seqLess(h.ackNr, conn.recoverySeq) {
+		conn.inRecovery = false
+	}
+
+	// A packet is lost if enough later ones arrived
+	for _, packet := range conn.inflight {
+		position := int(int16(packet.seqNr - h.ackNr - 2))
+		if position >= len(h.selectiveAck)*8 {
+			break
+		}
+		later := 0
+		for _, i := range selected {
+			if i > position {
+				later++
+			}
+		}
+		if position == -1 && conn.duplicates > later {
+			later = conn.duplicates
+		}
+		if later < duplicateAcks || packet.fastResent || packet.needResend {
+			continue
+		}
+
+		packet.fastResent = true
+		if !conn.inRecovery {
+			conn.congestion.onLoss()
+			conn.inRecovery = true
+			conn.recoverySeq = conn.seqNr - 1
+		}
+		conn.transmit(packet)
+	}
+}
+
+func (conn *Conn) sampleRtt(sample time.Duration) {
+	if conn.rtt == 0 {
+		conn.rtt = sample
+		conn.rttVar = sample / 2
+	} else {
+		delta := conn.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		conn.rttVar += (delta - conn.rttVar) / 4
+		conn.rtt += (sample - conn.rtt) / 8
+	}
+}
+
+func (conn *Conn) setTimeout(timeout time.Duration) {
+	switch {
+	case timeout < minTimeout:
+		timeout = minTimeout
+	case timeout > maxTimeout:
+		timeout = maxTimeout
+	}
+	conn.timeout = timeout
+}
+
+// receive queues the payload of a data packet in order and acks it
+func (conn *Conn) receive(h header, payload []byte) {
+	if h.kind == stFin && !conn.finReceived {
+		conn.finReceived = true
+		conn.finSeq = h.seqNr
+	}
+
+	ahead := uint16(h.seqNr - conn.ackNr)
+	_, duplicate := conn.outOfOrder[h.seqNr]
+	fits := conn.readBuffer.Len()+conn.outOfOrderSize+len(payload) <= receiveBufferSize+maxPayload
+	if h.kind == stData && len(payload) > 0 && ahead > 0 && ahead <= maxOutOfOrder && !duplicate && fits {
+		conn.outOfOrder[h.seqNr] = append([]byte{}, payload...)
+		conn.outOfOrderSize += len(payload)
+	}
+
+	for !conn.eof {
+		next := conn.ackNr + 1
+		if conn.finReceived && next == conn.finSeq {
+			conn.ackNr = next
+			conn.eof = true
+			break
+		}
+		data, ok := conn.outOfOrder[next]
+		if !ok {
+			break
+		}
+		delete(conn.outOfOrder, next)
+		conn.outOfOrderSize -= len(data)
+		conn.readBuffer.Write(data)
+		conn.ackNr = next
+	}
+
+	// Duplicates are acked too, the ack of the first one may have been lost
+	conn.sendState()
+}
+
+// tick resends the oldest packet in flight once it timed out and keeps idle
+// connections alive
+func (conn *Conn) tick(now time.Time) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.state == stateClosed {
+		return
+	}
+
+	// Everything in flight is lost once the oldest packet timed out
+	timedOut := false
+	for _, packet := range conn.inflight {
+		if !packet.needResend && now.Sub(packet.sentAt) >= conn.timeout {
+			timedOut = true
+			break
+		}
+	}
+	if timedOut {
+		conn.timeouts++
+		if conn.timeouts > maxTimeouts {
+			conn.fail(errTimeout)
+			return
+		}
+		conn.setTimeout(conn.timeout * 2)
+		conn.congestion.onTimeout()
+		for _, packet := range conn.inflight {
+			packet.needResend = true
+			packet.fastResent = false
+		}
+		conn.inflightBytes = 0
+		conn.flush()
+	}
+
+	if conn.state == stateConnected && now.Sub(conn.lastSent) >= keepaliveInterval {
+		conn.sendState()
+	}
+}
+
+// checkDone drops a closed connection once its FIN was acked
+func (conn *Conn) checkDone() {
+	if conn.closed && conn.finSent && len(conn.inflight) == 0 {
+		conn.drop()
+	}
+}
+
+// fail breaks the connection, the waiting reads and writes return err
+func (conn *Conn) fail(err error) {
+	if conn.err == nil {
+		conn.err = err
+	}
+	conn.drop()
+	conn.cond.Broadcast()
+}
+
+func (conn *Conn) drop() {
+	if conn.state == stateClosed {
+		return
+	}
+	conn.state = stateClosed
+	conn.socket.remove(conn)
+}
@@ -0,0 +1,108 @@
+package utp
+
+import "time"
+
+const (
+	// LEDBAT keeps the queuing delay added by a connection around this,
+	// backing off before TCP on the same link does
+	targetDelay = 100 * time.Millisecond
+	// The congestion window grows at most this many bytes per round trip
+	maxWindowIncrease = 3000
+	minWindow         = 2 * maxPayload
+	initialWindow     = 4 * maxPayload
+	maxWindow         = receiveBufferSize
+)
+
+// ledbat is the congestion window of a connection, BEP 29
+type ledbat struct {
+	window             float64
+	slowStart          bool
+	slowStartThreshold float64
+	delays             delayHistory
+}
+
+func newLedbat() ledbat {
+	return ledbat{
+		window:             initialWindow,
+		slowStart:          true,
+		slowStartThreshold: maxWindow,
+	}
+}
+
+// onAck grows or shrinks the window by how far the one way delay of the
+// acked packets is from the target
+func (congestion *ledbat) onAck(acked int, delaySample uint32, now time.Time) {
+	ourDelay := time.Duration(0)
+	if delaySample != 0 {
+		ourDelay = congestion.delays.add(delaySample, now)
+	}
+
+	if congestion.slowStart {
+		if ourDelay > targetDelay/2 || congestion.window >= congestion.slowStartThreshold {
+			congestion.slowStart = false
+		} else {
+			congestion.setWindow(congestion.window + float64(acked))
+			return
+		}
+	}
+
+	offTarget := float64(targetDelay-ourDelay) / float64(targetDelay)
+	windowFactor := float64(acked) / congestion.window
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	congestion.setWindow(congestion.window + maxWindowIncrease*offTarget*windowFactor)
+}
+
+// onLoss halves the window when a packet was lost but later ones arrived
+func (congestion *ledbat) onLoss() {
+	congestion.setWindow(congestion.window / 2)
+	congestion.slowStartThreshold = congestion.window
+	congestion.slowStart = false
+}
+
+// onTimeout restarts from the smallest window when nothing was acked in time
+func (congestion *ledbat) onTimeout() {
+	congestion.slowStartThreshold = congestion.window / 2
+	congestion.window = minWindow
+	congestion.slowStart = true
+}
+
+func (congestion *ledbat) setWindow(window float64) {
+	switch {
+	case window < minWindow:
+		window = minWindow
+	case window > maxWindow:
+		window = maxWindow
+	}
+	congestion.window = window
+}
+
+// delayHistory keeps the lowest one way delay of the last two minutes as the
+// delay of the link without our queuing. The clocks of the peers differ, so
+// only differences of the samples mean anything.
+type delayHistory struct {
+	current     uint32
+	previous    uint32
+	hasCurrent  bool
+	hasPrevious bool
+	started     time.Time
+}
+
+// add records a sample and returns the queuing delay it shows
+func (history *delayHistory) add(sample uint32, now time.Time) time.Duration {
+	switch {
+	case !history.hasCurrent || now.Sub(history.started) >= time.Minute:
+		history.previous, history.hasPrevious = history.current, history.hasCurrent
+		history.current, history.hasCurrent = sample, true
+		history.started = now
+	case int32(sample-history.current) < 0:
+		history.current = sample
+	}
+
+	base := history.current
+	if history.hasPrevious && int32(history.previous-base) < 0 {
+		base = history.previous
+	}
+	return time.Duration(int32(sample-base)) * time.Microsecond
+}
@@ -0,0 +1,117 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version      = 1
+	headerLength = 20
+
+	extensionNone         = 0
+	extensionSelectiveAck = 1
+	// The selective ack covers the 32 packets after the first missing one
+	selectiveAckLength = 4
+)
+
+// Timestamps are microseconds since the package was loaded, the peer only
+// compares them with each other
+var epoch = time.Now()
+
+// header is the header of a uTP packet, BEP 29
+type header struct {
+	kind                int
+	connectionId        uint16
+	timestamp           uint32
+	timestampDifference uint32
+	windowSize          uint32
+	seqNr               uint16
+	ackNr               uint16
+	// selectiveAck has a bit for every packet after ackNr+1 that was
+	// received, nil without the extension
+	selectiveAck []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	length := headerLength + len(payload)
+	if h.selectiveAck != nil {
+		length += 2 + len(h.selectiveAck)
+	}
+
+	buf := make([]byte, headerLength, length)
+	buf[0] = byte(h.kind<<4 | version)
+	if h.selectiveAck != nil {
+		buf[1] = extensionSelectiveAck
+	}
+	binary.BigEndian.PutUint16(buf[2:], h.connectionId)
+	binary.BigEndian.PutUint32(buf[4:], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:], h.timestampDifference)
+	binary.BigEndian.PutUint32(buf[12:], h.windowSize)
+	binary.BigEndian.PutUint16(buf[16:], h.seqNr)
+	binary.BigEndian.PutUint16(buf[18:], h.ackNr)
+
+	if h.selectiveAck != nil {
+		buf = append(buf, extensionNone, byte(len(h.selectiveAck)))
+		buf = append(buf, h.selectiveAck...)
+	}
+	return append(buf, payload...)
+}
+
+// unmarshal parses a packet, the header and the payload point into it
+func unmarshal(packet []byte) (header, []byte, error) {
+	if len(packet) < headerLength {
+		return header{}, nil, errors.New("packet too short")
+	}
+	if packet[0]&0xf != version {
+		return header{}, nil, errors.New("unsupported uTP version")
+	}
+
+	h := header{
+		kind:                int(packet[0] >> 4),
+		connectionId:        binary.BigEndian.Uint16(packet[2:]),
+		timestamp:           binary.BigEndian.Uint32(packet[4:]),
+		timestampDifference: binary.BigEndian.Uint32(packet[8:]),
+		windowSize:          binary.BigEndian.Uint32(packet[12:]),
+		seqNr:               binary.BigEndian.Uint16(packet[16:]),
+		ackNr:               binary.BigEndian.Uint16(packet[18:]),
+	}
+	if h.kind > stSyn {
+		return header{}, nil, errors.New("unknown packet type")
+	}
+
+	// Extensions are a linked list, unknown ones are skipped
+	extension := packet[1]
+	rest := packet[headerLength:]
+	for extension != extensionNone {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return header{}, nil, errors.New("invalid extension")
+		}
+		next, length := rest[0], int(rest[1])
+		if extension == extensionSelectiveAck {
+			h.selectiveAck = rest[2 : 2+length]
+		}
+		extension = next
+		rest = rest[2+length:]
+	}
+	return h, rest, nil
+}
+
+// seqLess compares sequence numbers that wrap around
+func seqLess(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func timestampMicro(now time.Time) uint32 {
+	return uint32(now.Sub(epoch) / time.Microsecond)
+}
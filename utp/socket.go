@@ -0,0 +1,272 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How often connections check for timeouts
+	tickInterval = 50 * time.Millisecond
+	// Incoming connections not accepted yet, more are refused
+	acceptBacklog = 64
+	// Size asked for the UDP send and receive buffers
+	socketBufferSize = 4 << 20
+)
+
+// connKey identifies a connection by the peer and the connection id of the
+// packets it sends us
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket runs uTP connections over a UDP socket, it implements net.Listener
+// for the incoming ones
+type Socket struct {
+	conn     net.PacketConn
+	mutex    sync.Mutex
+	conns    map[connKey]*Conn
+	accepted chan *Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Listen opens a UDP socket for uTP connections, e.g. Listen("udp", ":6881")
+func Listen(network string, address string) (*Socket, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(conn), nil
+}
+
+// NewSocket runs uTP over a packet connection, it is closed with the socket
+func NewSocket(conn net.PacketConn) *Socket {
+	// Bursts of every connection queue up in the socket, the system may
+	// cap the size
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		udpConn.SetReadBuffer(socketBufferSize)
+		udpConn.SetWriteBuffer(socketBufferSize)
+	}
+
+	socket := &Socket{
+		conn:     conn,
+		conns:    map[connKey]*Conn{},
+		accepted: make(chan *Conn, acceptBacklog),
+		done:     make(chan struct{}),
+	}
+	go socket.readLoop()
+	go socket.tickLoop()
+	return socket
+}
+
+// Accept waits for an incoming connection
+func (socket *Socket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-socket.accepted:
+		return conn, nil
+	case <-socket.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the UDP socket and breaks its connections
+func (socket *Socket) Close() error {
+	err := net.ErrClosed
+	socket.once.Do(func() {
+		close(socket.done)
+		err = socket.conn.Close()
+
+		socket.mutex.Lock()
+		conns := make([]*Conn, 0, len(socket.conns))
+		for _, conn := range socket.conns {
+			conns = append(conns, conn)
+		}
+		socket.mutex.Unlock()
+
+		for _, conn := range conns {
+			conn.mutex.Lock()
+			conn.fail(net.ErrClosed)
+			conn.mutex.Unlock()
+		}
+	})
+	return err
+}
+
+func (socket *Socket) Addr() net.Addr {
+	return socket.conn.LocalAddr()
+}
+
+// DialContext connects to a peer, address is a host and port
+func (socket *Socket) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Our packets carry a random id, the peer's carry the next one
+	socket.mutex.Lock()
+	var conn *Conn
+	for conn == nil {
+		id := uint16(rand.Intn(1 << 16))
+		key := connKey{addr: remote.String(), id: id}
+		if _, ok := socket.conns[key]; !ok {
+			conn = newConn(socket, remote, id, id+1)
+			socket.conns[key] = conn
+		}
+	}
+	socket.mutex.Unlock()
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.seqNr = 1
+	conn.sendNew(stSyn, nil)
+
+	// Closing the context wakes the wait below
+	dialed := make(chan struct{})
+	defer close(dialed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.mutex.Lock()
+			defer conn.mutex.Unlock()
+			conn.cond.Broadcast()
+		case <-dialed:
+		}
+	}()
+
+	for conn.state == stateSynSent && ctx.Err() == nil {
+		conn.cond.Wait()
+	}
+
+	switch {
+	case conn.err != nil:
+		return nil, conn.err
+	case ctx.Err() != nil:
+		conn.fail(ctx.Err())
+		return nil, ctx.Err()
+	}
+	return conn, nil
+}
+
+func (socket *Socket) readLoop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := socket.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-socket.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		h, payload, err := unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		socket.dispatch(h, payload, addr)
+	}
+}
+
+// dispatch hands a packet to its connection, starting one for a SYN and
+// resetting the peer for packets of unknown connections
+func (socket *Socket) dispatch(h header, payload []byte, addr net.Addr) {
+	key := connKey{addr: addr.String(), id: h.connectionId}
+	if h.kind == stSyn {
+		// The SYN carries the id of the packets the dialer will receive
+		key.id = h.connectionId + 1
+	}
+
+	socket.mutex.Lock()
+	var conn *Conn
+	if h.kind == stReset {
+		// Resets carry the id of the packets the peer got from us
+		for candidateKey, candidate := range socket.conns {
+			if candidateKey.addr == key.addr && candidate.sendId == h.connectionId {
+				conn = candidate
+				break
+			}
+		}
+	} else {
+		conn = socket.conns[key]
+	}
+	if conn == nil && h.kind == stSyn {
+		conn = socket.newIncoming(h, addr, key)
+	}
+	socket.mutex.Unlock()
+
+	if conn == nil {
+		if h.kind != stReset && h.kind != stSyn {
+			reset := header{kind: stReset, connectionId: h.connectionId, timestamp: timestampMicro(time.Now()), ackNr: h.seqNr}
+			socket.write(reset.marshal(nil), addr)
+		}
+		return
+	}
+	conn.handlePacket(h, payload, time.Now())
+}
+
+// newIncoming queues the connection of a SYN for Accept, nil if the queue is
+// full
+func (socket *Socket) newIncoming(h header, addr net.Addr, key connKey) *Conn {
+	if len(socket.accepted) == cap(socket.accepted) {
+		return nil
+	}
+
+	conn := newConn(socket, addr, key.id, h.connectionId)
+	conn.state = stateConnected
+	conn.ackNr = h.seqNr
+	conn.seqNr = uint16(rand.Intn(1 << 16))
+	conn.initialSeqNr = conn.seqNr
+	socket.conns[key] = conn
+	socket.accepted <- conn
+	return conn
+}
+
+func (socket *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			socket.mutex.Lock()
+			conns := make([]*Conn, 0, len(socket.conns))
+			for _, conn := range socket.conns {
+				conns = append(conns, conn)
+			}
+			socket.mutex.Unlock()
+
+			for _, conn := range conns {
+				conn.tick(now)
+			}
+		case <-socket.done:
+			return
+		}
+	}
+}
+
+func (socket *Socket) write(packet []byte, addr net.Addr) {
+	// Lost packets are resent, errors are handled the same way
+	socket.conn.WriteTo(packet, addr)
+}
+
+func (socket *Socket) remove(conn *Conn) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
+	key := connKey{addr: conn.remote.String(), id: conn.recvId}
+	if socket.conns[key] == conn {
+		delete(socket.conns, key)
+	}
+}
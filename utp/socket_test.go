@@ -0,0 +1,259 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// badNetwork drops, delays and reorders the packets written to it, packets
+// of a blackholed network are all dropped
+type badNetwork struct {
+	net.PacketConn
+	loss float64
+	// Packets are held back between delay and delay+jitter, so a jitter
+	// reorders them
+	delay     time.Duration
+	jitter    time.Duration
+	blackhole int32
+	sent      int32
+	dropped   int32
+}
+
+func (network *badNetwork) WriteTo(b []byte, addr net.Addr) (int, error) {
+	atomic.AddInt32(&network.sent, 1)
+	if atomic.LoadInt32(&network.blackhole) != 0 || rand.Float64() < network.loss {
+		atomic.AddInt32(&network.dropped, 1)
+		return len(b), nil
+	}
+	if network.delay == 0 && network.jitter == 0 {
+		return network.PacketConn.WriteTo(b, addr)
+	}
+
+	delay := network.delay
+	if network.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(network.jitter)))
+	}
+	packet := append([]byte{}, b...)
+	time.AfterFunc(delay, func() {
+		network.PacketConn.WriteTo(packet, addr)
+	})
+	return len(b), nil
+}
+
+// newTestSockets returns two loopback sockets sending through bad networks
+func newTestSockets(t *testing.T, loss float64, delay time.Duration, jitter time.Duration) (*Socket, *Socket, *badNetwork) {
+	sockets := [2]*Socket{}
+	networks := [2]*badNetwork{}
+	for i := range sockets {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		networks[i] = &badNetwork{PacketConn: conn, loss: loss, delay: delay, jitter: jitter}
+		socket := NewSocket(networks[i])
+		t.Cleanup(func() { socket.Close() })
+		sockets[i] = socket
+	}
+	return sockets[0], sockets[1], networks[0]
+}
+
+// connect dials from one socket to the other and returns both ends
+func connect(t *testing.T, dialer *Socket, listener *Socket) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialed, err := dialer.DialContext(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	return dialed, conn
+}
+
+func randomData(length int) []byte {
+	data := make([]byte, length)
+	rand.Read(data)
+	return data
+}
+
+func TestTransferOverBadNetwork(t *testing.T) {
+	tests := []struct {
+		name   string
+		loss   float64
+		delay  time.Duration
+		jitter time.Duration
+		length int
+	}{
+		{"clean", 0, 0, 0, 8 << 20},
+		{"lossy", 0.05, 0, 0, 4 << 20},
+		{"reordering", 0, 5 * time.Millisecond, 10 * time.Millisecond, 4 << 20},
+		{"lossy and reordering", 0.05, 5 * time.Millisecond, 10 * time.Millisecond, 2 << 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer, listener, network := newTestSockets(t, test.loss, test.delay, test.jitter)
+			dialed, accepted := connect(t, dialer, listener)
+			data := randomData(test.length)
+			reply := randomData(test.length / 4)
+
+			// Both directions at once, the dialing side closes once it
+			// read the reply, data arriving after a close resets the
+			// connection
+			errs := make(chan error, 2)
+			go func() {
+				_, err := dialed.Write(data)
+				if err != nil {
+					errs <- err
+					return
+				}
+				received := make([]byte, len(reply))
+				_, err = io.ReadFull(dialed, received)
+				if err == nil && !bytes.Equal(received, reply) {
+					err = errors.New("reply differs")
+				}
+				if err == nil {
+					err = dialed.Close()
+				}
+				errs <- err
+			}()
+			go func() {
+				_, err := accepted.Write(reply)
+				errs <- err
+			}()
+
+			received := make([]byte, len(data))
+			_, err := io.ReadFull(accepted, received)
+			if err != nil || !bytes.Equal(received, data) {
+				t.Fatalf("data differs, %v", err)
+			}
+			// The data is followed by the FIN
+			accepted.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if n, err := accepted.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("read after the data, %v bytes, %v", n, err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if test.loss > 0 && atomic.LoadInt32(&network.dropped) == 0 {
+				t.Error("no packets dropped")
+			}
+		})
+	}
+}
+
+func TestReplyBeforeClose(t *testing.T) {
+	dialer, listener, _ := newTestSockets(t, 0.1, 2*time.Millisecond, 5*time.Millisecond)
+	dialed, accepted := connect(t, dialer, listener)
+	reply := randomData(1 << 20)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		request := make([]byte, 7)
+		_, err := io.ReadFull(accepted, request)
+		if err != nil || string(request) != "request" {
+			t.Errorf("request %q, %v", request, err)
+			return
+		}
+		accepted.Write(reply)
+		accepted.Close()
+	}()
+
+	_, err := dialed.Write([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed.SetReadDeadline(time.Now().Add(30 * time.Second))
+	received, err := io.ReadAll(dialed)
+	if err != nil || !bytes.Equal(received, reply) {
+		t.Errorf("reply of %v bytes, %v", len(received), err)
+	}
+	wg.Wait()
+
+	if err := dialed.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := dialed.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after close, %v", err)
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	dialer, listener, network := newTestSockets(t, 0, 0, 0)
+	dialed, accepted := connect(t, dialer, listener)
+
+	start := time.Now()
+	accepted.SetReadDeadline(start.Add(100 * time.Millisecond))
+	_, err := accepted.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline, %v", err)
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Error("deadline error isn't a timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("read returned after %v", elapsed)
+	}
+
+	// Clearing the deadline makes reads wait for data again
+	accepted.SetReadDeadline(time.Time{})
+	go dialed.Write([]byte("x"))
+	if n, err := accepted.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Fatalf("read after clearing the deadline, %v", err)
+	}
+
+	// Nothing is acked anymore, so writes block once the send buffer fills
+	atomic.StoreInt32(&network.blackhole, 1)
+	dialed.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	data := randomData(4 * sendBufferSize)
+	n, err := dialed.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write past the deadline, %v", err)
+	}
+	if n >= len(data) {
+		t.Errorf("%v bytes written without acks", n)
+	}
+
+	// A deadline in the past fails at once
+	dialed.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := dialed.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("write with an expired deadline, %v", err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	dialer, listener, network := newTestSockets(t, 0, 0, 0)
+	atomic.StoreInt32(&network.blackhole, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err := dialer.DialContext(ctx, listener.Addr().String())
+	if err == nil {
+		t.Error("dial without an answer succeeded")
+	}
+}
@@ -0,0 +1,357 @@
+package worker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	"torrentClient/common"
+	"torrentClient/connmgr"
+	"torrentClient/models"
+	"torrentClient/picker"
+	"torrentClient/seed"
+)
+
+const (
+	// Time a peer has to answer a block request
+	pieceTimeout = 30 * time.Second
+	// Block requests sent before waiting for an answer
+	maxPipelinedRequests = 5
+	// The download side looks for work this often even without a change of
+	// the peer, pieces may be requeued by other workers
+	idleRecheck = 10 * time.Second
+)
+
+// pieceBlock is a block received from the peer
+type pieceBlock struct {
+	index int
+	begin int
+	data  []byte
+}
+
+// connection is the protocol engine of a peer connection. Its read side
+// handles every message as it arrives, so requests are answered whether or
+// not we download from the peer, and hands blocks and state changes over to
+// the download side running next to it.
+type connection struct {
+	peer                  *models.Peer
+	connections           *connmgr.Torrent
+	manifest              *models.Manifest
+	piecePicker           *picker.Picker
+	pieceJobResultChannel *chan *models.PieceJobResult
+	uploads               *seed.UploadQueue
+	blocks                chan pieceBlock
+	wake                  chan struct{}
+}
+
+func newConnection(peer *models.Peer, connections *connmgr.Torrent, manifest *models.Manifest, piecePicker *picker.Picker, pieceJobResultChannel *chan *models.PieceJobResult, uploads *seed.UploadQueue) *connection {
+	return &connection{
+		peer:                  peer,
+		connections:           connections,
+		manifest:              manifest,
+		piecePicker:           piecePicker,
+		pieceJobResultChannel: pieceJobResultChannel,
+		uploads:               uploads,
+		blocks:                make(chan pieceBlock, 4*maxPipelinedRequests),
+		wake:                  make(chan struct{}, 1),
+	}
+}
+
+// signal wakes the download side up after a change of the peer's state
+func (connection *connection) signal() {
+	select {
+	case connection.wake <- struct{}{}:
+	default:
+	}
+}
+
+// readLoop handles the messages of the peer until the connection closes
+func (connection *connection) readLoop() error {
+	for {
+		message, err := connection.peer.Receive(0)
+		if err != nil {
+			return err
+		}
+		if message == nil {
+			continue
+		}
+
+		err = connection.handleMessage(message)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (connection *connection) handleMessage(message *models.Message) error {
+	peer := connection.peer
+
+	if message.Type != models.MsgTypePiece {
+		fmt.Printf("Received message from peer %v, %v\n", peer.Address, message.Type.String())
+	}
+
+	switch message.Type {
+	case models.MsgTypeUnChoke:
+		peer.SetChoking(false)
+		connection.signal()
+	case models.MsgTypeChoke:
+		peer.SetChoking(true)
+		connection.signal()
+	case models.MsgTypeInterested:
+		peer.SetInterested(true)
+	case models.MsgTypeNotInterested:
+		peer.SetInterested(false)
+	case models.MsgTypeHave:
+		if len(message.Payload) < 4 {
+			fmt.Printf("Received invalid have message from peer %v\n", peer.Address)
+			return nil
+		}
+		pieceIndex := binary.BigEndian.Uint32(message.Payload)
+		peer.MarkPiece(int(pieceIndex))
+		connection.uploads.PeerHas(int(pieceIndex))
+		connection.signal()
+	case models.MsgTypeBitField:
+		peer.SetBitField(message.Payload)
+		connection.uploads.PeerBitField()
+		connection.signal()
+	case models.MsgTypeCancel:
+		connection.uploads.Cancel(message.Payload)
+	case models.MsgTypePiece:
+		index, begin, block, err := common.ReadPieceMessage(message.Payload)
+		if err != nil {
+			fmt.Printf("Error reading piece job result from peer %v, %v\n", peer.Address, err)
+			return err
+		}
+
+		// Never wait for the download side, blocks it has no room for are
+		// left over from a piece it gave up on
+		select {
+		case connection.blocks <- pieceBlock{index: index, begin: begin, data: block}:
+		default:
+			fmt.Printf("Dropping block of piece %v from peer %v\n", index, peer.Address)
+		}
+	case models.MsgTypeRequest, models.MsgTypeHashRequest:
+		connection.uploads.Add(message)
+	case models.MsgTypeExtended:
+		// We don't advertise any extension messages, only the handshake
+		// can arrive
+		extendedHandshake, err := models.ReadExtendedHandshake(message.Payload)
+		if err != nil {
+			fmt.Printf("Error reading extended handshake from peer %v, %v\n", peer.Address, err)
+			return nil
+		}
+		peer.SetUploadOnly(extendedHandshake.UploadOnly)
+		connection.signal()
+	case models.MsgTypeHashes:
+		req, hashes, err := models.ReadHashesMessage(message.Payload)
+		if err != nil {
+			fmt.Printf("Error reading hashes from peer %v, %v\n", peer.Address, err)
+			return err
+		}
+		// Piece layers come with the torrent file, so these aren't needed
+		fmt.Printf("Received %v hashes from peer %v at index %v\n", len(hashes), peer.Address, req.Index)
+	case models.MsgTypeHashReject:
+		fmt.Printf("Received hash reject from peer %v\n", peer.Address)
+	}
+
+	return nil
+}
+
+// wait blocks until the peer's state changes or the timeout passes, false
+// means the connection closed
+func (connection *connection) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-connection.wake:
+		return true
+	case <-timer.C:
+		return true
+	case <-connection.peer.Done():
+		return false
+	}
+}
+
+// updateInterest tells the peer whether we want any of its pieces
+func (connection *connection) updateInterest() bool {
+	interested := connection.piecePicker.Interesting(connection.peer.BitField())
+	if !connection.peer.SetAmInterested(interested) {
+		return interested
+	}
+
+	messageType := models.MsgTypeNotInterested
+	if interested {
+		messageType = models.MsgTypeInterested
+	}
+	err := common.SendMessage(connection.peer, models.Message{Type: messageType})
+	if err != nil {
+		fmt.Printf("Error sending %v to peer %v\n", messageType, connection.peer.Address)
+	}
+	return interested
+}
+
+// downloadLoop downloads the pieces the peer has until the connection closes
+func (connection *connection) downloadLoop() {
+	peer := connection.peer
+
+	for {
+		// The download may finish or resume through file priorities too
+		finished := connection.piecePicker.Finished()
+		err := common.UpdateUploadOnly(peer, finished)
+		if err != nil {
+			fmt.Printf("Error sending extended handshake to peer %v\n", peer.Address)
+			return
+		}
+
+		// Neither side wants anything from the other
+		if peer.UploadOnly() && finished {
+			fmt.Printf("Closing connection to peer %v, both sides are upload only\n", peer.Address)
+			peer.Close()
+			return
+		}
+
+		if !connection.updateInterest() || peer.IsChoking() {
+			if !connection.wait(idleRecheck) {
+				return
+			}
+			continue
+		}
+
+		pieceJob, ok := connection.piecePicker.Next(connection.availablePieces())
+		if !ok {
+			// Everything we want from this peer is being downloaded already
+			if !connection.wait(idleRecheck) {
+				return
+			}
+			continue
+		}
+
+		if !connection.downloadPiece(pieceJob) {
+			return
+		}
+	}
+}
+
+// availablePieces returns the pieces of the peer it may download, pieces of
+// failed downloads it took part in are left to other peers for a while
+func (connection *connection) availablePieces() models.Bitfield {
+	bitField := connection.peer.BitField()
+	for _, index := range connection.connections.SuspectPieces(connection.peer.Address.IP) {
+		bitField.ClearPiece(index)
+	}
+	return bitField
+}
+
+// downloadPiece requests the blocks of a piece with a few requests in flight
+// and sends the verified piece to the result channel. False means the
+// connection is done.
+func (connection *connection) downloadPiece(pieceJob models.PieceJob) bool {
+	peer := connection.peer
+	fmt.Printf("Sending piece job to peer %v, piece index %v\n", peer.Address, pieceJob.PieceIndex)
+
+	// Forget blocks of earlier pieces
+	for drained := false; !drained; {
+		select {
+		case <-connection.blocks:
+		default:
+			drained = true
+		}
+	}
+
+	buffer := make([]byte, pieceJob.PieceLength)
+	blockCount := (pieceJob.PieceLength + common.BlockSize - 1) / common.BlockSize
+	received := make([]bool, blockCount)
+	receivedCount := 0
+	nextBlock := 0
+	outstanding := 0
+	deadline := time.Now().Add(pieceTimeout)
+
+	for receivedCount < blockCount {
+		for outstanding < maxPipelinedRequests && nextBlock < blockCount {
+			begin := nextBlock * common.BlockSize
+			err := common.SendMessage(peer, models.Message{
+				Type: models.MsgTypeRequest,
+				Payload: models.RequestMessage{
+					PieceIndex: pieceJob.PieceIndex,
+					Begin:      begin,
+					Length:     blockLength(pieceJob.PieceLength, begin),
+				}.ToBytes(),
+			})
+			if err != nil {
+				fmt.Printf("Error sending request to peer %v\n", peer.Address)
+				connection.piecePicker.Requeue(pieceJob)
+				return false
+			}
+			nextBlock++
+			outstanding++
+		}
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case block := <-connection.blocks:
+			timer.Stop()
+			i := block.begin / common.BlockSize
+			if block.index != pieceJob.PieceIndex || block.begin%common.BlockSize != 0 ||
+				i >= blockCount || received[i] || len(block.data) != blockLength(pieceJob.PieceLength, block.begin) {
+				fmt.Printf("Received unexpected block of piece %v at %v from peer %v\n", block.index, block.begin, peer.Address)
+				continue
+			}
+			copy(buffer[block.begin:], block.data)
+			received[i] = true
+			receivedCount++
+			outstanding--
+			deadline = time.Now().Add(pieceTimeout)
+		case <-connection.wake:
+			timer.Stop()
+			// A choke drops our pending requests
+			if peer.IsChoking() {
+				connection.piecePicker.Requeue(pieceJob)
+				return true
+			}
+		case <-timer.C:
+			fmt.Printf("Timeout downloading piece %v from peer %v\n", pieceJob.PieceIndex, peer.Address)
+			connection.piecePicker.Requeue(pieceJob)
+			peer.Close()
+			return false
+		case <-peer.Done():
+			timer.Stop()
+			connection.piecePicker.Requeue(pieceJob)
+			return false
+		}
+	}
+
+	// check if piece is valid
+	if !common.CheckPiece(connection.manifest, pieceJob.PieceIndex, buffer) {
+		fmt.Printf("Piece hash doesn't match for piece %v from peer %v\n", pieceJob.PieceIndex, peer.Address)
+		blocks := make([]connmgr.Block, blockCount)
+		for i := range blocks {
+			begin := i * common.BlockSize
+			blocks[i] = connmgr.Block{
+				Begin:  begin,
+				Data:   buffer[begin : begin+blockLength(pieceJob.PieceLength, begin)],
+				Source: peer.Address.IP,
+			}
+		}
+		connection.connections.PieceFailed(pieceJob.PieceIndex, blocks)
+		connection.piecePicker.Requeue(pieceJob)
+		return true
+	}
+
+	select {
+	case *connection.pieceJobResultChannel <- &models.PieceJobResult{
+		PieceIndex: pieceJob.PieceIndex,
+		PieceData:  buffer,
+	}:
+		return true
+	case <-peer.Done():
+		connection.piecePicker.Requeue(pieceJob)
+		return false
+	}
+}
+
+func blockLength(pieceLength int, begin int) int {
+	if pieceLength-begin < common.BlockSize {
+		return pieceLength - begin
+	}
+	return common.BlockSize
+}
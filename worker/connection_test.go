@@ -0,0 +1,73 @@
+package worker
+
+import (
+	"net"
+	"testing"
+	"time"
+	"torrentClient/common"
+	"torrentClient/connmgr"
+	"torrentClient/models"
+	"torrentClient/picker"
+	"torrentClient/torrenttest"
+)
+
+// readUploadOnly returns the upload only state of the next extended
+// handshake the remote side of a peer receives
+func readUploadOnly(t *testing.T, remote net.Conn) bool {
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		message, err := models.ReadMessage(remote)
+		if err != nil {
+			t.Fatal("no extended handshake,", err)
+		}
+		if message == nil || message.Type != models.MsgTypeExtended {
+			continue
+		}
+		extendedHandshake, err := models.ReadExtendedHandshake(message.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return extendedHandshake.UploadOnly
+	}
+}
+
+func TestUploadOnlySentWhenDownloadFinishes(t *testing.T) {
+	torrent := torrenttest.SingleFile(t, "data.bin", 40000, 16384)
+	manifest := torrent.Manifest
+	have := torrent.Bitfield()
+	piecePicker := picker.New(&manifest, &have)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peer := models.NewPeer(local, models.PeerAddress{IP: net.IPv4(192, 0, 2, 1), Port: 6881}, manifest.PieceCount())
+	peer.SupportsExtensions = true
+	peer.Start()
+	defer peer.Close()
+
+	results := make(chan *models.PieceJobResult)
+	connections := connmgr.New(10, 5).AddTorrent(manifest.InfoHash, 10)
+	engine := newConnection(peer, connections, &manifest, piecePicker, &results, nil)
+
+	err := common.UpdateUploadOnly(peer, piecePicker.Finished())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readUploadOnly(t, remote) {
+		t.Fatal("upload only before anything was downloaded")
+	}
+	go engine.downloadLoop()
+
+	// Pieces stored by other connections finish the download
+	for index := 0; index < manifest.PieceCount(); index++ {
+		piecePicker.Done(index)
+	}
+	engine.signal()
+	if !readUploadOnly(t, remote) {
+		t.Error("extended handshake after finishing isn't upload only")
+	}
+
+	// Telling the peer again changes nothing
+	if peer.SetAmUploadOnly(true) {
+		t.Error("upload only state would be sent twice")
+	}
+}
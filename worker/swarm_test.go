@@ -0,0 +1,204 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"torrentClient/common"
+	"torrentClient/connmgr"
+	"torrentClient/models"
+	"torrentClient/mse"
+	"torrentClient/picker"
+	"torrentClient/seed"
+	"torrentClient/storage"
+	"torrentClient/torrenttest"
+)
+
+// testNode is a client of the swarm test, the parts main wires together
+type testNode struct {
+	manifest models.Manifest
+	id       [20]byte
+	store    *storage.Storage
+	picker   *picker.Picker
+	conns    *connmgr.Torrent
+	uploader *seed.Uploader
+	stats    models.Stats
+	network  *common.Network
+	results  chan *models.PieceJobResult
+}
+
+func newTestNode(t *testing.T, ctx context.Context, manifest models.Manifest, dir string, id byte, network *common.Network) *testNode {
+	node := &testNode{
+		manifest: manifest,
+		id:       [20]byte{'-', 'T', 'S', id},
+		network:  network,
+		results:  make(chan *models.PieceJobResult),
+	}
+
+	var err error
+	node.store, err = storage.Open(&node.manifest, dir, storage.AllocateSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.store.Close() })
+
+	have := make(models.Bitfield, (manifest.PieceCount()+7)/8)
+	node.picker = picker.New(&node.manifest, &have)
+	node.conns = connmgr.New(10, 5).AddTorrent(manifest.InfoHash, 10)
+	node.uploader, err = seed.NewUploader(node.store, node.picker, &node.manifest, &node.stats, seed.DefaultBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Store the verified pieces and announce them, like main does
+	go func() {
+		for {
+			select {
+			case result := <-node.results:
+				if err := node.store.WritePiece(result.PieceIndex, result.PieceData); err != nil {
+					t.Error(err)
+				}
+				node.conns.PieceVerified(result.PieceIndex, result.PieceData)
+				node.picker.Done(result.PieceIndex)
+				for _, peer := range node.conns.Peers() {
+					common.SendHaveMessage(peer, result.PieceIndex)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return node
+}
+
+// seed stores the whole torrent as already downloaded
+func (node *testNode) seed(t *testing.T, torrent *torrenttest.Torrent) {
+	for index := 0; index < node.manifest.PieceCount(); index++ {
+		if err := node.store.WritePiece(index, torrent.Piece(index)); err != nil {
+			t.Fatal(err)
+		}
+		node.picker.Done(index)
+	}
+}
+
+// listen accepts peers on a loopback port and returns its address
+func (node *testNode) listen(t *testing.T, ctx context.Context, wg *sync.WaitGroup) models.PeerAddress {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			remote := conn.RemoteAddr().(*net.TCPAddr)
+			address := models.PeerAddress{IP: remote.IP, Port: uint16(remote.Port), Source: models.SourceIncoming}
+
+			if !node.conns.Accept(address) {
+				conn.Close()
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := mse.Accept(conn, node.manifest.InfoHashes(), node.network.Encryption)
+				if err != nil {
+					t.Errorf("encryption handshake with %v failed, %v", address, err)
+					conn.Close()
+					node.conns.Release(address)
+					return
+				}
+				StartPeerWorker(ctx, node.conns, node.network, address, node.id, node.manifest, 0, node.picker, &node.results, node.uploader, &conn)
+			}()
+		}
+	}()
+
+	local := listener.Addr().(*net.TCPAddr)
+	return models.PeerAddress{IP: local.IP, Port: uint16(local.Port), Source: models.SourceTracker}
+}
+
+// connect dials the candidates from the connection manager
+func (node *testNode) connect(ctx context.Context, wg *sync.WaitGroup, candidates ...models.PeerAddress) {
+	node.conns.AddCandidates(candidates)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.conns.Run(ctx, func(address models.PeerAddress) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				StartPeerWorker(ctx, node.conns, node.network, address, node.id, node.manifest, 0, node.picker, &node.results, node.uploader, nil)
+			}()
+		})
+	}()
+}
+
+// waitFinished waits until every leecher downloaded the torrent and checks
+// the data it stored
+func waitFinished(t *testing.T, data []byte, leechers ...*testNode) {
+	deadline := time.Now().Add(60 * time.Second)
+	for i, leecher := range leechers {
+		for !leecher.picker.Finished() {
+			if time.Now().After(deadline) {
+				t.Fatalf("leecher %v has %v of %v pieces", i, leecher.manifest.PieceCount()-leecher.picker.Wanted(), leecher.manifest.PieceCount())
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		stored := make([]byte, len(data))
+		if _, err := leecher.store.ReadAt(stored, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stored, data) {
+			t.Errorf("leecher %v stored different data", i)
+		}
+	}
+}
+
+func TestSwarm(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	torrent := torrenttest.SingleFile(t, "data.bin", 1000000, 32768)
+	data := torrent.Data
+	root := t.TempDir()
+	network := &common.Network{Encryption: mse.Disabled}
+
+	seeder := newTestNode(t, ctx, torrent.Manifest, filepath.Join(root, "seeder"), 1, network)
+	seeder.seed(t, torrent)
+	first := newTestNode(t, ctx, torrent.Manifest, filepath.Join(root, "first"), 2, network)
+	second := newTestNode(t, ctx, torrent.Manifest, filepath.Join(root, "second"), 3, network)
+
+	seederAddress := seeder.listen(t, ctx, &wg)
+	firstAddress := first.listen(t, ctx, &wg)
+	second.listen(t, ctx, &wg)
+
+	// The second leecher also gets pieces from the first one
+	first.connect(ctx, &wg, seederAddress)
+	second.connect(ctx, &wg, seederAddress, firstAddress)
+
+	waitFinished(t, data, first, second)
+
+	if seeder.stats.Uploaded() == 0 {
+		t.Error("seeder uploaded nothing")
+	}
+	if uploaded := seeder.stats.Uploaded() + first.stats.Uploaded() + second.stats.Uploaded(); uploaded < 2*int64(len(data)) {
+		t.Errorf("the swarm uploaded %v bytes for two downloads of %v", uploaded, len(data))
+	}
+}
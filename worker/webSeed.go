@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"torrentClient/common"
+	"torrentClient/models"
+	"torrentClient/picker"
+)
+
+// A web seed failing this many pieces in a row is given up on
+const maxWebSeedFailures = 5
+
+// StartWebSeedWorker downloads pieces from an HTTP web seed (BEP 19) and sends
+// them to the same result channel as the peer workers
+func StartWebSeedWorker(ctx context.Context, network *common.Network, webSeedUrl string, manifest models.Manifest, piecePicker *picker.Picker, pieceJobResultChannel *chan *models.PieceJobResult) {
+	client := network.HTTPClient(60 * time.Second)
+
+	// A web seed has every piece
+	bitField := make(models.Bitfield, (manifest.PieceCount()+7)/8)
+	for i := range bitField {
+		bitField[i] = 0xff
+	}
+
+	failures := 0
+	for !piecePicker.Finished() {
+		pieceJob, ok := piecePicker.Next(bitField)
+		if !ok {
+			// Everything left is being downloaded by peers
+			if !sleep(ctx, 5*time.Second) {
+				return
+			}
+			continue
+		}
+
+		piece, err := common.FetchWebSeedPiece(ctx, client, webSeedUrl, &manifest, pieceJob.PieceIndex)
+		if err == nil && !common.CheckPiece(&manifest, pieceJob.PieceIndex, piece) {
+			err = fmt.Errorf("piece hash doesn't match for piece %v", pieceJob.PieceIndex)
+		}
+
+		if err != nil {
+			piecePicker.Requeue(pieceJob)
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			fmt.Printf("Error downloading piece %v from web seed %v, %v\n", pieceJob.PieceIndex, webSeedUrl, err)
+			if failures >= maxWebSeedFailures {
+				fmt.Printf("Giving up on web seed %v\n", webSeedUrl)
+				return
+			}
+			if !sleep(ctx, time.Duration(failures)*10*time.Second) {
+				return
+			}
+			continue
+		}
+
+		failures = 0
+		select {
+		case *pieceJobResultChannel <- &models.PieceJobResult{
+			PieceIndex: pieceJob.PieceIndex,
+			PieceData:  piece,
+		}:
+		case <-ctx.Done():
+			piecePicker.Requeue(pieceJob)
+			return
+		}
+	}
+}
+
+// sleep waits for the duration, false means the context was done first
+func sleep(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
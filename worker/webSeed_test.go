@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+	"torrentClient/common"
+	"torrentClient/models"
+	"torrentClient/picker"
+	"torrentClient/torrenttest"
+)
+
+func TestWebSeedWorkerRejectsBadPieces(t *testing.T) {
+	torrent := torrenttest.SingleFile(t, "file.bin", 3*16384, 16384)
+	manifest := torrent.Manifest
+	data := torrent.Data
+
+	// The second piece is corrupted on the web seed
+	corrupted := append([]byte{}, data...)
+	corrupted[16384+100] ^= 0xff
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(corrupted))
+	}))
+	defer server.Close()
+
+	have := torrent.Bitfield()
+	piecePicker := picker.New(&manifest, &have)
+	results := make(chan *models.PieceJobResult)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		StartWebSeedWorker(ctx, &common.Network{}, server.URL+"/file.bin", manifest, piecePicker, &results)
+		close(done)
+	}()
+
+	// The worker waits after a failure, the good pieces before it arrive
+	received := []int{}
+	timeout := time.After(time.Second)
+collect:
+	for {
+		select {
+		case result := <-results:
+			if !common.CheckPiece(&manifest, result.PieceIndex, result.PieceData) {
+				t.Errorf("piece %v with a bad hash was sent", result.PieceIndex)
+			}
+			piecePicker.Done(result.PieceIndex)
+			received = append(received, result.PieceIndex)
+		case <-timeout:
+			break collect
+		}
+	}
+	cancel()
+	<-done
+
+	if len(received) != 1 || received[0] != 0 {
+		t.Errorf("received pieces %v, want only the first", received)
+	}
+
+	// The bad piece went back to the picker
+	full := models.Bitfield{0xff}
+	left := []int{}
+	for {
+		job, ok := piecePicker.Next(full)
+		if !ok {
+			break
+		}
+		left = append(left, job.PieceIndex)
+	}
+	sort.Ints(left)
+	if len(left) != 2 || left[0] != 1 || left[1] != 2 {
+		t.Errorf("pieces left to download %v", left)
+	}
+}